@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"sync"
 	"time"
@@ -9,28 +11,26 @@ import (
 
 	"go.etcd.io/etcd/api/v3/etcdserverpb"
 	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
-	"go.etcd.io/etcd/client/pkg/v3/logutil"
 	clientv3 "go.etcd.io/etcd/client/v3"
 
 	"github.com/ahrtr/etcd-defrag/internal/config"
+	"github.com/ahrtr/etcd-defrag/internal/logging"
 )
 
-func memberList(gcfg config.GlobalConfig) (*clientv3.MemberListResponse, error) {
-	cfgSpec := gcfg.ClientConfigWithoutEndpoints()
+func memberList(ctx context.Context, gcfg config.GlobalConfig) (*clientv3.MemberListResponse, error) {
 	eps, err := endpointsFromCmd(gcfg)
 	if err != nil {
 		return nil, err
 	}
-	cfgSpec.Endpoints = eps
 
-	c, err := createClient(cfgSpec)
+	c, release, err := getClient(gcfg, eps...)
 	if err != nil {
 		return nil, err
 	}
 
-	ctx, cancel := commandCtx(gcfg.CommandTimeout)
+	ctx, cancel := commandCtx(ctx, gcfg.CommandTimeout)
 	defer func() {
-		c.Close()
+		release()
 		cancel()
 	}()
 
@@ -53,168 +53,245 @@ func (eh epHealth) String() string {
 	return fmt.Sprintf("endpoint: %s, health: %t, took: %s, error: %s", eh.Ep, eh.Health, eh.Took, eh.Error)
 }
 
-func clusterHealth(gcfg config.GlobalConfig) ([]epHealth, error) {
+func (eh epHealth) fields() []zap.Field {
+	fields := []zap.Field{
+		logging.Phase(phaseHealthCheck),
+		logging.Endpoint(eh.Ep),
+		zap.Bool("health", eh.Health),
+		zap.String("took", eh.Took),
+	}
+	if eh.Error != "" {
+		fields = append(fields, zap.String("error", eh.Error))
+	}
+	return fields
+}
+
+// memberHealth is the health of a member, which is healthy if any of its
+// URLs is.
+type memberHealth struct {
+	member  member
+	healthy bool
+	// urls are the results of the URLs probed, in turn until a healthy one.
+	urls []epHealth
+}
+
+func clusterHealth(ctx context.Context, gcfg config.GlobalConfig) ([]memberHealth, error) {
 	var (
-		eps []string
-		err error
+		members []member
+		err     error
 	)
 
 	if gcfg.SkipHealthcheckClusterEndpoints {
-		eps, err = endpoints(gcfg)
+		members, err = getMembers(ctx, gcfg)
 	} else {
-		eps, err = endpointsFromCluster(gcfg)
+		var resp *clientv3.MemberListResponse
+		if resp, err = memberList(ctx, gcfg); err == nil {
+			members, err = membersFromCluster(gcfg, resp.Members)
+		}
 	}
 
 	if err != nil {
 		return nil, err
 	}
-	lg, err := logutil.CreateDefaultZapLogger(zap.InfoLevel)
-	if err != nil {
-		return nil, err
-	}
-
-	cfgSpec := gcfg.ClientConfigWithoutEndpoints()
-	var cfgs []*clientv3.Config
-	for _, ep := range eps {
-		cfg, err := clientv3.NewClientConfig(&clientv3.ConfigSpec{
-			Endpoints:        []string{ep},
-			DialTimeout:      cfgSpec.DialTimeout,
-			KeepAliveTime:    cfgSpec.KeepAliveTime,
-			KeepAliveTimeout: cfgSpec.KeepAliveTimeout,
-			Secure:           cfgSpec.Secure,
-			Auth:             cfgSpec.Auth,
-		}, lg)
-		if err != nil {
-			return nil, err
-		}
-		cfgs = append(cfgs, cfg)
-	}
 
-	healthCh := make(chan epHealth, len(eps))
+	healthList := make([]memberHealth, len(members))
 
 	var wg sync.WaitGroup
-	for _, cfg := range cfgs {
+	for i, m := range members {
 		wg.Add(1)
-		go func(cfg *clientv3.Config) {
+		go func(i int, m member) {
 			defer wg.Done()
-
-			ep := cfg.Endpoints[0]
-			cfg.Logger = lg.Named("client")
-			cli, err := clientv3.New(*cfg)
-			if err != nil {
-				healthCh <- epHealth{Ep: ep, Health: false, Error: err.Error()}
-				return
-			}
-			startTS := time.Now()
-			ctx, cancel := commandCtx(gcfg.CommandTimeout)
-			defer func() {
-				cli.Close()
-				cancel()
-			}()
-			// get a random key. As long as we can get the response
-			// without an error, the endpoint is health.
-			_, err = cli.Get(ctx, "health")
-			eh := epHealth{Ep: ep, Health: false, Took: time.Since(startTS).String()}
-			if err == nil || err == rpctypes.ErrPermissionDenied {
-				eh.Health = true
-			} else {
-				eh.Error = err.Error()
-			}
-
-			if eh.Health {
-				resp, err := cli.AlarmList(ctx)
-				if err == nil && len(resp.Alarms) > 0 {
-					eh.Health = false
-					eh.Error = "Active Alarm(s): "
-					for _, v := range resp.Alarms {
-						switch v.Alarm {
-						case etcdserverpb.AlarmType_NOSPACE:
-							// We ignore AlarmType_NOSPACE, and we need to
-							// continue to perform defragmentation.
-							eh.Health = true
-							eh.Error = eh.Error + "NOSPACE "
-						case etcdserverpb.AlarmType_CORRUPT:
-							eh.Error = eh.Error + "CORRUPT "
-						default:
-							eh.Error = eh.Error + "UNKNOWN "
-						}
-					}
-				} else if err != nil {
-					eh.Health = false
-					eh.Error = "Unable to fetch the alarm list"
+			mh := memberHealth{member: m}
+			_, err := m.eachURL(func(ep string) error {
+				eh := endpointHealth(ctx, gcfg, ep)
+				mh.urls = append(mh.urls, eh)
+				if !eh.Health {
+					return errors.New(eh.Error)
 				}
-			}
-			healthCh <- eh
-		}(cfg)
+				return nil
+			}, anyError)
+			mh.healthy = err == nil
+			healthList[i] = mh
+		}(i, m)
 	}
 	wg.Wait()
-	close(healthCh)
 
-	var healthList []epHealth
-	for h := range healthCh {
-		healthList = append(healthList, h)
+	return healthList, nil
+}
+
+// endpointHealth probes the health of the endpoint, see clusterHealth.
+func endpointHealth(ctx context.Context, gcfg config.GlobalConfig, ep string) epHealth {
+	// The clients of the health check are reused by the rest of the run, so
+	// the connections are only established once.
+	cli, release, err := getClient(gcfg, ep)
+	if err != nil {
+		return epHealth{Ep: ep, Health: false, Error: err.Error()}
+	}
+	startTS := time.Now()
+	ctx, cancel := commandCtx(ctx, gcfg.CommandTimeout)
+	defer func() {
+		release()
+		cancel()
+	}()
+	// get a random key. As long as we can get the response
+	// without an error, the endpoint is health.
+	_, err = cli.Get(ctx, "health")
+	eh := epHealth{Ep: ep, Health: false, Took: time.Since(startTS).String()}
+	if err == nil || err == rpctypes.ErrPermissionDenied {
+		eh.Health = true
+	} else {
+		eh.Error = err.Error()
 	}
 
-	return healthList, nil
+	if eh.Health {
+		resp, err := cli.AlarmList(ctx)
+		if err == nil && len(resp.Alarms) > 0 {
+			eh.Health = false
+			eh.Error = "Active Alarm(s): "
+			for _, v := range resp.Alarms {
+				switch v.Alarm {
+				case etcdserverpb.AlarmType_NOSPACE:
+					// We ignore AlarmType_NOSPACE, and we need to
+					// continue to perform defragmentation.
+					eh.Health = true
+					eh.Error = eh.Error + "NOSPACE "
+				case etcdserverpb.AlarmType_CORRUPT:
+					eh.Error = eh.Error + "CORRUPT "
+				default:
+					eh.Error = eh.Error + "UNKNOWN "
+				}
+			}
+		} else if err != nil {
+			eh.Health = false
+			eh.Error = "Unable to fetch the alarm list"
+		}
+	}
+	return eh
 }
 
 type epStatus struct {
-	Ep   string                   `json:"Endpoint"`
-	Resp *clientv3.StatusResponse `json:"Status"`
+	// Ep is the URL of the member which returned the status.
+	Ep     string                   `json:"Endpoint"`
+	Member member                   `json:"Member"`
+	Resp   *clientv3.StatusResponse `json:"Status"`
 }
 
 func (es epStatus) String() string {
-	return fmt.Sprintf("endpoint: %s, dbSize: %d, dbSizeInUse: %d, memberId: %x, leader: %x, revision: %d, term: %d, index: %d",
-		es.Ep, es.Resp.DbSize, es.Resp.DbSizeInUse, es.Resp.Header.MemberId, es.Resp.Leader, es.Resp.Header.Revision, es.Resp.RaftTerm, es.Resp.RaftIndex)
+	return fmt.Sprintf("endpoint: %s, member: %s, dbSize: %d, dbSizeInUse: %d, memberId: %x, leader: %x, revision: %d, term: %d, index: %d",
+		es.Ep, es.Member.Name, es.Resp.DbSize, es.Resp.DbSizeInUse, es.Resp.Header.MemberId, es.Resp.Leader, es.Resp.Header.Revision, es.Resp.RaftTerm, es.Resp.RaftIndex)
 }
 
-func membersStatus(gcfg config.GlobalConfig) ([]epStatus, error) {
-	eps, err := endpoints(gcfg)
-	if err != nil {
-		return nil, err
+// memberString identifies the member in the output, falling back to the
+// endpoint if the member is unknown.
+func (es epStatus) memberString() string {
+	if es.Member.ID == 0 {
+		return es.Ep
 	}
+	return es.Member.String()
+}
+
+func (es epStatus) fields() []zap.Field {
+	fields := []zap.Field{
+		logging.Endpoint(es.Ep),
+		logging.MemberID(es.Resp.Header.MemberId),
+		logging.MemberName(es.Member.Name),
+		zap.Int64("dbSize", es.Resp.DbSize),
+		zap.Int64("dbSizeInUse", es.Resp.DbSizeInUse),
+		zap.String("leader", fmt.Sprintf("%x", es.Resp.Leader)),
+		zap.Int64("revision", es.Resp.Header.Revision),
+		zap.Uint64("term", es.Resp.RaftTerm),
+		zap.Uint64("index", es.Resp.RaftIndex),
+	}
+	if es.Resp.DbSizeQuota > 0 {
+		fields = append(fields, zap.Int64("dbSizeQuota", es.Resp.DbSizeQuota))
+	}
+	return fields
+}
 
-	var statusList []epStatus
-	for _, ep := range eps {
-		status, err := memberStatus(gcfg, ep)
+// dbQuota returns the storage quota of the member. etcd v3.6+ reports the
+// quota in the status response; --etcd-storage-quota-bytes is only used as
+// a fallback for older versions.
+func (es epStatus) dbQuota(gcfg config.GlobalConfig) int64 {
+	if es.Resp != nil && es.Resp.DbSizeQuota > 0 {
+		return es.Resp.DbSizeQuota
+	}
+	return gcfg.EtcdStorageQuotaBytes
+}
+
+// membersStatus gets the status of the members in parallel, with at most
+// --status-concurrency requests in flight, but at least one. The status list
+// is in the order of the members.
+func membersStatus(ctx context.Context, gcfg config.GlobalConfig, members []member) ([]epStatus, error) {
+	statusList := make([]epStatus, len(members))
+	errs := make([]error, len(members))
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, max(gcfg.StatusConcurrency, 1))
+	for i, m := range members {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, m member) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			statusList[i], errs[i] = memberStatus(ctx, gcfg, m)
+		}(i, m)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
 		if err != nil {
-			return nil, fmt.Errorf("failed to get member(%q) status: %w", ep, err)
+			return nil, fmt.Errorf("failed to get member(%s) status: %w", members[i], err)
 		}
-		statusList = append(statusList, status)
 	}
-
 	return statusList, nil
 }
 
-func memberStatus(gcfg config.GlobalConfig, ep string) (epStatus, error) {
-	cfgSpec := gcfg.ClientConfigWithoutEndpoints()
-	cfgSpec.Endpoints = []string{ep}
-	c, err := createClient(cfgSpec)
+// memberStatus gets the status of the member, falling back to its other URLs
+// on any error.
+func memberStatus(ctx context.Context, gcfg config.GlobalConfig, m member) (epStatus, error) {
+	var resp *clientv3.StatusResponse
+	ep, err := m.eachURL(func(ep string) (err error) {
+		resp, err = endpointStatus(ctx, gcfg, ep)
+		return err
+	}, anyError)
+
+	return epStatus{Ep: ep, Member: m, Resp: resp}, err
+}
+
+func endpointStatus(ctx context.Context, gcfg config.GlobalConfig, ep string) (*clientv3.StatusResponse, error) {
+	c, release, err := getClient(gcfg, ep)
 	if err != nil {
-		return epStatus{}, fmt.Errorf("failed to createClient: %w", err)
+		return nil, &createClientError{err: err}
 	}
 
-	ctx, cancel := commandCtx(gcfg.CommandTimeout)
+	ctx, cancel := commandCtx(ctx, gcfg.CommandTimeout)
 	defer func() {
-		c.Close()
+		release()
 		cancel()
 	}()
-	resp, err := c.Status(ctx, ep)
+	return c.Status(ctx, ep)
+}
 
-	return epStatus{Ep: ep, Resp: resp}, err
+// compact compacts the keyspace via the member, falling back to its other
+// URLs on any error, since compacting twice at the same revision is harmless.
+// It returns the URL used.
+func compact(ctx context.Context, gcfg config.GlobalConfig, rev int64, m member) (string, error) {
+	return m.eachURL(func(ep string) error {
+		return compactEndpoint(ctx, gcfg, rev, ep)
+	}, anyError)
 }
 
-func compact(gcfg config.GlobalConfig, rev int64, ep string) error {
-	cfgSpec := gcfg.ClientConfigWithoutEndpoints()
-	cfgSpec.Endpoints = []string{ep}
-	c, err := createClient(cfgSpec)
+func compactEndpoint(ctx context.Context, gcfg config.GlobalConfig, rev int64, ep string) error {
+	c, release, err := getClient(gcfg, ep)
 	if err != nil {
-		return err
+		return &createClientError{err: err}
 	}
 
-	ctx, cancel := commandCtx(gcfg.CommandTimeout)
+	ctx, cancel := commandCtx(ctx, gcfg.CommandTimeout)
 	defer func() {
-		c.Close()
+		release()
 		cancel()
 	}()
 
@@ -222,17 +299,24 @@ func compact(gcfg config.GlobalConfig, rev int64, ep string) error {
 	return err
 }
 
-func defragment(gcfg config.GlobalConfig, ep string) error {
-	cfgSpec := gcfg.ClientConfigWithoutEndpoints()
-	cfgSpec.Endpoints = []string{ep}
-	c, err := createClient(cfgSpec)
+// defragment defragments the member. It only falls back to its other URLs
+// if a URL is unreachable, otherwise the member might be defragmented twice.
+// It returns the URL used.
+func defragment(ctx context.Context, gcfg config.GlobalConfig, m member) (string, error) {
+	return m.eachURL(func(ep string) error {
+		return defragmentEndpoint(ctx, gcfg, ep)
+	}, isUnavailable)
+}
+
+func defragmentEndpoint(ctx context.Context, gcfg config.GlobalConfig, ep string) error {
+	c, release, err := getClient(gcfg, ep)
 	if err != nil {
-		return err
+		return &createClientError{err: err}
 	}
 
-	ctx, cancel := commandCtx(gcfg.CommandTimeout)
+	ctx, cancel := commandCtx(ctx, gcfg.CommandTimeout)
 	defer func() {
-		c.Close()
+		release()
 		cancel()
 	}()
 
@@ -240,17 +324,25 @@ func defragment(gcfg config.GlobalConfig, ep string) error {
 	return err
 }
 
-func transferLeadership(gcfg config.GlobalConfig, leaderEp string, transfereeID uint64) error {
-	cfgSpec := gcfg.ClientConfigWithoutEndpoints()
-	cfgSpec.Endpoints = []string{leaderEp}
-	c, err := createClient(cfgSpec)
+// transferLeadership transfers the leadership from the leader member to the
+// transferee, falling back to the other URLs of the leader if a URL is
+// unreachable.
+func transferLeadership(ctx context.Context, gcfg config.GlobalConfig, leader member, transfereeID uint64) error {
+	_, err := leader.eachURL(func(ep string) error {
+		return transferLeadershipVia(ctx, gcfg, ep, transfereeID)
+	}, isUnavailable)
+	return err
+}
+
+func transferLeadershipVia(ctx context.Context, gcfg config.GlobalConfig, leaderEp string, transfereeID uint64) error {
+	c, release, err := getClient(gcfg, leaderEp)
 	if err != nil {
-		return fmt.Errorf("failed to create client for leader endpoint %s: %w", leaderEp, err)
+		return &createClientError{err: fmt.Errorf("leader endpoint %s: %w", leaderEp, err)}
 	}
 
-	ctx, cancel := commandCtx(gcfg.CommandTimeout)
+	ctx, cancel := commandCtx(ctx, gcfg.CommandTimeout)
 	defer func() {
-		c.Close()
+		release()
 		cancel()
 	}()
 
@@ -263,22 +355,20 @@ func transferLeadership(gcfg config.GlobalConfig, leaderEp string, transfereeID
 }
 
 // noSpaceAlarms gets all NOSPACE alarms from the cluster
-func noSpaceAlarms(gcfg config.GlobalConfig) ([]*etcdserverpb.AlarmMember, error) {
-	eps, err := endpoints(gcfg)
+func noSpaceAlarms(ctx context.Context, gcfg config.GlobalConfig) ([]*etcdserverpb.AlarmMember, error) {
+	eps, err := endpoints(ctx, gcfg)
 	if err != nil {
 		return nil, err
 	}
 
-	cfgSpec := gcfg.ClientConfigWithoutEndpoints()
-	cfgSpec.Endpoints = eps
-	c, err := createClient(cfgSpec)
+	c, release, err := getClient(gcfg, eps...)
 	if err != nil {
 		return nil, err
 	}
 
-	ctx, cancel := commandCtx(gcfg.CommandTimeout)
+	ctx, cancel := commandCtx(ctx, gcfg.CommandTimeout)
 	defer func() {
-		c.Close()
+		release()
 		cancel()
 	}()
 
@@ -298,26 +388,24 @@ func noSpaceAlarms(gcfg config.GlobalConfig) ([]*etcdserverpb.AlarmMember, error
 }
 
 // disAlarmNoSpaceAlarms disalarms the provided NOSPACE alarms
-func disAlarmNoSpaceAlarms(gcfg config.GlobalConfig, nospaceAlarms []*etcdserverpb.AlarmMember) error {
+func disAlarmNoSpaceAlarms(ctx context.Context, gcfg config.GlobalConfig, nospaceAlarms []*etcdserverpb.AlarmMember) error {
 	if len(nospaceAlarms) == 0 {
 		return nil // No NOSPACE alarms to disalarm
 	}
 
-	eps, err := endpoints(gcfg)
+	eps, err := endpoints(ctx, gcfg)
 	if err != nil {
 		return err
 	}
 
-	cfgSpec := gcfg.ClientConfigWithoutEndpoints()
-	cfgSpec.Endpoints = eps
-	c, err := createClient(cfgSpec)
+	c, release, err := getClient(gcfg, eps...)
 	if err != nil {
 		return err
 	}
 
-	ctx, cancel := commandCtx(gcfg.CommandTimeout)
+	ctx, cancel := commandCtx(ctx, gcfg.CommandTimeout)
 	defer func() {
-		c.Close()
+		release()
 		cancel()
 	}()
 
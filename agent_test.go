@@ -2,7 +2,11 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 	"go.etcd.io/etcd/api/v3/etcdserverpb"
@@ -86,7 +90,7 @@ func TestEndpointsForHealthCheck_SkipHealthcheckClusterEndpoints(t *testing.T) {
 			if cfg.SkipHealthcheckClusterEndpoints {
 				actualEndpoints, err = endpointsFromCmd(cfg)
 			} else {
-				actualEndpoints, err = endpointsFromCluster(cfg)
+				actualEndpoints, err = endpointsFromCluster(context.Background(), cfg)
 			}
 
 			require.NoError(t, err)
@@ -153,7 +157,7 @@ func TestEndpointsFromCluster_ExcludesLearners(t *testing.T) {
 				Endpoints: []string{"192.168.1.10:2379"},
 			}
 
-			actualEndpoints, err := endpointsFromCluster(cfg)
+			actualEndpoints, err := endpointsFromCluster(context.Background(), cfg)
 			require.NoError(t, err)
 			require.ElementsMatch(t, tc.expectedEndpoints, actualEndpoints)
 		})
@@ -227,6 +231,19 @@ func TestCheckAllMembersDBSize(t *testing.T) {
 			},
 			expectedEps: []string{"ep1", "ep2"},
 		},
+		{
+			name: "quota reported by the members takes precedence",
+			gcfg: config.GlobalConfig{
+				EtcdStorageQuotaBytes: 1000,
+				DisalarmThreshold:     0.8,
+			},
+			statusList: []epStatus{
+				{Ep: "ep1", Resp: &clientv3.StatusResponse{DbSize: 900, DbSizeQuota: 2000}}, // v3.6+ member
+				{Ep: "ep2", Resp: &clientv3.StatusResponse{DbSize: 1700, DbSizeQuota: 2000}},
+				{Ep: "ep3", Resp: &clientv3.StatusResponse{DbSize: 900}}, // v3.5 member, fallback to the flag
+			},
+			expectedEps: []string{"ep2", "ep3"},
+		},
 		{
 			name: "threshold at boundary",
 			gcfg: config.GlobalConfig{
@@ -262,3 +279,55 @@ func (f *fakeHealthCheckClient) MemberList(ctx context.Context, opts ...clientv3
 func (f *fakeHealthCheckClient) Close() error {
 	return nil
 }
+
+// fakeMultiURLClient makes etcd-1 of fakeClusterClient advertise the dead
+// URL ep1-dead before ep1.
+type fakeMultiURLClient struct {
+	*fakeClusterClient
+}
+
+func (f *fakeMultiURLClient) MemberList(ctx context.Context, opts ...clientv3.OpOption) (*clientv3.MemberListResponse, error) {
+	resp, _ := f.fakeClusterClient.MemberList(ctx, opts...)
+	resp.Members[0].ClientURLs = []string{"ep1-dead", "ep1"}
+	return resp, nil
+}
+
+func TestRunDefrag_DeadURL(t *testing.T) {
+	oldCreateClient := createClient
+	t.Cleanup(func() {
+		createClient = oldCreateClient
+	})
+
+	onDefrag := func(ctx context.Context, ep string) error {
+		return nil
+	}
+	createClient = func(cfgSpec *clientv3.ConfigSpec) (EtcdCluster, error) {
+		if cfgSpec.Endpoints[0] == "ep1-dead" {
+			return nil, errors.New("connection refused")
+		}
+		return &fakeMultiURLClient{&fakeClusterClient{onDefrag: onDefrag}}, nil
+	}
+
+	reportFile := filepath.Join(t.TempDir(), "report.json")
+	gcfg := config.GlobalConfig{
+		Endpoints:             []string{"ep2"},
+		Cluster:               true,
+		CommandTimeout:        time.Minute,
+		EtcdStorageQuotaBytes: 2 * 1024 * 1024 * 1024,
+		ReportFile:            reportFile,
+		ReportFormat:          "json",
+	}
+	require.NoError(t, runDefrag(context.Background(), gcfg))
+
+	report := readReport(t, reportFile)
+	var health []string
+	for _, eh := range report.HealthCheck {
+		health = append(health, fmt.Sprintf("%s:%t", eh.Ep, eh.Health))
+	}
+	require.ElementsMatch(t, []string{"ep1-dead:false", "ep1:true", "ep2:true", "ep3:true"}, health)
+	require.Len(t, report.Endpoints, 3)
+	require.Equal(t, "ep1", report.Endpoints[0].Endpoint)
+	for _, er := range report.Endpoints {
+		require.Equal(t, actionDefragmented, er.Action)
+	}
+}
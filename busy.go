@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/ahrtr/etcd-defrag/internal/config"
+	"github.com/ahrtr/etcd-defrag/internal/logging"
+)
+
+// busyPollInterval is how often the status of a member whose
+// defragmentation timed out is polled.
+var busyPollInterval = time.Second
+
+// errStillBusy is returned when a member whose defragmentation timed out
+// hasn't completed it within --max-busy-wait.
+var errStillBusy = errors.New("still busy defragmenting")
+
+// isTimeout returns whether the request exceeded --command-timeout. The
+// defragmentation keeps running on the member in that case.
+func isTimeout(err error) bool {
+	return errors.Is(err, context.DeadlineExceeded) || status.Code(err) == codes.DeadlineExceeded
+}
+
+// waitForDefragment polls the status of the member whose defragmentation
+// timed out, until it responds again with a DbSize different from the one
+// before the defragmentation, which means the defragmentation is completed.
+// It gives up with errStillBusy after --max-busy-wait.
+func waitForDefragment(ctx context.Context, gcfg config.GlobalConfig, m member, before epStatus) error {
+	lg.Warn("The defragmentation exceeded --command-timeout, waiting for the member to complete it", append(m.fields(), logging.Phase(phaseDefrag), zap.Duration("maxBusyWait", gcfg.MaxBusyWait))...)
+	deadline := time.Now().Add(gcfg.MaxBusyWait)
+	for {
+		if !sleepCtx(ctx, busyPollInterval) {
+			return ctx.Err()
+		}
+		s, err := memberStatus(ctx, gcfg, m)
+		if err == nil && s.Resp.DbSize != before.Resp.DbSize {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			if err != nil {
+				return fmt.Errorf("%w after %v, the last status error: %w", errStillBusy, gcfg.MaxBusyWait, err)
+			}
+			return fmt.Errorf("%w after %v", errStillBusy, gcfg.MaxBusyWait)
+		}
+		lg.Debug("The member is still busy", append(m.fields(), logging.Phase(phaseDefrag), zap.Error(err))...)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/ahrtr/etcd-defrag/internal/config"
+)
+
+func TestRunDefrag_Timeout(t *testing.T) {
+	oldCreateClient, oldInterval := createClient, busyPollInterval
+	busyPollInterval = time.Millisecond
+	t.Cleanup(func() {
+		createClient, busyPollInterval = oldCreateClient, oldInterval
+	})
+
+	testCases := []struct {
+		name            string
+		busyPolls       int
+		expectedErr     error
+		expectedActions []string
+	}{
+		{
+			name:            "completed after timeout",
+			busyPolls:       3,
+			expectedActions: []string{"etcd-1:completedAfterTimeout", "etcd-2:defragmented", "etcd-3:defragmented"},
+		},
+		{
+			name:            "still busy",
+			busyPolls:       1000,
+			expectedErr:     errStillBusy,
+			expectedActions: []string{"etcd-1:stillBusy", "etcd-2:notStarted", "etcd-3:notStarted"},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// The defragmentation of ep1 times out, then ep1 doesn't respond
+			// for busyPolls status requests, and finally reports a smaller
+			// DbSize.
+			var (
+				mu    sync.Mutex
+				polls = -1
+			)
+			onDefrag := func(ctx context.Context, ep string) error {
+				mu.Lock()
+				defer mu.Unlock()
+				if ep == "ep1" {
+					polls = 0
+					return status.Error(codes.DeadlineExceeded, "context deadline exceeded")
+				}
+				return nil
+			}
+			onStatus := func(ep string, resp *clientv3.StatusResponse) error {
+				mu.Lock()
+				defer mu.Unlock()
+				if ep != "ep1" || polls < 0 {
+					return nil
+				}
+				if polls < tc.busyPolls {
+					polls++
+					return status.Error(codes.DeadlineExceeded, "context deadline exceeded")
+				}
+				resp.DbSize = 500
+				return nil
+			}
+			createClient = func(cfgSpec *clientv3.ConfigSpec) (EtcdCluster, error) {
+				return &fakeClusterClient{onDefrag: onDefrag, onStatus: onStatus}, nil
+			}
+
+			reportFile := filepath.Join(t.TempDir(), "report.json")
+			gcfg := config.GlobalConfig{
+				Endpoints:             []string{"ep1"},
+				Cluster:               true,
+				ContinueOnError:       true,
+				CommandTimeout:        time.Minute,
+				MaxBusyWait:           100 * time.Millisecond,
+				EtcdStorageQuotaBytes: 2 * 1024 * 1024 * 1024,
+				ReportFile:            reportFile,
+				ReportFormat:          "json",
+			}
+			err := runDefrag(context.Background(), gcfg)
+			if tc.expectedErr != nil {
+				require.ErrorIs(t, err, tc.expectedErr)
+			} else {
+				require.NoError(t, err)
+			}
+
+			require.Equal(t, tc.expectedActions, reportActions(t, reportFile))
+		})
+	}
+}
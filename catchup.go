@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/ahrtr/etcd-defrag/internal/config"
+	"github.com/ahrtr/etcd-defrag/internal/logging"
+)
+
+// catchUpPollInterval is how often the status of a defragmented member is
+// polled until it catches up.
+var catchUpPollInterval = time.Second
+
+// errNotCaughtUp is returned when a defragmented member hasn't caught up
+// within --catch-up-timeout.
+var errNotCaughtUp = errors.New("not caught up")
+
+// waitForCatchUp polls the status of the defragmented member, until its
+// applied index is within --catch-up-max-lag of the raft index of the leader,
+// and it passes the health check. It gives up with errNotCaughtUp after
+// --catch-up-timeout. The members are used to look up the leader.
+func waitForCatchUp(ctx context.Context, gcfg config.GlobalConfig, m member, members []member) error {
+	lg.Info("Waiting for the member to catch up", append(m.fields(), logging.Phase(phaseCatchUp), zap.Uint64("maxLag", gcfg.CatchUpMaxLag), zap.Duration("timeout", gcfg.CatchUpTimeout))...)
+	startTS := time.Now()
+	deadline := startTS.Add(gcfg.CatchUpTimeout)
+	for {
+		lag, err := catchUpLag(ctx, gcfg, m, members)
+		if err == nil && lag > gcfg.CatchUpMaxLag {
+			err = fmt.Errorf("the applied index is %d entries behind the leader", lag)
+		}
+		if err == nil {
+			lg.Info("The member caught up", append(m.fields(), logging.Phase(phaseCatchUp), zap.Uint64("lag", lag), zap.Duration("took", time.Since(startTS)))...)
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%w within %v: %w", errNotCaughtUp, gcfg.CatchUpTimeout, err)
+		}
+		lg.Debug("The member hasn't caught up yet", append(m.fields(), logging.Phase(phaseCatchUp), zap.Error(err))...)
+		if !sleepCtx(ctx, catchUpPollInterval) {
+			return ctx.Err()
+		}
+	}
+}
+
+// catchUpLag returns how many entries the applied index of the member lags
+// behind the raft index of the leader. It fails if the member is unhealthy.
+func catchUpLag(ctx context.Context, gcfg config.GlobalConfig, m member, members []member) (uint64, error) {
+	status, err := memberStatus(ctx, gcfg, m)
+	if err != nil {
+		return 0, err
+	}
+	leaderID := status.Resp.Leader
+	if leaderID == 0 {
+		return 0, errors.New("the member has no leader")
+	}
+
+	leaderStatus := status
+	if leaderID != m.ID {
+		leader, err := memberByID(ctx, gcfg, members, leaderID)
+		if err != nil {
+			return 0, err
+		}
+		if leaderStatus, err = memberStatus(ctx, gcfg, leader); err != nil {
+			return 0, fmt.Errorf("failed to get the status of the leader %s: %w", leader, err)
+		}
+	}
+
+	if eh := endpointHealth(ctx, gcfg, status.Ep); !eh.Health {
+		return 0, fmt.Errorf("the member is unhealthy: %s", eh.Error)
+	}
+
+	if status.Resp.RaftAppliedIndex >= leaderStatus.Resp.RaftIndex {
+		return 0, nil
+	}
+	return leaderStatus.Resp.RaftIndex - status.Resp.RaftAppliedIndex, nil
+}
+
+// memberByID returns the member with the ID from the members, or from the
+// member list of the cluster if it isn't one of them.
+func memberByID(ctx context.Context, gcfg config.GlobalConfig, members []member, id uint64) (member, error) {
+	for _, m := range members {
+		if m.ID == id {
+			return m, nil
+		}
+	}
+	resp, err := memberList(ctx, gcfg)
+	if err != nil {
+		return member{}, fmt.Errorf("failed to get member list: %w", err)
+	}
+	list, err := membersFromCluster(gcfg, resp.Members)
+	if err != nil {
+		return member{}, err
+	}
+	for _, m := range list {
+		if m.ID == id {
+			return m, nil
+		}
+	}
+	return member{}, fmt.Errorf("member %x not found in the member list", id)
+}
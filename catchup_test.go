@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	clientv3 "go.etcd.io/etcd/client/v3"
+
+	"github.com/ahrtr/etcd-defrag/internal/config"
+)
+
+func TestRunDefrag_CatchUp(t *testing.T) {
+	oldCreateClient, oldInterval := createClient, catchUpPollInterval
+	catchUpPollInterval = time.Millisecond
+	t.Cleanup(func() {
+		createClient, catchUpPollInterval = oldCreateClient, oldInterval
+	})
+
+	testCases := []struct {
+		name            string
+		step            int64
+		expectedErr     error
+		expectedActions []string
+	}{
+		{
+			name:            "caught up",
+			step:            1000,
+			expectedActions: []string{"etcd-1:defragmented", "etcd-2:defragmented", "etcd-3:defragmented"},
+		},
+		{
+			name:            "not caught up",
+			step:            0,
+			expectedErr:     errNotCaughtUp,
+			expectedActions: []string{"etcd-1:defragmented", "etcd-2:notStarted", "etcd-3:notStarted"},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// The leader is at raft index 5000. Once defragmented, the
+			// applied index of ep1 starts at 1000, and advances by step on
+			// each status request.
+			var (
+				mu      sync.Mutex
+				applied int64 = -1
+			)
+			onDefrag := func(ctx context.Context, ep string) error {
+				mu.Lock()
+				defer mu.Unlock()
+				if ep == "ep1" {
+					applied = 1000
+				}
+				return nil
+			}
+			onStatus := func(ep string, resp *clientv3.StatusResponse) error {
+				mu.Lock()
+				defer mu.Unlock()
+				resp.RaftIndex = 5000
+				resp.RaftAppliedIndex = 5000
+				if ep == "ep1" && applied >= 0 {
+					resp.RaftAppliedIndex = uint64(applied)
+					applied = min(applied+tc.step, 5000)
+				}
+				return nil
+			}
+			createClient = func(cfgSpec *clientv3.ConfigSpec) (EtcdCluster, error) {
+				return &fakeClusterClient{onDefrag: onDefrag, onStatus: onStatus}, nil
+			}
+
+			reportFile := filepath.Join(t.TempDir(), "report.json")
+			gcfg := config.GlobalConfig{
+				Endpoints:             []string{"ep1"},
+				Cluster:               true,
+				ContinueOnError:       true,
+				CommandTimeout:        time.Minute,
+				CatchUpTimeout:        100 * time.Millisecond,
+				CatchUpMaxLag:         1000,
+				EtcdStorageQuotaBytes: 2 * 1024 * 1024 * 1024,
+				ReportFile:            reportFile,
+				ReportFormat:          "json",
+			}
+			err := runDefrag(context.Background(), gcfg)
+			if tc.expectedErr != nil {
+				require.ErrorIs(t, err, tc.expectedErr)
+				require.ErrorContains(t, err, "the applied index is 4000 entries behind the leader")
+			} else {
+				require.NoError(t, err)
+			}
+
+			require.Equal(t, tc.expectedActions, reportActions(t, reportFile))
+		})
+	}
+}
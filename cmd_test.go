@@ -2,6 +2,7 @@ package main
 
 import (
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -32,6 +33,10 @@ func TestAllFlags(t *testing.T) {
 				CommandTimeout:        30 * time.Second,
 				KeepaliveTime:         2 * time.Second,
 				KeepaliveTimeout:      6 * time.Second,
+				StatusConcurrency:     4,
+				MaxBusyWait:           10 * time.Minute,
+				CatchUpMaxLag:         1000,
+				MaxConcurrentDefrags:  1,
 				InsecureTransport:     true,
 				InsecureSkipVerify:    false,
 				Cert:                  "",
@@ -50,6 +55,12 @@ func TestAllFlags(t *testing.T) {
 				DryRun:                false,
 				AutoDisalarm:          false,
 				DisalarmThreshold:     0.9,
+				RuleScope:             "member",
+				RuleLanguage:          "goval",
+				ReportFormat:          "json",
+				LogLevel:              "info",
+				LogFormat:             "text",
+				ClientLogLevel:        "error",
 			},
 		},
 		{
@@ -63,6 +74,7 @@ func TestAllFlags(t *testing.T) {
 				"ETCD_DEFRAG_COMMAND_TIMEOUT":          "45s",
 				"ETCD_DEFRAG_KEEPALIVE_TIME":           "3s",
 				"ETCD_DEFRAG_KEEPALIVE_TIMEOUT":        "8s",
+				"ETCD_DEFRAG_STATUS_CONCURRENCY":       "2",
 				"ETCD_DEFRAG_INSECURE_TRANSPORT":       "false",
 				"ETCD_DEFRAG_INSECURE_SKIP_TLS_VERIFY": "true",
 				"ETCD_DEFRAG_CERT":                     "/path/to/cert",
@@ -92,6 +104,10 @@ func TestAllFlags(t *testing.T) {
 				CommandTimeout:        45 * time.Second,
 				KeepaliveTime:         3 * time.Second,
 				KeepaliveTimeout:      8 * time.Second,
+				StatusConcurrency:     2,
+				MaxBusyWait:           10 * time.Minute,
+				CatchUpMaxLag:         1000,
+				MaxConcurrentDefrags:  1,
 				InsecureTransport:     false,
 				InsecureSkipVerify:    true,
 				Cert:                  "/path/to/cert",
@@ -110,6 +126,12 @@ func TestAllFlags(t *testing.T) {
 				DryRun:                true,
 				AutoDisalarm:          false,
 				DisalarmThreshold:     0.9,
+				RuleScope:             "member",
+				RuleLanguage:          "goval",
+				ReportFormat:          "json",
+				LogLevel:              "info",
+				LogFormat:             "text",
+				ClientLogLevel:        "error",
 			},
 		},
 		{
@@ -129,6 +151,15 @@ func TestAllFlags(t *testing.T) {
 				"--command-timeout=50s",
 				"--keepalive-time=4s",
 				"--keepalive-timeout=10s",
+				"--status-concurrency=8",
+				"--pause-file=/cli/pause",
+				"--catch-up-timeout=2m",
+				"--catch-up-max-lag=50",
+				"--move-leader-to=etcd-2",
+				"--restore-leader=true",
+				"--min-healthy-after=quorum+1",
+				"--max-concurrent-defrags=2",
+				"--member-zones=etcd-1=zone-a,etcd-2=zone-b",
 				"--insecure-transport=false",
 				"--insecure-skip-tls-verify=true",
 				"--cert=/cli/cert",
@@ -155,11 +186,21 @@ func TestAllFlags(t *testing.T) {
 				CommandTimeout:        50 * time.Second,
 				KeepaliveTime:         4 * time.Second,
 				KeepaliveTimeout:      10 * time.Second,
+				StatusConcurrency:     8,
+				MaxBusyWait:           10 * time.Minute,
+				CatchUpTimeout:        2 * time.Minute,
+				CatchUpMaxLag:         50,
+				MoveLeaderTo:          "etcd-2",
+				RestoreLeader:         true,
+				MinHealthyAfter:       "quorum+1",
+				MaxConcurrentDefrags:  2,
+				MemberZones:           []string{"etcd-1=zone-a", "etcd-2=zone-b"},
 				InsecureTransport:     false,
 				InsecureSkipVerify:    true,
 				Cert:                  "/cli/cert",
 				Key:                   "/cli/key",
 				CaCert:                "/cli/ca",
+				PauseFile:             "/cli/pause",
 				User:                  "cliuser",
 				Password:              "clipass",
 				DiscoverySrv:          "cli.mydomain",
@@ -173,6 +214,12 @@ func TestAllFlags(t *testing.T) {
 				DryRun:                true,
 				AutoDisalarm:          false,
 				DisalarmThreshold:     0.9,
+				RuleScope:             "member",
+				RuleLanguage:          "goval",
+				ReportFormat:          "json",
+				LogLevel:              "info",
+				LogFormat:             "text",
+				ClientLogLevel:        "error",
 			},
 		},
 		{
@@ -198,8 +245,12 @@ func TestAllFlags(t *testing.T) {
 				CommandTimeout:        30 * time.Second, // default
 				KeepaliveTime:         2 * time.Second,  // default
 				KeepaliveTimeout:      6 * time.Second,  // default
-				InsecureTransport:     true,             // default
-				InsecureSkipVerify:    false,            // default
+				StatusConcurrency:     4,
+				MaxBusyWait:           10 * time.Minute,
+				CatchUpMaxLag:         1000,
+				MaxConcurrentDefrags:  1,
+				InsecureTransport:     true,  // default
+				InsecureSkipVerify:    false, // default
 				Cert:                  "",
 				Key:                   "",
 				CaCert:                "",
@@ -216,6 +267,12 @@ func TestAllFlags(t *testing.T) {
 				DryRun:                false, // default
 				AutoDisalarm:          false, // default
 				DisalarmThreshold:     0.9,
+				RuleScope:             "member",
+				RuleLanguage:          "goval",
+				ReportFormat:          "json",
+				LogLevel:              "info",
+				LogFormat:             "text",
+				ClientLogLevel:        "error",
 			},
 		},
 	}
@@ -249,3 +306,113 @@ func TestAllFlags(t *testing.T) {
 		})
 	}
 }
+
+func TestAllFlags_ConfigFile(t *testing.T) {
+	testCases := []struct {
+		name        string
+		fileName    string
+		content     string
+		env         map[string]string
+		cli         []string
+		expectedErr string
+		check       func(t *testing.T, cfg config.GlobalConfig)
+	}{
+		{
+			name:     "values from yaml file",
+			fileName: "config.yaml",
+			content: `
+endpoints:
+  - 10.0.0.1:2379
+  - 10.0.0.2:2379
+cluster: true
+command-timeout: 45s
+etcd-storage-quota-bytes: 8589934592
+defrag-rule: "dbQuotaUsage > 0.8 || dbSizeFree > 200*1024*1024"
+cacert: /etc/etcd/ca.crt
+`,
+			check: func(t *testing.T, cfg config.GlobalConfig) {
+				require.Equal(t, []string{"10.0.0.1:2379", "10.0.0.2:2379"}, cfg.Endpoints)
+				require.True(t, cfg.Cluster)
+				require.Equal(t, 45*time.Second, cfg.CommandTimeout)
+				require.Equal(t, int64(8589934592), cfg.EtcdStorageQuotaBytes)
+				require.Equal(t, "dbQuotaUsage > 0.8 || dbSizeFree > 200*1024*1024", cfg.DefragRule)
+				require.Equal(t, "/etc/etcd/ca.crt", cfg.CaCert)
+				// not in the file, so the default applies
+				require.Equal(t, 2*time.Second, cfg.DialTimeout)
+			},
+		},
+		{
+			name:     "values from json file",
+			fileName: "config.json",
+			content:  `{"etcd-storage-quota-bytes": 2147483648, "disalarm-threshold": 0.7, "move-leader": true}`,
+			check: func(t *testing.T, cfg config.GlobalConfig) {
+				require.Equal(t, int64(2147483648), cfg.EtcdStorageQuotaBytes)
+				require.InDelta(t, 0.7, cfg.DisalarmThreshold, 0)
+				require.True(t, cfg.MoveLeader)
+			},
+		},
+		{
+			name:     "values from toml file",
+			fileName: "config.toml",
+			content:  "compaction = false\nwait-between-defrags = \"10s\"\n",
+			check: func(t *testing.T, cfg config.GlobalConfig) {
+				require.False(t, cfg.Compaction)
+				require.Equal(t, 10*time.Second, cfg.WaitBetweenDefrags)
+			},
+		},
+		{
+			name:     "flags and environment variables override the file",
+			fileName: "config.yaml",
+			content:  "dial-timeout: 5s\ncommand-timeout: 45s\nmove-leader: true\n",
+			env: map[string]string{
+				"ETCD_DEFRAG_COMMAND_TIMEOUT": "50s",
+			},
+			cli: []string{"--dial-timeout=7s"},
+			check: func(t *testing.T, cfg config.GlobalConfig) {
+				require.Equal(t, 7*time.Second, cfg.DialTimeout)
+				require.Equal(t, 50*time.Second, cfg.CommandTimeout)
+				require.True(t, cfg.MoveLeader)
+			},
+		},
+		{
+			name:        "unknown keys are rejected",
+			fileName:    "config.yaml",
+			content:     "move-leader: true\ndefrag-rules: dbSize > 0\n",
+			expectedErr: "unknown key(s) in config file",
+		},
+		{
+			name:        "invalid value",
+			fileName:    "config.yaml",
+			content:     "dial-timeout: soon\n",
+			expectedErr: `invalid value for key "dial-timeout"`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			viper.Reset()
+			os.Clearenv()
+			globalCfg = config.GlobalConfig{}
+
+			for key, val := range tc.env {
+				t.Setenv(key, val)
+			}
+
+			path := filepath.Join(t.TempDir(), tc.fileName)
+			require.NoError(t, os.WriteFile(path, []byte(tc.content), 0600))
+
+			cmd := newDefragCommand()
+			cmd.Run = func(cmd *cobra.Command, args []string) {}
+			cmd.SilenceUsage = true
+			cmd.SetArgs(append([]string{"--config=" + path}, tc.cli...))
+
+			err := cmd.Execute()
+			if tc.expectedErr != "" {
+				require.ErrorContains(t, err, tc.expectedErr)
+				return
+			}
+			require.NoError(t, err)
+			tc.check(t, globalCfg)
+		})
+	}
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/ahrtr/etcd-defrag/internal/config"
+	"github.com/ahrtr/etcd-defrag/internal/logging"
+)
+
+// Values of defragResult.outcome.
+const (
+	defragSucceeded = iota
+	// defragFailed is a failure, the run goes on with --continue-on-error.
+	defragFailed
+	// defragStopped is a failure which stops the run, even with
+	// --continue-on-error.
+	defragStopped
+	// defragInterrupted is a defragmentation abandoned because the run was
+	// interrupted.
+	defragInterrupted
+)
+
+// defragResult is the result of defragMember.
+type defragResult struct {
+	member  member
+	outcome int
+	// err is the reason of defragStopped.
+	err error
+}
+
+// defragMember defragments the member, which was selected with the status,
+// and records the result in the report of the member. It then waits for the
+// member to catch up and restores its leadership if needed, and finally
+// waits for --wait-between-defrags unless it's the last member.
+func defragMember(ctx context.Context, gcfg config.GlobalConfig, m member, status epStatus, epReport *endpointReport, members []member, movedLeader, last bool) defragResult {
+	ep := status.Ep
+	lg.Info("Defragmenting member", append(m.fields(), logging.Phase(phaseDefrag), logging.Endpoint(ep))...)
+	startTS := time.Now()
+	// Try the URL which worked for the status first.
+	dm := m.preferURL(ep)
+	ep, err := defragment(ctx, gcfg, dm)
+	// The member keeps defragmenting after a timeout, so wait for it,
+	// otherwise two members might be defragmented at once.
+	timedOut := err != nil && ctx.Err() == nil && isTimeout(err)
+	if timedOut {
+		err = waitForDefragment(ctx, gcfg, dm.preferURL(ep), status)
+	}
+	d := time.Since(startTS)
+	recordDefrag(ep, d, err)
+	epReport.Endpoint = ep
+	epReport.Duration = d.String()
+	if errors.Is(err, errStillBusy) {
+		epReport.Action = actionStillBusy
+		epReport.Error = err.Error()
+		lg.Error("The member is still defragmenting, so stopping the run", append(m.fields(), logging.Phase(phaseDefrag), logging.Endpoint(ep), zap.Duration("took", d), zap.Error(err))...)
+		return defragResult{member: m, outcome: defragStopped, err: fmt.Errorf("member %s is %w", m, err)}
+	}
+	if err != nil && ctx.Err() != nil {
+		epReport.Action = actionInterrupted
+		epReport.Error = err.Error()
+		lg.Warn("Abandoned the defragmentation, it may still be running on the member", append(m.fields(), logging.Phase(phaseDefrag), logging.Endpoint(ep), zap.Duration("took", d))...)
+		return defragResult{member: m, outcome: defragInterrupted}
+	}
+	if err != nil {
+		epReport.fail(err)
+		lg.Error("Failed to defragment etcd member", append(m.fields(), logging.Phase(phaseDefrag), logging.Endpoint(ep), zap.Duration("took", d), zap.Error(err))...)
+		return defragResult{member: m, outcome: defragFailed}
+	}
+	lg.Info("Finished defragmenting etcd member", append(m.fields(), logging.Phase(phaseDefrag), logging.Endpoint(ep), zap.Duration("took", d), zap.Bool("afterTimeout", timedOut))...)
+	epReport.Action = actionDefragmented
+	if timedOut {
+		epReport.Action = actionCompletedAfterTimeout
+	}
+
+	// The status is still fetched if the run is interrupted, to complete
+	// the report.
+	postStatus, err := getMemberStatus(context.WithoutCancel(ctx), gcfg, dm, "Post defragmentation")
+	if err != nil {
+		epReport.Error = err.Error()
+		lg.Error("Failed to get member status", append(m.fields(), logging.Phase(phaseStatus), zap.Error(err))...)
+		return defragResult{member: m, outcome: defragFailed}
+	}
+	epReport.setAfter(postStatus)
+
+	restoreLeader := movedLeader && gcfg.RestoreLeader
+	// The next member is only started once this one is back in sync, so
+	// that the cluster never has two lagging members. The former leader is
+	// also back in sync before getting the leadership back.
+	if gcfg.CatchUpTimeout > 0 && (!last || restoreLeader) {
+		if err := waitForCatchUp(ctx, gcfg, dm, members); err != nil {
+			if ctx.Err() != nil {
+				return defragResult{member: m, outcome: defragInterrupted}
+			}
+			epReport.Error = err.Error()
+			lg.Error("The member didn't catch up, so stopping the run", append(m.fields(), logging.Phase(phaseCatchUp), logging.Endpoint(ep), zap.Error(err))...)
+			return defragResult{member: m, outcome: defragStopped, err: fmt.Errorf("member %s is %w", m, err)}
+		}
+	}
+
+	if restoreLeader {
+		// Like the leader transfer, the restore is completed even if the
+		// run is interrupted.
+		restored := true
+		err := restoreLeadership(context.WithoutCancel(ctx), gcfg, dm, members)
+		if err != nil {
+			restored = false
+			epReport.Error = err.Error()
+			lg.Error("Failed to restore the leadership", append(m.fields(), logging.Phase(phaseMoveLeader), logging.Endpoint(ep), zap.Error(err))...)
+		}
+		epReport.LeaderRestored = &restored
+		if err != nil {
+			return defragResult{member: m, outcome: defragFailed}
+		}
+	}
+
+	if gcfg.WaitBetweenDefrags > 0 && !last {
+		lg.Info("Waiting for next operation", logging.Phase(phaseDefrag), zap.Duration("wait", gcfg.WaitBetweenDefrags))
+		sleepCtx(ctx, gcfg.WaitBetweenDefrags)
+	}
+	return defragResult{member: m, outcome: defragSucceeded}
+}
+
+// defragSlots bounds the defragmentations running at once to its limit, see
+// --max-concurrent-defrags, and never runs two members of the same zone at
+// once. It's only used by the goroutine of the run.
+type defragSlots struct {
+	limit int
+	// zones maps the member names and hex IDs to their zone, see
+	// --member-zones.
+	zones   map[string]string
+	running map[uint64]member
+	results chan defragResult
+}
+
+func newDefragSlots(limit int, zones map[string]string) *defragSlots {
+	return &defragSlots{
+		limit:   max(limit, 1),
+		zones:   zones,
+		running: map[uint64]member{},
+		results: make(chan defragResult),
+	}
+}
+
+// zone returns the zone of the member, or empty if it isn't mapped.
+func (s *defragSlots) zone(m member) string {
+	if z, ok := s.zones[m.Name]; ok && m.Name != "" {
+		return z
+	}
+	return s.zones[fmt.Sprintf("%x", m.ID)]
+}
+
+// free returns whether the member can be started now. A member started
+// alone, i.e. the leader, waits for all the others.
+func (s *defragSlots) free(m member, alone bool) bool {
+	if alone {
+		return len(s.running) == 0
+	}
+	if len(s.running) >= s.limit {
+		return false
+	}
+	if z := s.zone(m); z != "" {
+		for _, r := range s.running {
+			if s.zone(r) == z {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// wait blocks until the member can be started, passing each result
+// received meanwhile to apply. It gives up as soon as apply returns false.
+func (s *defragSlots) wait(m member, alone bool, apply func(defragResult) bool) bool {
+	for !s.free(m, alone) {
+		if !s.next(apply) {
+			return false
+		}
+	}
+	return true
+}
+
+// drain waits for all the running defragmentations, passing their results
+// to apply.
+func (s *defragSlots) drain(apply func(defragResult) bool) {
+	for len(s.running) > 0 {
+		s.next(apply)
+	}
+}
+
+func (s *defragSlots) next(apply func(defragResult) bool) bool {
+	r := <-s.results
+	delete(s.running, r.member.ID)
+	return apply(r)
+}
+
+// start runs the defragmentation of the member in the background.
+func (s *defragSlots) start(m member, fn func() defragResult) {
+	s.running[m.ID] = m
+	go func() {
+		s.results <- fn()
+	}()
+}
+
+// members returns the members being defragmented.
+func (s *defragSlots) members() []member {
+	ms := make([]member, 0, len(s.running))
+	for _, m := range s.running {
+		ms = append(ms, m)
+	}
+	return ms
+}
+
+// defragScheduler starts the defragmentations of a run in the order of its
+// members, and keeps track of their results to decide whether the run goes
+// on. It's only used by the goroutine of the run.
+type defragScheduler struct {
+	slots           *defragSlots
+	report          *runReport
+	members         []member
+	continueOnError bool
+
+	failures int
+	// stop is whether no more member is started, and halted whether the
+	// members not processed yet are then reported as not started, i.e. the
+	// run is interrupted, a member is still busy, didn't catch up or was
+	// refused by the quorum guard. stopErr is the reason if not
+	// interrupted.
+	stop, halted bool
+	stopErr      error
+}
+
+func newDefragScheduler(gcfg config.GlobalConfig, slots *defragSlots, report *runReport, members []member) *defragScheduler {
+	return &defragScheduler{
+		slots:           slots,
+		report:          report,
+		members:         members,
+		continueOnError: gcfg.ContinueOnError,
+	}
+}
+
+// apply records the result of a defragmentation, and returns whether the
+// run goes on.
+func (s *defragScheduler) apply(r defragResult) bool {
+	switch r.outcome {
+	case defragFailed:
+		s.failures++
+		s.stop = s.stop || !s.continueOnError
+	case defragStopped:
+		s.failures++
+		s.halt(r.err)
+	case defragInterrupted:
+		s.halt(nil)
+	}
+	return !s.stop
+}
+
+// fail records the failure of the member, and returns whether the run goes
+// on, i.e. with --continue-on-error.
+func (s *defragScheduler) fail(epReport *endpointReport, err error) bool {
+	s.failures++
+	epReport.fail(err)
+	s.stop = s.stop || !s.continueOnError
+	return !s.stop
+}
+
+// refuse records the failure of the member, and stops the run even with
+// --continue-on-error.
+func (s *defragScheduler) refuse(epReport *endpointReport, err error) {
+	s.failures++
+	epReport.fail(err)
+	s.halt(err)
+}
+
+// notStarted stops the run before the member is started, e.g. because the
+// run is interrupted.
+func (s *defragScheduler) notStarted(epReport *endpointReport) {
+	epReport.Action = actionNotStarted
+	s.halt(nil)
+}
+
+func (s *defragScheduler) halt(err error) {
+	if s.stopErr == nil {
+		s.stopErr = err
+	}
+	s.stop, s.halted = true, true
+}
+
+// wait blocks until the member can be started, see defragSlots.wait. If the
+// run is stopped meanwhile, the member is reported as not started.
+func (s *defragScheduler) wait(m member, alone bool, epReport *endpointReport) bool {
+	if !s.slots.wait(m, alone, s.apply) {
+		epReport.Action = actionNotStarted
+		return false
+	}
+	return true
+}
+
+// start runs the defragmentation of the member, and returns whether the run
+// goes on. Without --max-concurrent-defrags, and for the leader, the member
+// is done before moving on to the next one.
+func (s *defragScheduler) start(m member, alone bool, fn func() defragResult) bool {
+	s.slots.start(m, fn)
+	if s.slots.limit == 1 || alone {
+		s.slots.drain(s.apply)
+	}
+	return !s.stop
+}
+
+// finish waits for the running defragmentations, and returns the error of
+// the run if any member failed or wasn't started.
+func (s *defragScheduler) finish(ctx context.Context) error {
+	s.slots.drain(s.apply)
+	s.report.Failures = s.failures
+	if s.halted {
+		// The members processed so far all have an entry in the report.
+		stoppedAt := len(s.report.Endpoints)
+		for _, m := range s.members[stoppedAt:] {
+			s.report.addEndpoint(m).Action = actionNotStarted
+		}
+		if ctx.Err() != nil {
+			return interrupted(ctx)
+		}
+		return fmt.Errorf("stopped with %d (total %d) member(s) not started, since %w", len(s.members)-stoppedAt, len(s.members), s.stopErr)
+	}
+	if s.failures != 0 {
+		return fmt.Errorf("%d (total %d) member(s) failed to be defragmented", s.failures, len(s.members))
+	}
+	return nil
+}
+
+// concurrencyLimit returns how many followers may be defragmented at once,
+// i.e. --max-concurrent-defrags, capped so that a quorum of the voting
+// members, or --min-healthy-after if higher, is left while they're
+// unavailable.
+func concurrencyLimit(ctx context.Context, gcfg config.GlobalConfig) (int, error) {
+	limit := max(gcfg.MaxConcurrentDefrags, 1)
+	if limit == 1 {
+		return 1, nil
+	}
+	resp, err := memberList(ctx, gcfg)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get member list: %w", err)
+	}
+	voters := 0
+	for _, m := range resp.Members {
+		if !m.IsLearner {
+			voters++
+		}
+	}
+	required, err := config.MinHealthyMembers(config.MinHealthyQuorum, voters)
+	if err != nil {
+		return 0, err
+	}
+	if n, err := config.MinHealthyMembers(gcfg.MinHealthyAfter, voters); err != nil {
+		return 0, err
+	} else if n > required {
+		required = n
+	}
+	margin := max(voters-required, 1)
+	if margin < limit {
+		lg.Info("Capped --max-concurrent-defrags by the quorum margin", logging.Phase(phaseDefrag), zap.Int("maxConcurrentDefrags", gcfg.MaxConcurrentDefrags), zap.Int("voters", voters), zap.Int("minHealthy", required), zap.Int("limit", margin))
+		limit = margin
+	}
+	return limit, nil
+}
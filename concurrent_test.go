@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/ahrtr/etcd-defrag/internal/config"
+)
+
+// fakeFiveMemberClient extends the cluster of fakeClusterClient to 5
+// members, the leader is still etcd-3.
+type fakeFiveMemberClient struct {
+	*fakeClusterClient
+}
+
+func (f *fakeFiveMemberClient) MemberList(ctx context.Context, opts ...clientv3.OpOption) (*clientv3.MemberListResponse, error) {
+	resp, _ := f.fakeClusterClient.MemberList(ctx, opts...)
+	resp.Members = append(resp.Members,
+		&etcdserverpb.Member{ID: 4, Name: "etcd-4", ClientURLs: []string{"ep4"}},
+		&etcdserverpb.Member{ID: 5, Name: "etcd-5", ClientURLs: []string{"ep5"}},
+	)
+	return resp, nil
+}
+
+func TestRunDefrag_Concurrent(t *testing.T) {
+	oldCreateClient := createClient
+	t.Cleanup(func() {
+		createClient = oldCreateClient
+	})
+
+	testCases := []struct {
+		name                 string
+		maxConcurrentDefrags int
+		minHealthyAfter      string
+		memberZones          []string
+		expectedConcurrency  int
+	}{
+		{
+			name:                 "sequential",
+			maxConcurrentDefrags: 1,
+			expectedConcurrency:  1,
+		},
+		{
+			name:                 "capped by the quorum margin",
+			maxConcurrentDefrags: 4,
+			expectedConcurrency:  2,
+		},
+		{
+			name:                 "capped by --min-healthy-after",
+			maxConcurrentDefrags: 4,
+			minHealthyAfter:      "quorum+1",
+			expectedConcurrency:  1,
+		},
+		{
+			name:                 "zones",
+			maxConcurrentDefrags: 2,
+			minHealthyAfter:      "quorum",
+			memberZones:          []string{"etcd-1=zone-a", "etcd-2=zone-a", "4=zone-b", "etcd-5=zone-b"},
+			expectedConcurrency:  2,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var (
+				mu          sync.Mutex
+				running     = map[string]bool{}
+				concurrency int
+				overlaps    [][2]string
+			)
+			onDefrag := func(ctx context.Context, ep string) error {
+				mu.Lock()
+				for r := range running {
+					overlaps = append(overlaps, [2]string{r, ep})
+				}
+				running[ep] = true
+				concurrency = max(concurrency, len(running))
+				mu.Unlock()
+
+				time.Sleep(50 * time.Millisecond)
+
+				mu.Lock()
+				delete(running, ep)
+				mu.Unlock()
+				return nil
+			}
+			createClient = func(cfgSpec *clientv3.ConfigSpec) (EtcdCluster, error) {
+				return &fakeFiveMemberClient{&fakeClusterClient{onDefrag: onDefrag}}, nil
+			}
+
+			gcfg := config.GlobalConfig{
+				Endpoints:             []string{"ep1"},
+				Cluster:               true,
+				CommandTimeout:        time.Minute,
+				MaxConcurrentDefrags:  tc.maxConcurrentDefrags,
+				MinHealthyAfter:       tc.minHealthyAfter,
+				MemberZones:           tc.memberZones,
+				EtcdStorageQuotaBytes: 2 * 1024 * 1024 * 1024,
+			}
+			require.NoError(t, runDefrag(context.Background(), gcfg))
+			require.Equal(t, tc.expectedConcurrency, concurrency)
+
+			zones, err := config.ParseMemberZones(tc.memberZones)
+			require.NoError(t, err)
+			zoneOf := map[string]string{}
+			for m, z := range zones {
+				zoneOf[map[string]string{"etcd-1": "ep1", "etcd-2": "ep2", "4": "ep4", "etcd-5": "ep5"}[m]] = z
+			}
+			for _, o := range overlaps {
+				// The leader is always defragmented alone.
+				require.NotContains(t, o, "ep3")
+				if zoneOf[o[0]] != "" {
+					require.NotEqual(t, zoneOf[o[0]], zoneOf[o[1]], "members of the same zone defragmented at once: %v", o)
+				}
+			}
+		})
+	}
+}
+
+func TestParseMemberZones(t *testing.T) {
+	zones, err := config.ParseMemberZones([]string{"etcd-1=zone-a", "8e9e05c52164694d=zone-b"})
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"etcd-1": "zone-a", "8e9e05c52164694d": "zone-b"}, zones)
+
+	_, err = config.ParseMemberZones([]string{"etcd-1"})
+	require.ErrorContains(t, err, `invalid --member-zones entry "etcd-1"`)
+	_, err = config.ParseMemberZones([]string{"etcd-1=zone-a", "etcd-1=zone-b"})
+	require.ErrorContains(t, err, `member "etcd-1" is mapped more than once`)
+}
+
+func TestRunDefrag_LeaderMovedWhileWaiting(t *testing.T) {
+	oldCreateClient, oldInterval := createClient, leaderPollInterval
+	leaderPollInterval = time.Millisecond
+	t.Cleanup(func() {
+		createClient, leaderPollInterval = oldCreateClient, oldInterval
+	})
+
+	var (
+		mu          sync.Mutex
+		leader      uint64 = 3
+		ep4Statuses int
+		running     = map[string]bool{}
+		overlaps    [][2]string
+		transferred []uint64
+	)
+	// The leadership moves to etcd-4 right after its status is fetched
+	// before the defragmentation, while etcd-1 and etcd-2 are running.
+	onStatus := func(ep string, resp *clientv3.StatusResponse) error {
+		mu.Lock()
+		defer mu.Unlock()
+		resp.Leader = leader
+		if ep == "ep4" {
+			if ep4Statuses++; ep4Statuses == 2 {
+				leader = 4
+			}
+		}
+		return nil
+	}
+	onMoveLeader := func(transfereeID uint64) error {
+		mu.Lock()
+		defer mu.Unlock()
+		transferred = append(transferred, leader)
+		leader = transfereeID
+		return nil
+	}
+	onDefrag := func(ctx context.Context, ep string) error {
+		mu.Lock()
+		for r := range running {
+			overlaps = append(overlaps, [2]string{r, ep})
+		}
+		running[ep] = true
+		mu.Unlock()
+
+		time.Sleep(50 * time.Millisecond)
+
+		mu.Lock()
+		delete(running, ep)
+		mu.Unlock()
+		return nil
+	}
+	createClient = func(cfgSpec *clientv3.ConfigSpec) (EtcdCluster, error) {
+		return &fakeFiveMemberClient{&fakeClusterClient{onDefrag: onDefrag, onStatus: onStatus, onMoveLeader: onMoveLeader}}, nil
+	}
+
+	gcfg := config.GlobalConfig{
+		Endpoints:             []string{"ep1"},
+		Cluster:               true,
+		CommandTimeout:        time.Minute,
+		MaxConcurrentDefrags:  2,
+		MoveLeader:            true,
+		EtcdStorageQuotaBytes: 2 * 1024 * 1024 * 1024,
+	}
+	require.NoError(t, runDefrag(context.Background(), gcfg))
+	// The leadership was transferred away from etcd-4 before it was
+	// defragmented alone.
+	require.Equal(t, []uint64{4}, transferred)
+	for _, o := range overlaps {
+		require.NotContains(t, o, "ep4")
+	}
+}
+
+func TestRunDefrag_ConcurrentMemberFailed(t *testing.T) {
+	oldCreateClient := createClient
+	t.Cleanup(func() {
+		createClient = oldCreateClient
+	})
+
+	var (
+		mu       sync.Mutex
+		running  = map[string]bool{}
+		overlaps [][2]string
+		degraded atomic.Bool
+	)
+	// etcd-5 fails while etcd-1 and etcd-2 are defragmented, so etcd-4 must
+	// wait for both, otherwise only 2 of the 5 members would be left.
+	onStatus := func(ep string, resp *clientv3.StatusResponse) error {
+		if degraded.Load() && ep == "ep5" {
+			return status.Error(codes.Unavailable, "connection refused")
+		}
+		return nil
+	}
+	onDefrag := func(ctx context.Context, ep string) error {
+		mu.Lock()
+		if ep == "ep2" {
+			degraded.Store(true)
+		}
+		for r := range running {
+			overlaps = append(overlaps, [2]string{r, ep})
+		}
+		running[ep] = true
+		mu.Unlock()
+
+		time.Sleep(50 * time.Millisecond)
+
+		mu.Lock()
+		delete(running, ep)
+		mu.Unlock()
+		return nil
+	}
+	createClient = func(cfgSpec *clientv3.ConfigSpec) (EtcdCluster, error) {
+		return &fakeDegradedClient{
+			EtcdCluster: &fakeFiveMemberClient{&fakeClusterClient{onDefrag: onDefrag, onStatus: onStatus}},
+			ep:          cfgSpec.Endpoints[0],
+			unhealthy:   "ep5",
+			degraded:    &degraded,
+		}, nil
+	}
+
+	gcfg := config.GlobalConfig{
+		Endpoints:             []string{"ep1"},
+		Cluster:               true,
+		ContinueOnError:       true,
+		CommandTimeout:        time.Minute,
+		MaxConcurrentDefrags:  2,
+		EtcdStorageQuotaBytes: 2 * 1024 * 1024 * 1024,
+	}
+	err := runDefrag(context.Background(), gcfg)
+	require.ErrorContains(t, err, "1 (total 5) member(s) failed to be defragmented")
+	require.Len(t, overlaps, 1)
+	require.ElementsMatch(t, []string{"ep1", "ep2"}, overlaps[0][:])
+}
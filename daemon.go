@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/ahrtr/etcd-defrag/internal/config"
+	"github.com/ahrtr/etcd-defrag/internal/logging"
+)
+
+// runDaemon keeps calling run every --interval until the context is done.
+// A failed cycle is only logged, so that one bad cycle does not terminate
+// the process; the next cycle starts with a fresh health check. The context
+// is passed to run, so that a cycle in progress is interrupted too. It
+// returns nil when stopped between cycles, and the error of the cycle cut
+// short otherwise, which wraps errInterrupted.
+func runDaemon(ctx context.Context, gcfg config.GlobalConfig, run func(context.Context, config.GlobalConfig) error) error {
+	lg.Info("Running in daemon mode", logging.Phase(phaseDaemon), zap.Duration("interval", gcfg.Interval), zap.Duration("jitter", gcfg.IntervalJitter))
+
+	if gcfg.IntervalJitter > 0 {
+		// Spread the first cycle of multiple instances started at the same time.
+		delay := time.Duration(rand.Int63n(int64(gcfg.IntervalJitter)))
+		lg.Info("Delaying the first cycle", logging.Phase(phaseDaemon), zap.Duration("delay", delay))
+		if !sleepCtx(ctx, delay) {
+			return nil
+		}
+	}
+
+	ticker := time.NewTicker(gcfg.Interval)
+	defer ticker.Stop()
+
+	for cycle := 1; ; cycle++ {
+		lg.Info("Starting defragmentation cycle", logging.Phase(phaseDaemon), zap.Int("cycle", cycle))
+		err := run(ctx, gcfg)
+		if errors.Is(err, errInterrupted) {
+			return err
+		}
+		if err != nil {
+			lg.Error("Defragmentation cycle failed", logging.Phase(phaseDaemon), zap.Int("cycle", cycle), zap.Error(err))
+		} else {
+			lg.Info("Defragmentation cycle finished", logging.Phase(phaseDaemon), zap.Int("cycle", cycle))
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// sleepCtx sleeps for the given duration, and returns false if the context
+// is done before the duration elapses.
+func sleepCtx(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
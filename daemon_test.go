@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ahrtr/etcd-defrag/internal/config"
+)
+
+func TestRunDaemon(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cycles := 0
+	run := func(ctx context.Context, gcfg config.GlobalConfig) error {
+		cycles++
+		if cycles == 3 {
+			cancel()
+		}
+		// a failed cycle must not stop the daemon
+		return errors.New("cycle failed")
+	}
+
+	gcfg := config.GlobalConfig{Interval: time.Millisecond, IntervalJitter: time.Millisecond}
+	// The daemon is stopped between cycles, which isn't an interruption.
+	require.NoError(t, runDaemon(ctx, gcfg, run))
+	require.Equal(t, 3, cycles)
+}
+
+func TestRunDaemon_Interrupted(t *testing.T) {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+
+	cycles := 0
+	run := func(ctx context.Context, gcfg config.GlobalConfig) error {
+		cycles++
+		if cycles == 2 {
+			cancel(errors.New("signal terminated"))
+			return interrupted(ctx)
+		}
+		return nil
+	}
+
+	gcfg := config.GlobalConfig{Interval: time.Millisecond}
+	err := runDaemon(ctx, gcfg, run)
+	require.ErrorIs(t, err, errInterrupted)
+	require.Equal(t, 2, cycles)
+}
+
+func TestValidateConfig_Interval(t *testing.T) {
+	testCases := []struct {
+		name        string
+		interval    time.Duration
+		jitter      time.Duration
+		expectedErr string
+	}{
+		{
+			name: "run once",
+		},
+		{
+			name:     "daemon mode with jitter",
+			interval: time.Hour,
+			jitter:   time.Minute,
+		},
+		{
+			name:        "negative interval",
+			interval:    -time.Hour,
+			expectedErr: "--interval must not be negative",
+		},
+		{
+			name:        "jitter without interval",
+			jitter:      time.Minute,
+			expectedErr: "--interval-jitter requires --interval to be set",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := config.GlobalConfig{
+				EtcdStorageQuotaBytes: 2 * 1024 * 1024 * 1024,
+				Interval:              tc.interval,
+				IntervalJitter:        tc.jitter,
+			}
+			err := cfg.Validate(&cobra.Command{})
+			if tc.expectedErr == "" {
+				require.NoError(t, err)
+			} else {
+				require.EqualError(t, err, tc.expectedErr)
+			}
+		})
+	}
+}
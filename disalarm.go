@@ -1,50 +1,62 @@
 package main
 
 import (
+	"context"
 	"fmt"
-	"log"
+
+	"go.uber.org/zap"
 
 	"github.com/ahrtr/etcd-defrag/internal/config"
+	"github.com/ahrtr/etcd-defrag/internal/logging"
 )
 
-// performAutoDisalarm performs automatic disalarm operation
-func performAutoDisalarm(gcfg config.GlobalConfig, statusList []epStatus) error {
-	alarms, err := noSpaceAlarms(gcfg)
+// performAutoDisalarm performs automatic disalarm operation, and returns
+// whether the alarms were disalarmed (success), left untouched (skip), or
+// failed to be disalarmed (failure).
+func performAutoDisalarm(ctx context.Context, gcfg config.GlobalConfig, statusList []epStatus) (string, error) {
+	alarms, err := noSpaceAlarms(ctx, gcfg)
 	if err != nil {
-		return fmt.Errorf("failed to get NOSPACE alarms: %w", err)
+		autoDisalarmTotal.WithLabelValues(resultFailure).Inc()
+		return resultFailure, fmt.Errorf("failed to get NOSPACE alarms: %w", err)
 	}
 
 	if len(alarms) == 0 {
-		log.Println("No NOSPACE alarms found, skipping auto-disalarm")
-		return nil
+		lg.Info("No NOSPACE alarms found, skipping auto-disalarm", logging.Phase(phaseAutoDisalarm))
+		autoDisalarmTotal.WithLabelValues(resultSkip).Inc()
+		return resultSkip, nil
 	}
 
-	log.Println("Found NOSPACE alarms")
+	lg.Info("Found NOSPACE alarms", logging.Phase(phaseAutoDisalarm), zap.Int("count", len(alarms)))
 
 	// Check if all members' DB size is below threshold
-	epsWithDBSize := checkAllMembersDBSize(gcfg, statusList)
-	if len(epsWithDBSize) > 0 {
-		log.Printf("Members %v DB size is still above threshold (%.2f), skipping auto-disalarm\n", epsWithDBSize, gcfg.DisalarmThreshold)
-		return nil
+	membersWithDBSize := checkAllMembersDBSize(gcfg, statusList)
+	if len(membersWithDBSize) > 0 {
+		lg.Info("Members' DB size is still above threshold, skipping auto-disalarm", logging.Phase(phaseAutoDisalarm),
+			zap.Strings("members", membersWithDBSize), zap.Float64("threshold", gcfg.DisalarmThreshold))
+		autoDisalarmTotal.WithLabelValues(resultSkip).Inc()
+		return resultSkip, nil
 	}
 
-	log.Println("Performing auto-disalarm operation...")
-	if err := disAlarmNoSpaceAlarms(gcfg, alarms); err != nil {
-		return fmt.Errorf("failed to disalarm NOSPACE alarms: %w", err)
+	lg.Info("Performing auto-disalarm operation", logging.Phase(phaseAutoDisalarm))
+	if err := disAlarmNoSpaceAlarms(ctx, gcfg, alarms); err != nil {
+		autoDisalarmTotal.WithLabelValues(resultFailure).Inc()
+		return resultFailure, fmt.Errorf("failed to disalarm NOSPACE alarms: %w", err)
 	}
 
-	log.Println("Auto-disalarm operation completed successfully")
-	return nil
+	autoDisalarmTotal.WithLabelValues(resultSuccess).Inc()
+	lg.Info("Auto-disalarm operation completed successfully", logging.Phase(phaseAutoDisalarm))
+	return resultSuccess, nil
 }
 
 // checkAllMembersDBSize checks if all members' DB size is below the threshold
+// of their own storage quota, and returns the members above it.
 func checkAllMembersDBSize(gcfg config.GlobalConfig, statusList []epStatus) []string {
-	var eps []string
-	threshold := float64(gcfg.EtcdStorageQuotaBytes) * gcfg.DisalarmThreshold
+	var members []string
 	for _, status := range statusList {
+		threshold := float64(status.dbQuota(gcfg)) * gcfg.DisalarmThreshold
 		if float64(status.Resp.DbSize) > threshold {
-			eps = append(eps, status.Ep)
+			members = append(members, status.memberString())
 		}
 	}
-	return eps
+	return members
 }
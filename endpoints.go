@@ -1,45 +1,28 @@
 package main
 
 import (
+	"context"
 	"errors"
-	"log"
 	"net"
 	"net/url"
 	"strings"
 
 	"go.etcd.io/etcd/client/pkg/v3/srv"
+	"go.uber.org/zap"
 	"golang.org/x/exp/slices"
 
 	"github.com/ahrtr/etcd-defrag/internal/config"
+	"github.com/ahrtr/etcd-defrag/internal/logging"
 )
 
 var errBadScheme = errors.New("url scheme must be http or https")
 
-func endpointsWithLeaderAtEnd(gcfg config.GlobalConfig, statusList []epStatus) ([]string, error) {
-	eps, err := endpoints(gcfg)
-	if err != nil || len(eps) <= 1 {
-		return eps, err
-	}
-
-	var sortedEps, leaderEps []string
-	for _, status := range statusList {
-		if status.Resp.Header.MemberId != status.Resp.Leader {
-			sortedEps = append(sortedEps, status.Ep)
-		} else {
-			leaderEps = append(leaderEps, status.Ep)
-		}
-	}
-
-	sortedEps = append(sortedEps, leaderEps...)
-	return sortedEps, nil
-}
-
-func endpoints(gcfg config.GlobalConfig) ([]string, error) {
+func endpoints(ctx context.Context, gcfg config.GlobalConfig) ([]string, error) {
 	if !gcfg.Cluster {
 		return endpointsFromCmd(gcfg)
 	}
 
-	return endpointsFromCluster(gcfg)
+	return endpointsFromCluster(ctx, gcfg)
 }
 
 func isLocalEndpoint(ep string) (bool, error) {
@@ -77,8 +60,8 @@ func isLocalEndpoint(ep string) (bool, error) {
 	return false, nil
 }
 
-func endpointsFromCluster(gcfg config.GlobalConfig) ([]string, error) {
-	memberlistResp, err := memberList(gcfg)
+func endpointsFromCluster(ctx context.Context, gcfg config.GlobalConfig) ([]string, error) {
+	memberlistResp, err := memberList(ctx, gcfg)
 	if err != nil {
 		return nil, err
 	}
@@ -145,7 +128,7 @@ func endpointsFromDNSDiscovery(gcfg config.GlobalConfig) ([]string, error) {
 	var ret []string
 	for _, ep := range eps {
 		if strings.HasPrefix(ep, "http://") {
-			log.Printf("ignoring discovered insecure endpoint %q\n", ep)
+			lg.Warn("Ignoring discovered insecure endpoint", logging.Endpoint(ep), zap.String("discoverySrv", gcfg.DiscoverySrv))
 			continue
 		}
 		ret = append(ret, ep)
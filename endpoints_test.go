@@ -101,7 +101,7 @@ func TestEndpointDedup(t *testing.T) {
 	for _, testcase := range testcases {
 		t.Run(testcase.name, func(t *testing.T) {
 			fakeClient.memberListResp = testcase.returnedMemberList
-			ep, err := endpointsFromCluster(config.GlobalConfig{Endpoints: []string{"https://localhost:2379"}})
+			ep, err := endpointsFromCluster(context.Background(), config.GlobalConfig{Endpoints: []string{"https://localhost:2379"}})
 			if err != nil {
 				t.Error(err)
 			}
@@ -165,7 +165,7 @@ func TestEndpointExcludeLocalhost(t *testing.T) {
 	for _, testcase := range testcases {
 		t.Run(testcase.name, func(t *testing.T) {
 			fakeClient.memberListResp = testcase.returnedMemberList
-			ep, err := endpointsFromCluster(config.GlobalConfig{Endpoints: []string{"https://localhost:2379"}, ExcludeLocalhost: testcase.excludeLocalhost})
+			ep, err := endpointsFromCluster(context.Background(), config.GlobalConfig{Endpoints: []string{"https://localhost:2379"}, ExcludeLocalhost: testcase.excludeLocalhost})
 			if err != nil {
 				t.Error(err)
 			}
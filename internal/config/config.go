@@ -1,6 +1,7 @@
 package config
 
 import (
+	"reflect"
 	"strings"
 	"time"
 
@@ -17,6 +18,8 @@ type GlobalConfig struct {
 	CommandTimeout   time.Duration `mapstructure:"command-timeout"`
 	KeepaliveTime    time.Duration `mapstructure:"keepalive-time"`
 	KeepaliveTimeout time.Duration `mapstructure:"keepalive-timeout"`
+	// StatusConcurrency is the maximum number of status requests in flight.
+	StatusConcurrency int `mapstructure:"status-concurrency"`
 
 	// TLS configuration
 	CaCert             string `mapstructure:"cacert"`
@@ -36,27 +39,69 @@ type GlobalConfig struct {
 	Password string `mapstructure:"password"`
 
 	// Behavior configuration
-	Compaction      bool   `mapstructure:"compaction"`
-	ContinueOnError bool   `mapstructure:"continue-on-error"`
-	DefragRule      string `mapstructure:"defrag-rule"`
-	DryRun          bool   `mapstructure:"dry-run"`
+	Compaction       bool   `mapstructure:"compaction"`
+	ContinueOnError  bool   `mapstructure:"continue-on-error"`
+	DefragRule       string `mapstructure:"defrag-rule"`
+	RuleScope        string `mapstructure:"rule-scope"`
+	RuleLanguage     string `mapstructure:"rule-language"`
+	RulesFile        string `mapstructure:"rules-file"`
+	DefragScore      string `mapstructure:"defrag-score"`
+	MaxMembersPerRun int    `mapstructure:"max-members-per-run"`
+	StrictRules      bool   `mapstructure:"strict-rules"`
+	DryRun           bool   `mapstructure:"dry-run"`
 	// TODO: remove this when etcd v3.5 is end of life.
 	// etcd v3.6.0 already added quota into the endpoint status response
-	// in https://github.com/etcd-io/etcd/pull/17877
+	// in https://github.com/etcd-io/etcd/pull/17877, so this is only used
+	// as a fallback when the response doesn't contain the quota.
 	EtcdStorageQuotaBytes           int64         `mapstructure:"etcd-storage-quota-bytes"`
 	ExcludeLocalhost                bool          `mapstructure:"exclude-localhost"`
 	MoveLeader                      bool          `mapstructure:"move-leader"`
+	MoveLeaderTo                    string        `mapstructure:"move-leader-to"`
+	RestoreLeader                   bool          `mapstructure:"restore-leader"`
+	MinHealthyAfter                 string        `mapstructure:"min-healthy-after"`
+	MaxConcurrentDefrags            int           `mapstructure:"max-concurrent-defrags"`
+	MemberZones                     []string      `mapstructure:"member-zones"`
 	WaitBetweenDefrags              time.Duration `mapstructure:"wait-between-defrags"`
 	SkipHealthcheckClusterEndpoints bool          `mapstructure:"skip-healthcheck-cluster-endpoints"`
+	PauseFile                       string        `mapstructure:"pause-file"`
+	MaxBusyWait                     time.Duration `mapstructure:"max-busy-wait"`
+	CatchUpTimeout                  time.Duration `mapstructure:"catch-up-timeout"`
+	CatchUpMaxLag                   uint64        `mapstructure:"catch-up-max-lag"`
+
+	// Daemon configuration
+	Interval       time.Duration `mapstructure:"interval"`
+	IntervalJitter time.Duration `mapstructure:"interval-jitter"`
+
+	// Metrics configuration
+	MetricsAddr string `mapstructure:"metrics-addr"`
+
+	// Report configuration
+	ReportFile   string `mapstructure:"report-file"`
+	ReportFormat string `mapstructure:"report-format"`
+
+	// Logging configuration
+	LogLevel       string `mapstructure:"log-level"`
+	LogFormat      string `mapstructure:"log-format"`
+	ClientLogLevel string `mapstructure:"client-log-level"`
 
 	// Auto-disalarm configuration
 	AutoDisalarm      bool    `mapstructure:"auto-disalarm"`
 	DisalarmThreshold float64 `mapstructure:"disalarm-threshold"`
 
 	// Other flags
-	PrintVersion bool `mapstructure:"version"`
+	ConfigFile   string `mapstructure:"config"`
+	PrintVersion bool   `mapstructure:"version"`
 }
 
+// Values of --rule-scope.
+const (
+	// RuleScopeMember evaluates the rule for each member separately.
+	RuleScopeMember = "member"
+	// RuleScopeCluster evaluates the rule once, and either all endpoints
+	// are defragmented or none of them.
+	RuleScopeCluster = "cluster"
+)
+
 // ClientConfigWithoutEndpoints creates a clientv3.ConfigSpec from GlobalConfig without setting endpoints
 func (c GlobalConfig) ClientConfigWithoutEndpoints() *clientv3.ConfigSpec {
 	cfg := &clientv3.ConfigSpec{
@@ -88,6 +133,39 @@ func (c GlobalConfig) AuthConfig() *clientv3.AuthConfig {
 	}
 }
 
+const redacted = "******"
+
+// RedactedSettings returns the configuration as a map keyed by the flag
+// names, with the secrets redacted, so that it can be safely exported.
+func (c GlobalConfig) RedactedSettings() map[string]interface{} {
+	settings := make(map[string]interface{})
+
+	v := reflect.ValueOf(c)
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		key := t.Field(i).Tag.Get("mapstructure")
+		if key == "" {
+			continue
+		}
+		switch val := v.Field(i).Interface().(type) {
+		case time.Duration:
+			settings[key] = val.String()
+		default:
+			settings[key] = val
+		}
+	}
+
+	if c.Password != "" {
+		settings["password"] = redacted
+	}
+	// --user accepts the format "username[:password]"
+	if user, _, found := strings.Cut(c.User, ":"); found {
+		settings["user"] = user + ":" + redacted
+	}
+
+	return settings
+}
+
 // RegisterFlags registers all command-line flags
 func RegisterFlags(cmd *cobra.Command, cfg *GlobalConfig) {
 	// Manually splitting, because GetStringSlice has inconsistent behavior for splitting command line flags and environment variables
@@ -104,6 +182,8 @@ func RegisterFlags(cmd *cobra.Command, cfg *GlobalConfig) {
 		"keepalive time for client connections")
 	cmd.Flags().DurationVar(&cfg.KeepaliveTimeout, "keepalive-timeout", viper.GetDuration("keepalive-timeout"),
 		"keepalive timeout for client connections")
+	cmd.Flags().IntVar(&cfg.StatusConcurrency, "status-concurrency", viper.GetInt("status-concurrency"),
+		"maximum number of members whose status is fetched in parallel (0 or 1 fetches them one by one)")
 
 	// TLS flags
 	cmd.Flags().StringVar(&cfg.CaCert, "cacert", viper.GetString("cacert"),
@@ -140,18 +220,76 @@ func RegisterFlags(cmd *cobra.Command, cfg *GlobalConfig) {
 		"whether continue to defragment next endpoint if current one fails")
 	cmd.Flags().StringVar(&cfg.DefragRule, "defrag-rule", viper.GetString("defrag-rule"),
 		"defragmentation rule (etcd-defrag will run defragmentation if the rule is empty or it is evaluated to true)")
+	cmd.Flags().StringVar(&cfg.RuleScope, "rule-scope", viper.GetString("rule-scope"),
+		"scope of the defragmentation rule, either member (evaluated for each member) or cluster (evaluated once, and either all endpoints are defragmented or none)")
+	cmd.Flags().StringVar(&cfg.RuleLanguage, "rule-language", viper.GetString("rule-language"),
+		"language of the defragmentation rule, either goval or cel (Common Expression Language)")
+	cmd.Flags().StringVar(&cfg.RulesFile, "rules-file", viper.GetString("rules-file"),
+		"path of a YAML or JSON file listing named defragmentation rules, each applied to the members matched by its selector; it can't be used together with --defrag-rule")
+	cmd.Flags().StringVar(&cfg.DefragScore, "defrag-score", viper.GetString("defrag-score"),
+		"numeric expression over the same variables as the defragmentation rule; the members are defragmented in descending order of the score, and the leader still goes last")
+	cmd.Flags().IntVar(&cfg.MaxMembersPerRun, "max-members-per-run", viper.GetInt("max-members-per-run"),
+		"maximum number of members defragmented in a run, in the order of --defrag-score (0 means no limit)")
+	cmd.Flags().BoolVar(&cfg.StrictRules, "strict-rules", viper.GetBool("strict-rules"),
+		"fail if the static check of the defragmentation rule reports any warning")
 	cmd.Flags().BoolVar(&cfg.DryRun, "dry-run", viper.GetBool("dry-run"),
 		"evaluate whether or not endpoints require defragmentation, but don't actually perform it")
 	cmd.Flags().Int64Var(&cfg.EtcdStorageQuotaBytes, "etcd-storage-quota-bytes", int64(viper.GetInt("etcd-storage-quota-bytes")),
-		"etcd storage quota in bytes (the value passed to etcd instance by flag --quota-backend-bytes)")
+		"etcd storage quota in bytes (the value passed to etcd instance by flag --quota-backend-bytes), only used when the member doesn't report its quota (etcd < v3.6)")
 	cmd.Flags().BoolVar(&cfg.ExcludeLocalhost, "exclude-localhost", viper.GetBool("exclude-localhost"),
 		"whether to exclude localhost endpoints")
 	cmd.Flags().BoolVar(&cfg.MoveLeader, "move-leader", viper.GetBool("move-leader"),
 		"whether to move the leadership before performing defragmentation on the leader")
+	cmd.Flags().StringVar(&cfg.MoveLeaderTo, "move-leader-to", viper.GetString("move-leader-to"),
+		"name or hex ID of the member to transfer the leadership to, only used with --move-leader. Defaults to empty (the healthy voting member with the smallest raft lag)")
+	cmd.Flags().BoolVar(&cfg.RestoreLeader, "restore-leader", viper.GetBool("restore-leader"),
+		"transfer the leadership back to the original leader once it's defragmented, only used with --move-leader")
+	cmd.Flags().StringVar(&cfg.MinHealthyAfter, "min-healthy-after", viper.GetString("min-healthy-after"),
+		"minimum number of healthy voting members, excluding the one to defragment, checked before each defragmentation: quorum, quorum+<k> or a number. Defaults to empty (disabled)")
+	cmd.Flags().IntVar(&cfg.MaxConcurrentDefrags, "max-concurrent-defrags", viper.GetInt("max-concurrent-defrags"),
+		"maximum number of followers defragmented at once, capped so that a quorum of the voting members (or --min-healthy-after) stays available; the leader is always defragmented alone")
+	var memberZones []string
+	if zones := viper.GetString("member-zones"); zones != "" {
+		memberZones = strings.Split(zones, ",")
+	}
+	cmd.Flags().StringSliceVar(&cfg.MemberZones, "member-zones", memberZones,
+		"comma separated list of <member>=<zone>, where the member is a name or hex ID, so that no two members of the same zone are defragmented at once with --max-concurrent-defrags")
 	cmd.Flags().DurationVar(&cfg.WaitBetweenDefrags, "wait-between-defrags", viper.GetDuration("wait-between-defrags"),
 		"wait time between consecutive defragmentation runs or after a leader movement (if --move-leader is enabled). Defaults to 0s (no wait)")
 	cmd.Flags().BoolVar(&cfg.SkipHealthcheckClusterEndpoints, "skip-healthcheck-cluster-endpoints", viper.GetBool("skip-healthcheck-cluster-endpoints"),
 		"skip cluster endpoint discovery during health check and only check the endpoints provided via --endpoints")
+	cmd.Flags().DurationVar(&cfg.MaxBusyWait, "max-busy-wait", viper.GetDuration("max-busy-wait"),
+		"maximum time to wait for a member whose defragmentation exceeded --command-timeout to complete it; the run is stopped if it doesn't")
+	cmd.Flags().DurationVar(&cfg.CatchUpTimeout, "catch-up-timeout", viper.GetDuration("catch-up-timeout"),
+		"maximum time to wait for a defragmented member to catch up with the leader and pass a health check before the next member; the run is stopped if it doesn't. Defaults to 0s (disabled)")
+	cmd.Flags().Uint64Var(&cfg.CatchUpMaxLag, "catch-up-max-lag", viper.GetUint64("catch-up-max-lag"),
+		"maximum number of raft entries the applied index of a defragmented member may lag behind the leader to be considered caught up, only used with --catch-up-timeout")
+	cmd.Flags().StringVar(&cfg.PauseFile, "pause-file", viper.GetString("pause-file"),
+		"path of a file which pauses the defragmentation before the next member while it exists. Defaults to empty (disabled)")
+
+	// Daemon flags
+	cmd.Flags().DurationVar(&cfg.Interval, "interval", viper.GetDuration("interval"),
+		"run as a daemon and repeat the defragmentation cycle at this interval. Defaults to 0s (run once and exit)")
+	cmd.Flags().DurationVar(&cfg.IntervalJitter, "interval-jitter", viper.GetDuration("interval-jitter"),
+		"maximum random delay before the first cycle in daemon mode. Defaults to 0s (no delay)")
+
+	// Metrics flags
+	cmd.Flags().StringVar(&cfg.MetricsAddr, "metrics-addr", viper.GetString("metrics-addr"),
+		"address to serve Prometheus metrics on /metrics (e.g. :9090). Defaults to empty (disabled)")
+
+	// Report flags
+	cmd.Flags().StringVar(&cfg.ReportFile, "report-file", viper.GetString("report-file"),
+		"path of the file to write a structured report of each run to. Defaults to empty (disabled)")
+	cmd.Flags().StringVar(&cfg.ReportFormat, "report-format", viper.GetString("report-format"),
+		"format of the report written to --report-file, either json or yaml")
+
+	// Logging flags
+	cmd.Flags().StringVar(&cfg.LogLevel, "log-level", viper.GetString("log-level"),
+		"log level, one of debug, info, warn or error")
+	cmd.Flags().StringVar(&cfg.LogFormat, "log-format", viper.GetString("log-format"),
+		"log format, either text or json")
+	cmd.Flags().StringVar(&cfg.ClientLogLevel, "client-log-level", viper.GetString("client-log-level"),
+		"log level of the etcd client library, one of debug, info, warn or error")
 
 	// Auto-disalarm flags
 	cmd.Flags().BoolVar(&cfg.AutoDisalarm, "auto-disalarm", viper.GetBool("auto-disalarm"),
@@ -159,6 +297,10 @@ func RegisterFlags(cmd *cobra.Command, cfg *GlobalConfig) {
 	cmd.Flags().Float64Var(&cfg.DisalarmThreshold, "disalarm-threshold", viper.GetFloat64("disalarm-threshold"),
 		"threshold ratio for automatic alarm clearing (db size / quota)")
 
+	// Config file flag
+	cmd.Flags().StringVar(&cfg.ConfigFile, "config", viper.GetString("config"),
+		"path of a YAML, TOML or JSON config file, whose keys are the flag names. Values are evaluated in the order: flags > environment variables > config file > defaults")
+
 	// Version flag
 	cmd.Flags().BoolVar(&cfg.PrintVersion, "version", viper.GetBool("version"),
 		"print the version and exit")
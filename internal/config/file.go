@@ -0,0 +1,75 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// LoadConfigFile reads the configuration file (YAML, TOML or JSON, detected
+// by the file extension) and applies its values to the flags which are set
+// neither on the command line nor via environment variables, so that the
+// values are evaluated in the order: flags > env > file > defaults.
+//
+// The keys in the file are the flag names, e.g. `defrag-rule`. Unknown keys
+// are rejected, so that typos don't get silently ignored.
+func LoadConfigFile(cmd *cobra.Command, path string) error {
+	if path == "" {
+		return nil
+	}
+
+	v := viper.New()
+	v.SetConfigFile(path)
+	if err := v.ReadInConfig(); err != nil {
+		return fmt.Errorf("failed to read config file %q: %w", path, err)
+	}
+
+	var unknownKeys []string
+	for _, key := range v.AllKeys() {
+		if key == "config" || cmd.Flags().Lookup(key) == nil {
+			unknownKeys = append(unknownKeys, key)
+		}
+	}
+	if len(unknownKeys) > 0 {
+		sort.Strings(unknownKeys)
+		return fmt.Errorf("unknown key(s) in config file %q: %s", path, strings.Join(unknownKeys, ", "))
+	}
+
+	for _, key := range v.AllKeys() {
+		if cmd.Flags().Changed(key) {
+			continue
+		}
+		if _, ok := os.LookupEnv(envVarName(key)); ok {
+			continue
+		}
+		if err := cmd.Flags().Set(key, flagValueString(v.Get(key))); err != nil {
+			return fmt.Errorf("invalid value for key %q in config file %q: %w", key, path, err)
+		}
+	}
+
+	return nil
+}
+
+// flagValueString converts a value decoded from the config file into the
+// string representation accepted by the flag.
+func flagValueString(val interface{}) string {
+	switch v := val.(type) {
+	case []interface{}:
+		items := make([]string, 0, len(v))
+		for _, item := range v {
+			items = append(items, flagValueString(item))
+		}
+		return strings.Join(items, ",")
+	case float64:
+		// JSON decodes all numbers as float64; avoid the exponent format
+		// (e.g. 2.147483648e+09), which integer flags can't parse.
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		return fmt.Sprint(v)
+	}
+}
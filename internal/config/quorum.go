@@ -0,0 +1,54 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// MinHealthyQuorum is the --min-healthy-after value which requires a quorum
+// of the voting members to stay healthy. It can be followed by "+k" to
+// require k more.
+const MinHealthyQuorum = "quorum"
+
+// MinHealthyMembers returns how many of the voters must stay healthy while a
+// member is defragmented, according to --min-healthy-after, which is either
+// "quorum", "quorum+k" or a number. It returns 0 when the guard is disabled.
+func MinHealthyMembers(minHealthyAfter string, voters int) (int, error) {
+	if minHealthyAfter == "" {
+		return 0, nil
+	}
+	quorum := voters/2 + 1
+	if minHealthyAfter == MinHealthyQuorum {
+		return quorum, nil
+	}
+	if k, ok := strings.CutPrefix(minHealthyAfter, MinHealthyQuorum+"+"); ok {
+		n, err := strconv.Atoi(k)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid --min-healthy-after %q, expected quorum, quorum+<k> or a number", minHealthyAfter)
+		}
+		return quorum + n, nil
+	}
+	n, err := strconv.Atoi(minHealthyAfter)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid --min-healthy-after %q, expected quorum, quorum+<k> or a number", minHealthyAfter)
+	}
+	return n, nil
+}
+
+// ParseMemberZones parses --member-zones, a list of "<member>=<zone>" where
+// the member is a name or a hex ID, into a map keyed by the member.
+func ParseMemberZones(memberZones []string) (map[string]string, error) {
+	zones := map[string]string{}
+	for _, mz := range memberZones {
+		m, z, ok := strings.Cut(mz, "=")
+		if !ok || m == "" || z == "" {
+			return nil, fmt.Errorf("invalid --member-zones entry %q, expected <member>=<zone>", mz)
+		}
+		if _, dup := zones[m]; dup {
+			return nil, fmt.Errorf("member %q is mapped more than once in --member-zones", m)
+		}
+		zones[m] = z
+	}
+	return zones, nil
+}
@@ -0,0 +1,139 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+
+	"go.yaml.in/yaml/v3"
+)
+
+// Values of the role selector in the rules file.
+const (
+	RoleLeader   = "leader"
+	RoleFollower = "follower"
+)
+
+// MemberRule is a named defragmentation rule loaded from --rules-file, which
+// applies to the members matched by its selector.
+type MemberRule struct {
+	Name     string       `yaml:"name"`
+	Selector RuleSelector `yaml:"selector"`
+	// Rule is the defragmentation rule, in the language set by
+	// --rule-language. An empty rule is always true.
+	Rule string `yaml:"rule"`
+	// EtcdStorageQuotaBytes overrides --etcd-storage-quota-bytes for the
+	// matched members.
+	EtcdStorageQuotaBytes int64 `yaml:"etcd-storage-quota-bytes"`
+}
+
+// RuleSelector selects the members a rule applies to. A member must match
+// all the set fields, and an empty selector matches all members.
+type RuleSelector struct {
+	// MemberName is a regular expression matched against the member name.
+	MemberName string `yaml:"member-name"`
+	// MemberID is the member ID in hex, as printed by etcdctl.
+	MemberID string `yaml:"member-id"`
+	// Role is either leader or follower, learners are followers.
+	Role string `yaml:"role"`
+
+	memberName *regexp.Regexp
+	memberID   uint64
+}
+
+type rulesFile struct {
+	Rules []MemberRule `yaml:"rules"`
+}
+
+// LoadRulesFile reads the rules file (YAML or JSON), and validates the rule
+// names and selectors. The rules themselves are validated by the caller,
+// since it depends on --rule-language.
+func LoadRulesFile(path string) ([]MemberRule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read rules file %q: %w", path, err)
+	}
+
+	var f rulesFile
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	// Reject unknown keys, so that typos don't get silently ignored.
+	dec.KnownFields(true)
+	if err := dec.Decode(&f); err != nil {
+		return nil, fmt.Errorf("failed to parse rules file %q: %w", path, err)
+	}
+	if len(f.Rules) == 0 {
+		return nil, fmt.Errorf("no rule in rules file %q", path)
+	}
+
+	names := map[string]bool{}
+	for i := range f.Rules {
+		r := &f.Rules[i]
+		if err := r.validate(); err != nil {
+			return nil, fmt.Errorf("invalid rule #%d in rules file %q: %w", i+1, path, err)
+		}
+		if names[r.Name] {
+			return nil, fmt.Errorf("duplicate rule name %q in rules file %q", r.Name, path)
+		}
+		names[r.Name] = true
+	}
+	return f.Rules, nil
+}
+
+func (r *MemberRule) validate() error {
+	if r.Name == "" {
+		return errors.New("the name is empty")
+	}
+	if r.EtcdStorageQuotaBytes < 0 {
+		return fmt.Errorf("negative etcd-storage-quota-bytes %d", r.EtcdStorageQuotaBytes)
+	}
+
+	s := &r.Selector
+	if s.MemberName != "" {
+		re, err := regexp.Compile(s.MemberName)
+		if err != nil {
+			return fmt.Errorf("invalid member-name %q: %w", s.MemberName, err)
+		}
+		s.memberName = re
+	}
+	if s.MemberID != "" {
+		id, err := strconv.ParseUint(s.MemberID, 16, 64)
+		if err != nil {
+			return fmt.Errorf("invalid member-id %q, expected a hex ID", s.MemberID)
+		}
+		s.memberID = id
+	}
+	if s.Role != "" && s.Role != RoleLeader && s.Role != RoleFollower {
+		return fmt.Errorf("invalid role %q, only %s and %s are supported", s.Role, RoleLeader, RoleFollower)
+	}
+	return nil
+}
+
+// Matches returns whether the member is selected.
+func (s RuleSelector) Matches(name string, id uint64, isLeader bool) bool {
+	if s.memberName != nil && !s.memberName.MatchString(name) {
+		return false
+	}
+	if s.MemberID != "" && s.memberID != id {
+		return false
+	}
+	switch s.Role {
+	case RoleLeader:
+		return isLeader
+	case RoleFollower:
+		return !isLeader
+	}
+	return true
+}
+
+// MatchRule returns the first rule whose selector matches the member.
+func MatchRule(rules []MemberRule, name string, id uint64, isLeader bool) (MemberRule, bool) {
+	for _, r := range rules {
+		if r.Selector.Matches(name, id, isLeader) {
+			return r, true
+		}
+	}
+	return MemberRule{}, false
+}
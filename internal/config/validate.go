@@ -2,8 +2,11 @@ package config
 
 import (
 	"errors"
+	"fmt"
 
 	"github.com/spf13/cobra"
+
+	"github.com/ahrtr/etcd-defrag/internal/eval"
 )
 
 // Validate validates the configuration and returns an error if validation fails
@@ -36,6 +39,77 @@ func (c GlobalConfig) Validate(cmd *cobra.Command) error {
 		return errors.New("--disalarm-threshold must be greater than 0 and less than 1.0 when --auto-disalarm is enabled")
 	}
 
+	if c.Interval < 0 {
+		return errors.New("--interval must not be negative")
+	}
+
+	if c.IntervalJitter < 0 {
+		return errors.New("--interval-jitter must not be negative")
+	}
+
+	if c.IntervalJitter > 0 && c.Interval == 0 {
+		return errors.New("--interval-jitter requires --interval to be set")
+	}
+
+	// An empty scope is treated as the member scope.
+	if c.RuleScope != "" && c.RuleScope != RuleScopeMember && c.RuleScope != RuleScopeCluster {
+		return fmt.Errorf("invalid --rule-scope %q, only %s and %s are supported", c.RuleScope, RuleScopeMember, RuleScopeCluster)
+	}
+
+	if c.RulesFile != "" {
+		if c.DefragRule != "" {
+			return errors.New("--rules-file and --defrag-rule can't be used together")
+		}
+		if c.RuleScope == RuleScopeCluster {
+			return fmt.Errorf("--rules-file can't be used with --rule-scope=%s", RuleScopeCluster)
+		}
+	}
+
+	if c.MaxMembersPerRun < 0 {
+		return errors.New("--max-members-per-run must not be negative")
+	}
+
+	if c.MaxBusyWait < 0 {
+		return errors.New("--max-busy-wait must not be negative")
+	}
+
+	if c.MoveLeaderTo != "" && !c.MoveLeader {
+		return errors.New("--move-leader-to requires --move-leader")
+	}
+
+	if c.RestoreLeader && !c.MoveLeader {
+		return errors.New("--restore-leader requires --move-leader")
+	}
+
+	if _, err := MinHealthyMembers(c.MinHealthyAfter, 1); err != nil {
+		return err
+	}
+
+	if c.MaxConcurrentDefrags < 0 {
+		return errors.New("--max-concurrent-defrags must not be negative")
+	}
+
+	if _, err := ParseMemberZones(c.MemberZones); err != nil {
+		return err
+	}
+
+	if c.CatchUpTimeout < 0 {
+		return errors.New("--catch-up-timeout must not be negative")
+	}
+
+	if c.StatusConcurrency < 0 {
+		return errors.New("--status-concurrency must not be negative")
+	}
+
+	// An empty language is treated as goval.
+	if c.RuleLanguage != "" && c.RuleLanguage != eval.LanguageGoval && c.RuleLanguage != eval.LanguageCEL {
+		return fmt.Errorf("invalid --rule-language %q, only %s and %s are supported", c.RuleLanguage, eval.LanguageGoval, eval.LanguageCEL)
+	}
+
+	if c.ReportFile != "" && c.ReportFormat != "json" && c.ReportFormat != "yaml" {
+		return fmt.Errorf("invalid --report-format %q, only json and yaml are supported", c.ReportFormat)
+	}
+
 	// to avoid the potential divide-by-zero issue
 	if c.EtcdStorageQuotaBytes == 0 {
 		return errors.New("--etcd-storage-quota must be greater than 0")
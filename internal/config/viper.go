@@ -5,26 +5,42 @@ import (
 	"time"
 
 	"github.com/spf13/viper"
+
+	"github.com/ahrtr/etcd-defrag/internal/eval"
 )
 
+const envPrefix = "ETCD_DEFRAG"
+
 // SetupViper configures viper for environment variable handling and sets default values
 func SetupViper() {
 	viper.SetEnvKeyReplacer(strings.NewReplacer("-", "_"))
-	viper.SetEnvPrefix("ETCD_DEFRAG")
+	viper.SetEnvPrefix(envPrefix)
 	viper.AutomaticEnv()
 	setDefaults()
 }
 
+// envVarName returns the name of the environment variable for the flag,
+// e.g. ETCD_DEFRAG_MOVE_LEADER for --move-leader.
+func envVarName(flagName string) string {
+	return envPrefix + "_" + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
 func setDefaults() {
 	viper.SetDefault("endpoints", "127.0.0.1:2379")
 	viper.SetDefault("cluster", false)
 	viper.SetDefault("exclude-localhost", false)
 	viper.SetDefault("move-leader", false)
+	viper.SetDefault("move-leader-to", "")
+	viper.SetDefault("restore-leader", false)
+	viper.SetDefault("min-healthy-after", "")
+	viper.SetDefault("max-concurrent-defrags", 1)
+	viper.SetDefault("member-zones", "")
 	viper.SetDefault("wait-between-defrags", 0*time.Second)
 	viper.SetDefault("dial-timeout", 2*time.Second)
 	viper.SetDefault("command-timeout", 30*time.Second)
 	viper.SetDefault("keepalive-time", 2*time.Second)
 	viper.SetDefault("keepalive-timeout", 6*time.Second)
+	viper.SetDefault("status-concurrency", 4)
 	viper.SetDefault("insecure-transport", true)
 	viper.SetDefault("insecure-skip-tls-verify", false)
 	viper.SetDefault("cert", "")
@@ -39,9 +55,28 @@ func setDefaults() {
 	viper.SetDefault("continue-on-error", true)
 	viper.SetDefault("etcd-storage-quota-bytes", 2*1024*1024*1024)
 	viper.SetDefault("defrag-rule", "")
+	viper.SetDefault("rule-scope", RuleScopeMember)
+	viper.SetDefault("rule-language", eval.LanguageGoval)
+	viper.SetDefault("rules-file", "")
+	viper.SetDefault("defrag-score", "")
+	viper.SetDefault("max-members-per-run", 0)
+	viper.SetDefault("strict-rules", false)
 	viper.SetDefault("version", false)
 	viper.SetDefault("dry-run", false)
 	viper.SetDefault("skip-healthcheck-cluster-endpoints", false)
+	viper.SetDefault("pause-file", "")
+	viper.SetDefault("max-busy-wait", 10*time.Minute)
+	viper.SetDefault("catch-up-timeout", 0*time.Second)
+	viper.SetDefault("catch-up-max-lag", 1000)
 	viper.SetDefault("auto-disalarm", false)
 	viper.SetDefault("disalarm-threshold", 0.9)
+	viper.SetDefault("interval", 0*time.Second)
+	viper.SetDefault("interval-jitter", 0*time.Second)
+	viper.SetDefault("metrics-addr", "")
+	viper.SetDefault("report-file", "")
+	viper.SetDefault("report-format", "json")
+	viper.SetDefault("log-level", "info")
+	viper.SetDefault("log-format", "text")
+	viper.SetDefault("client-log-level", "error")
+	viper.SetDefault("config", "")
 }
@@ -0,0 +1,251 @@
+package eval
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+)
+
+// celMemberVariables are the types of the member variables in CEL. Unlike
+// goval, the sizes and counters are integers, and the version is a string,
+// e.g. `semver(version) >= semver("3.6.0")`.
+var celMemberVariables = map[string]*cel.Type{
+	DBQuota:          cel.IntType,
+	DBSize:           cel.IntType,
+	DBSizeInUse:      cel.IntType,
+	DBQuotaUsage:     cel.DoubleType,
+	DBSizeFree:       cel.IntType,
+	IsLeader:         cel.BoolType,
+	IsLearner:        cel.BoolType,
+	RaftTerm:         cel.IntType,
+	RaftIndex:        cel.IntType,
+	RaftAppliedIndex: cel.IntType,
+	Revision:         cel.IntType,
+	Version:          cel.StringType,
+	MemberName:       cel.StringType,
+	NoSpaceAlarms:    cel.IntType,
+}
+
+var celClusterVariables = map[string]*cel.Type{
+	ClusterMaxDBSize:        cel.IntType,
+	ClusterMinDBSize:        cel.IntType,
+	ClusterMedianDBSizeFree: cel.DoubleType,
+	MemberCount:             cel.IntType,
+	HealthyMemberCount:      cel.IntType,
+}
+
+// celEvaluator evaluates the rules written in CEL. The rules are type checked
+// when they are compiled, and the compiled programs are cached.
+type celEvaluator struct {
+	memberEnv  *cel.Env
+	clusterEnv *cel.Env
+
+	mu       sync.Mutex
+	programs map[celRuleKey]cel.Program
+}
+
+type celRuleKey struct {
+	rule    string
+	cluster bool
+	// score is set for the numeric expressions, see Score.
+	score bool
+}
+
+func newCELEvaluator() (Evaluator, error) {
+	memberEnv, err := newCELEnv(celMemberVariables, celClusterVariables)
+	if err != nil {
+		return nil, err
+	}
+	// In cluster scope, each member's variables are accessed via `members`,
+	// e.g. `members.exists(m, m.dbSize > 100 * 1024 * 1024)`.
+	clusterEnv, err := newCELEnv(celClusterVariables, map[string]*cel.Type{
+		Members: cel.ListType(cel.MapType(cel.StringType, cel.DynType)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &celEvaluator{memberEnv: memberEnv, clusterEnv: clusterEnv, programs: map[celRuleKey]cel.Program{}}, nil
+}
+
+func newCELEnv(varSets ...map[string]*cel.Type) (*cel.Env, error) {
+	opts := []cel.EnvOption{
+		// e.g. `dbQuotaUsage > 0` compares a double with an int.
+		cel.CrossTypeNumericComparisons(true),
+		// semver("3.6.0") converts a version into a comparable number, see
+		// VersionNumber.
+		cel.Function("semver",
+			cel.Overload("semver_string", []*cel.Type{cel.StringType}, cel.IntType,
+				cel.UnaryBinding(func(arg ref.Val) ref.Val {
+					s, ok := arg.(types.String)
+					if !ok {
+						return types.MaybeNoSuchOverloadErr(arg)
+					}
+					num := VersionNumber(string(s))
+					if num == 0 {
+						return types.NewErr("invalid version %q", string(s))
+					}
+					return types.Int(num)
+				}))),
+	}
+	for _, vars := range varSets {
+		for name, typ := range vars {
+			opts = append(opts, cel.Variable(name, typ))
+		}
+	}
+	env, err := cel.NewEnv(opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the CEL environment: %w", err)
+	}
+	return env, nil
+}
+
+func (e *celEvaluator) Validate(rule string) error {
+	if len(rule) == 0 {
+		return nil
+	}
+	_, err := e.program(celRuleKey{rule: rule})
+	return err
+}
+
+func (e *celEvaluator) ValidateCluster(rule string) error {
+	if len(rule) == 0 {
+		return nil
+	}
+	_, err := e.program(celRuleKey{rule: rule, cluster: true})
+	return err
+}
+
+func (e *celEvaluator) ValidateScore(expr string) error {
+	if len(expr) == 0 {
+		return nil
+	}
+	_, err := e.program(celRuleKey{rule: expr, score: true})
+	return err
+}
+
+func (e *celEvaluator) Evaluate(rule string, vars Variables) (bool, error) {
+	if len(rule) == 0 {
+		return true, nil
+	}
+	return e.evaluate(celRuleKey{rule: rule}, vars.celValues())
+}
+
+func (e *celEvaluator) EvaluateCluster(rule string, members []Variables, cluster ClusterVariables) (bool, error) {
+	if len(rule) == 0 {
+		return true, nil
+	}
+	vars := cluster.celValues()
+	list := make([]interface{}, 0, len(members))
+	for _, m := range members {
+		list = append(list, m.celValues())
+	}
+	vars[Members] = list
+	return e.evaluate(celRuleKey{rule: rule, cluster: true}, vars)
+}
+
+func (e *celEvaluator) Score(expr string, vars Variables) (float64, error) {
+	if len(expr) == 0 {
+		return 0, nil
+	}
+	out, err := e.eval(celRuleKey{rule: expr, score: true}, vars.celValues())
+	if err != nil {
+		return 0, err
+	}
+	switch v := out.Value().(type) {
+	case int64:
+		return float64(v), nil
+	case uint64:
+		return float64(v), nil
+	case float64:
+		return v, nil
+	}
+	return 0, errors.New("the score isn't a numeric expression")
+}
+
+func (e *celEvaluator) evaluate(key celRuleKey, vars map[string]interface{}) (bool, error) {
+	out, err := e.eval(key, vars)
+	if err != nil {
+		return false, err
+	}
+	result, ok := out.Value().(bool)
+	if !ok {
+		return false, errors.New("the rule isn't a boolean expression")
+	}
+	return result, nil
+}
+
+func (e *celEvaluator) eval(key celRuleKey, vars map[string]interface{}) (ref.Val, error) {
+	prg, err := e.program(key)
+	if err != nil {
+		return nil, err
+	}
+	out, _, err := prg.Eval(vars)
+	return out, err
+}
+
+// program compiles and type checks the rule, or returns the cached program.
+func (e *celEvaluator) program(key celRuleKey) (cel.Program, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if prg, ok := e.programs[key]; ok {
+		return prg, nil
+	}
+
+	env := e.memberEnv
+	if key.cluster {
+		env = e.clusterEnv
+	}
+	ast, iss := env.Compile(key.rule)
+	if iss.Err() != nil {
+		return nil, iss.Err()
+	}
+	switch t := ast.OutputType(); {
+	case key.score && t != cel.IntType && t != cel.UintType && t != cel.DoubleType:
+		return nil, fmt.Errorf("the score is %s, not a numeric expression", t)
+	case !key.score && t != cel.BoolType:
+		return nil, fmt.Errorf("the rule is %s, not a boolean expression", t)
+	}
+	prg, err := env.Program(ast)
+	if err != nil {
+		return nil, err
+	}
+	e.programs[key] = prg
+	return prg, nil
+}
+
+func (v Variables) celValues() map[string]interface{} {
+	vars := map[string]interface{}{
+		DBQuota:          v.DBQuota,
+		DBSize:           v.DBSize,
+		DBSizeInUse:      v.DBSizeInUse,
+		DBQuotaUsage:     float64(v.DBSize) / float64(v.DBQuota),
+		DBSizeFree:       v.DBSize - v.DBSizeInUse,
+		IsLeader:         v.IsLeader,
+		IsLearner:        v.IsLearner,
+		RaftTerm:         int64(v.RaftTerm),
+		RaftIndex:        int64(v.RaftIndex),
+		RaftAppliedIndex: int64(v.RaftAppliedIndex),
+		Revision:         v.Revision,
+		Version:          v.Version,
+		MemberName:       v.MemberName,
+		NoSpaceAlarms:    int64(v.NoSpaceAlarms),
+	}
+	for k, val := range v.ClusterVariables.celValues() {
+		vars[k] = val
+	}
+	return vars
+}
+
+func (c ClusterVariables) celValues() map[string]interface{} {
+	return map[string]interface{}{
+		ClusterMaxDBSize:        c.ClusterMaxDBSize,
+		ClusterMinDBSize:        c.ClusterMinDBSize,
+		ClusterMedianDBSizeFree: c.ClusterMedianDBSizeFree,
+		MemberCount:             int64(c.MemberCount),
+		HealthyMemberCount:      int64(c.HealthyMemberCount),
+	}
+}
@@ -0,0 +1,269 @@
+package eval
+
+import (
+	"testing"
+)
+
+func TestCELValidate(t *testing.T) {
+	e, err := NewEvaluator(LanguageCEL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name        string
+		rule        string
+		cluster     bool
+		expectError bool
+	}{
+		{
+			name: "empty rule",
+		},
+		{
+			name: "typed variables",
+			rule: "dbSize - dbSizeInUse > 200 * 1024 * 1024 && !isLeader && memberName.startsWith(\"etcd-\")",
+		},
+		{
+			name: "double compared with int",
+			rule: "dbQuotaUsage > 0",
+		},
+		{
+			name: "version",
+			rule: "semver(version) >= semver(\"3.6.0\")",
+		},
+		{
+			name:        "int multiplied by double",
+			rule:        "dbSize > dbQuota * 0.8",
+			expectError: true,
+		},
+		{
+			name:        "string compared with int",
+			rule:        "version > 30600",
+			expectError: true,
+		},
+		{
+			name:        "not a boolean expression",
+			rule:        "dbSize - dbSizeInUse",
+			expectError: true,
+		},
+		{
+			name:        "unknown variable",
+			rule:        "dbSizE > 100",
+			expectError: true,
+		},
+		{
+			name:        "syntax error",
+			rule:        "dbSize >",
+			expectError: true,
+		},
+		{
+			name:    "members in cluster scope",
+			rule:    "members.exists(m, m.dbSizeFree > 100) && healthyMemberCount == memberCount",
+			cluster: true,
+		},
+		{
+			name:        "member variable in cluster scope",
+			rule:        "dbSize > 100",
+			cluster:     true,
+			expectError: true,
+		},
+	}
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			validate := e.Validate
+			if tc.cluster {
+				validate = e.ValidateCluster
+			}
+			err := validate(tc.rule)
+			if tc.expectError != (err != nil) {
+				t.Fatalf("Unexpected result, expected error: %t, got %v", tc.expectError, err)
+			}
+		})
+	}
+}
+
+func TestCELEvaluate(t *testing.T) {
+	e, err := NewEvaluator(LanguageCEL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vars := Variables{
+		DBQuota:     1000,
+		DBSize:      800,
+		DBSizeInUse: 300,
+		IsLeader:    true,
+		Version:     "3.6.1",
+		MemberName:  "etcd-0",
+		ClusterVariables: ClusterVariables{
+			ClusterMaxDBSize: 800,
+			MemberCount:      3,
+		},
+	}
+
+	testCases := []struct {
+		name             string
+		rule             string
+		expectError      bool
+		evaluationResult bool
+	}{
+		{
+			name:             "empty rule",
+			evaluationResult: true,
+		},
+		{
+			name:             "sizes",
+			rule:             "dbSizeFree == 500 && dbQuotaUsage >= 0.8",
+			evaluationResult: true,
+		},
+		{
+			name: "bool and string variables",
+			rule: "!isLeader || memberName != \"etcd-0\"",
+		},
+		{
+			name:             "version",
+			rule:             "semver(version) >= semver(\"3.6.0\")",
+			evaluationResult: true,
+		},
+		{
+			name:        "invalid version",
+			rule:        "semver(\"3.6\") > 0",
+			expectError: true,
+		},
+		{
+			name:             "cluster variables",
+			rule:             "dbSize == clusterMaxDbSize && memberCount == 3",
+			evaluationResult: true,
+		},
+		{
+			name:        "division by zero",
+			rule:        "dbSize / (memberCount - 3) > 0",
+			expectError: true,
+		},
+	}
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			ret, err := e.Evaluate(tc.rule, vars)
+			if tc.expectError != (err != nil) {
+				t.Fatalf("Unexpected result, expected error: %t, got %v", tc.expectError, err)
+			}
+			if ret != tc.evaluationResult {
+				t.Fatalf("Unexpected evaluation result, expected %t, got %t", tc.evaluationResult, ret)
+			}
+		})
+	}
+}
+
+func TestCELEvaluateCluster(t *testing.T) {
+	e, err := NewEvaluator(LanguageCEL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	members := []Variables{
+		{DBSize: 1000, DBSizeInUse: 400},
+		{DBSize: 500, DBSizeInUse: 400, IsLeader: true},
+	}
+	cluster := ClusterVariables{ClusterMaxDBSize: 1000, ClusterMinDBSize: 500, MemberCount: 2, HealthyMemberCount: 2}
+
+	testCases := []struct {
+		name             string
+		rule             string
+		expectError      bool
+		evaluationResult bool
+	}{
+		{
+			name:             "cluster variables",
+			rule:             "clusterMaxDbSize - clusterMinDbSize >= 500",
+			evaluationResult: true,
+		},
+		{
+			name:             "members",
+			rule:             "members.exists(m, m.dbSizeFree > 500) && members.filter(m, m.isLeader).size() == 1",
+			evaluationResult: true,
+		},
+		{
+			name: "all members",
+			rule: "members.all(m, m.dbSizeFree > 500)",
+		},
+		{
+			name:        "member out of range",
+			rule:        "members[2].dbSize > 0",
+			expectError: true,
+		},
+	}
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			ret, err := e.EvaluateCluster(tc.rule, members, cluster)
+			if tc.expectError != (err != nil) {
+				t.Fatalf("Unexpected result, expected error: %t, got %v", tc.expectError, err)
+			}
+			if ret != tc.evaluationResult {
+				t.Fatalf("Unexpected evaluation result, expected %t, got %t", tc.evaluationResult, ret)
+			}
+		})
+	}
+}
+
+func TestNewEvaluator(t *testing.T) {
+	for _, language := range []string{"", LanguageGoval, LanguageCEL} {
+		if _, err := NewEvaluator(language); err != nil {
+			t.Fatalf("Unexpected error for language %q: %v", language, err)
+		}
+	}
+	if _, err := NewEvaluator("lua"); err == nil {
+		t.Fatal("Expected an error for an unknown language")
+	}
+}
+
+func TestCELScore(t *testing.T) {
+	e, err := NewEvaluator(LanguageCEL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vars := Variables{DBQuota: 1000, DBSize: 800, DBSizeInUse: 300}
+
+	testCases := []struct {
+		name          string
+		expr          string
+		expectError   bool
+		expectedScore float64
+	}{
+		{
+			name: "empty expression",
+		},
+		{
+			name:          "int",
+			expr:          "dbSizeFree",
+			expectedScore: 500,
+		},
+		{
+			name:          "double",
+			expr:          "double(dbSizeFree) / double(dbSize)",
+			expectedScore: 0.625,
+		},
+		{
+			name:        "boolean expression",
+			expr:        "dbSize > 100",
+			expectError: true,
+		},
+	}
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			if err := e.ValidateScore(tc.expr); tc.expectError != (err != nil) {
+				t.Fatalf("Unexpected validation result, expected error: %t, got %v", tc.expectError, err)
+			}
+			score, err := e.Score(tc.expr, vars)
+			if tc.expectError != (err != nil) {
+				t.Fatalf("Unexpected result, expected error: %t, got %v", tc.expectError, err)
+			}
+			if score != tc.expectedScore {
+				t.Fatalf("Unexpected score, expected %v, got %v", tc.expectedScore, score)
+			}
+		})
+	}
+}
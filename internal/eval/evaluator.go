@@ -2,6 +2,9 @@ package eval
 
 import (
 	"errors"
+	"fmt"
+	"strconv"
+	"strings"
 
 	"github.com/maja42/goval"
 )
@@ -12,49 +15,268 @@ const (
 	DBQuota      = "dbQuota"
 	DBQuotaUsage = "dbQuotaUsage"
 	DBSizeFree   = "dbSizeFree"
+
+	IsLeader         = "isLeader"
+	IsLearner        = "isLearner"
+	RaftTerm         = "raftTerm"
+	RaftIndex        = "raftIndex"
+	RaftAppliedIndex = "raftAppliedIndex"
+	Revision         = "revision"
+	Version          = "version"
+	MemberName       = "memberName"
+	NoSpaceAlarms    = "noSpaceAlarms"
+
+	ClusterMaxDBSize        = "clusterMaxDbSize"
+	ClusterMinDBSize        = "clusterMinDbSize"
+	ClusterMedianDBSizeFree = "clusterMedianDbSizeFree"
+	MemberCount             = "memberCount"
+	HealthyMemberCount      = "healthyMemberCount"
+
+	// Members is only available in cluster scope, it's the list of all
+	// members' variables, e.g. `members[0].dbSize`.
+	Members = "members"
 )
 
+// Variables holds the values of a member exposed to the defragmentation rule.
+type Variables struct {
+	DBQuota          int64
+	DBSize           int64
+	DBSizeInUse      int64
+	IsLeader         bool
+	IsLearner        bool
+	RaftTerm         uint64
+	RaftIndex        uint64
+	RaftAppliedIndex uint64
+	Revision         int64
+	// Version is the etcd server version, e.g. "3.6.1". It's exposed to
+	// the rule as a comparable number, see VersionNumber.
+	Version       string
+	MemberName    string
+	NoSpaceAlarms int
+
+	ClusterVariables
+}
+
+// ClusterVariables holds the aggregated values of the cluster exposed to the
+// defragmentation rule. They are the same for all members in a run.
+type ClusterVariables struct {
+	ClusterMaxDBSize        int64
+	ClusterMinDBSize        int64
+	ClusterMedianDBSizeFree float64
+	MemberCount             int
+	HealthyMemberCount      int
+}
+
+func (v Variables) toMap() map[string]interface{} {
+	vars := map[string]interface{}{
+		DBQuota:          float64(v.DBQuota),
+		DBSize:           float64(v.DBSize),
+		DBSizeInUse:      float64(v.DBSizeInUse),
+		DBQuotaUsage:     float64(v.DBSize) / float64(v.DBQuota),
+		DBSizeFree:       float64(v.DBSize - v.DBSizeInUse),
+		IsLeader:         v.IsLeader,
+		IsLearner:        v.IsLearner,
+		RaftTerm:         float64(v.RaftTerm),
+		RaftIndex:        float64(v.RaftIndex),
+		RaftAppliedIndex: float64(v.RaftAppliedIndex),
+		Revision:         float64(v.Revision),
+		Version:          float64(VersionNumber(v.Version)),
+		MemberName:       v.MemberName,
+		NoSpaceAlarms:    float64(v.NoSpaceAlarms),
+	}
+	for k, val := range v.ClusterVariables.toMap() {
+		vars[k] = val
+	}
+	return vars
+}
+
+func (c ClusterVariables) toMap() map[string]interface{} {
+	return map[string]interface{}{
+		ClusterMaxDBSize:        float64(c.ClusterMaxDBSize),
+		ClusterMinDBSize:        float64(c.ClusterMinDBSize),
+		ClusterMedianDBSizeFree: c.ClusterMedianDBSizeFree,
+		MemberCount:             float64(c.MemberCount),
+		HealthyMemberCount:      float64(c.HealthyMemberCount),
+	}
+}
+
+// clusterScopeVariables returns the variables of a rule evaluated once for
+// the whole cluster: the cluster variables, and the variables of each member
+// in the list `members`.
+func clusterScopeVariables(members []Variables, cluster ClusterVariables) map[string]interface{} {
+	vars := cluster.toMap()
+	list := make([]interface{}, 0, len(members))
+	for _, m := range members {
+		list = append(list, m.toMap())
+	}
+	vars[Members] = list
+	return vars
+}
+
+// SetVariable sets the member variable by its name in the rule, e.g.
+// "dbSize", from its string value. The derived variables dbQuotaUsage and
+// dbSizeFree can't be set.
+func (v *Variables) SetVariable(name, value string) error {
+	var err error
+	switch name {
+	case DBQuota:
+		v.DBQuota, err = strconv.ParseInt(value, 10, 64)
+	case DBSize:
+		v.DBSize, err = strconv.ParseInt(value, 10, 64)
+	case DBSizeInUse:
+		v.DBSizeInUse, err = strconv.ParseInt(value, 10, 64)
+	case IsLeader:
+		v.IsLeader, err = strconv.ParseBool(value)
+	case IsLearner:
+		v.IsLearner, err = strconv.ParseBool(value)
+	case RaftTerm:
+		v.RaftTerm, err = strconv.ParseUint(value, 10, 64)
+	case RaftIndex:
+		v.RaftIndex, err = strconv.ParseUint(value, 10, 64)
+	case RaftAppliedIndex:
+		v.RaftAppliedIndex, err = strconv.ParseUint(value, 10, 64)
+	case Revision:
+		v.Revision, err = strconv.ParseInt(value, 10, 64)
+	case Version:
+		if VersionNumber(value) == 0 {
+			err = errors.New("expected a version like 3.6.1")
+		}
+		v.Version = value
+	case MemberName:
+		v.MemberName = value
+	case NoSpaceAlarms:
+		v.NoSpaceAlarms, err = strconv.Atoi(value)
+	case ClusterMaxDBSize:
+		v.ClusterMaxDBSize, err = strconv.ParseInt(value, 10, 64)
+	case ClusterMinDBSize:
+		v.ClusterMinDBSize, err = strconv.ParseInt(value, 10, 64)
+	case ClusterMedianDBSizeFree:
+		v.ClusterMedianDBSizeFree, err = strconv.ParseFloat(value, 64)
+	case MemberCount:
+		v.MemberCount, err = strconv.Atoi(value)
+	case HealthyMemberCount:
+		v.HealthyMemberCount, err = strconv.Atoi(value)
+	case DBQuotaUsage, DBSizeFree:
+		return fmt.Errorf("%s is derived from the other variables and can't be set", name)
+	default:
+		return fmt.Errorf("unknown variable %q", name)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid value %q for %s: %w", value, name, err)
+	}
+	return nil
+}
+
 func defaultVariables() map[string]interface{} {
-	variables := map[string]interface{}{
-		DBQuota:     float64(2 * 1024 * 1024 * 1024), // 2GiB
-		DBSize:      float64(100 * 1024 * 1024),      // 100MiB
-		DBSizeInUse: float64(60 * 1024 * 1024),       // 60MiB
+	return defaultMemberVariables().toMap()
+}
+
+func defaultClusterScopeVariables() map[string]interface{} {
+	m := defaultMemberVariables()
+	return clusterScopeVariables([]Variables{m, m, m}, m.ClusterVariables)
+}
+
+func defaultMemberVariables() Variables {
+	return Variables{
+		DBQuota:          2 * 1024 * 1024 * 1024, // 2GiB
+		DBSize:           100 * 1024 * 1024,      // 100MiB
+		DBSizeInUse:      60 * 1024 * 1024,       // 60MiB
+		RaftTerm:         2,
+		RaftIndex:        1000,
+		RaftAppliedIndex: 1000,
+		Revision:         500,
+		Version:          "3.6.0",
+		MemberName:       "default",
+		ClusterVariables: ClusterVariables{
+			ClusterMaxDBSize:        100 * 1024 * 1024, // 100MiB
+			ClusterMinDBSize:        100 * 1024 * 1024, // 100MiB
+			ClusterMedianDBSizeFree: 40 * 1024 * 1024,  // 40MiB
+			MemberCount:             3,
+			HealthyMemberCount:      3,
+		},
+	}
+}
+
+// VersionNumber converts a version string "major.minor.patch" into the
+// number major*10000 + minor*100 + patch, e.g. 3.6.1 => 30601, so that
+// versions can be compared in the rule. Any pre-release or build suffix is
+// ignored, and 0 is returned if the version can't be parsed.
+func VersionNumber(version string) int {
+	version = strings.TrimPrefix(version, "v")
+	if i := strings.IndexAny(version, "-+"); i >= 0 {
+		version = version[:i]
 	}
-	variables[DBQuotaUsage] = variables[DBSize].(float64) / variables[DBQuota].(float64)
-	variables[DBSizeFree] = variables[DBSize].(float64) - variables[DBSizeInUse].(float64)
-	return variables
+
+	parts := strings.Split(version, ".")
+	if len(parts) != 3 {
+		return 0
+	}
+	num := 0
+	for _, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 || n > 99 {
+			return 0
+		}
+		num = num*100 + n
+	}
+	return num
 }
 
 func ValidateRule(rule string) error {
 	if len(rule) == 0 {
 		return nil
 	}
-	eval := goval.NewEvaluator()
-	result, err := eval.Evaluate(rule, defaultVariables(), nil)
-	if err != nil {
-		return err
-	}
-	if _, ok := result.(bool); !ok {
-		return errors.New("the rule isn't a boolean expression")
+	_, err := evaluate(rule, defaultVariables())
+	return err
+}
+
+// ValidateClusterRule validates a rule evaluated once for the whole cluster,
+// see EvaluateCluster.
+func ValidateClusterRule(rule string) error {
+	if len(rule) == 0 {
+		return nil
 	}
+	_, err := evaluate(rule, defaultClusterScopeVariables())
 	return err
 }
 
-func Evaluate(rule string, dbQuota, dbSize, dbSizeInUse int64) (bool, error) {
+func Evaluate(rule string, vars Variables) (bool, error) {
 	if len(rule) == 0 {
 		return true, nil
 	}
+	return evaluate(rule, vars.toMap())
+}
 
-	variables := map[string]interface{}{
-		DBQuota:      float64(dbQuota),
-		DBSize:       float64(dbSize),
-		DBSizeInUse:  float64(dbSizeInUse),
-		DBQuotaUsage: float64(dbSize) / float64(dbQuota),
-		DBSizeFree:   float64(dbSize - dbSizeInUse),
+// EvaluateCluster evaluates a rule once for the whole cluster. The member
+// variables (e.g. dbSize) aren't available, instead the rule can access the
+// cluster variables and each member's variables via `members`.
+func EvaluateCluster(rule string, members []Variables, cluster ClusterVariables) (bool, error) {
+	if len(rule) == 0 {
+		return true, nil
 	}
-	eval := goval.NewEvaluator()
+	return evaluate(rule, clusterScopeVariables(members, cluster))
+}
 
-	result, err := eval.Evaluate(rule, variables, nil)
+// ValidateScore validates a score expression, see EvaluateScore.
+func ValidateScore(expr string) error {
+	if len(expr) == 0 {
+		return nil
+	}
+	_, err := evaluateScore(expr, defaultVariables())
+	return err
+}
+
+// EvaluateScore evaluates a numeric expression over the member variables,
+// which ranks the members to defragment, the highest score first.
+func EvaluateScore(expr string, vars Variables) (float64, error) {
+	if len(expr) == 0 {
+		return 0, nil
+	}
+	return evaluateScore(expr, vars.toMap())
+}
+
+func evaluate(rule string, vars map[string]interface{}) (bool, error) {
+	result, err := evaluateValue(rule, vars)
 	if err != nil {
 		return false, err
 	}
@@ -64,3 +286,28 @@ func Evaluate(rule string, dbQuota, dbSize, dbSizeInUse int64) (bool, error) {
 
 	return result.(bool), err
 }
+
+func evaluateScore(expr string, vars map[string]interface{}) (float64, error) {
+	result, err := evaluateValue(expr, vars)
+	if err != nil {
+		return 0, err
+	}
+	switch v := result.(type) {
+	case int:
+		return float64(v), nil
+	case float64:
+		return v, nil
+	}
+	return 0, errors.New("the score isn't a numeric expression")
+}
+
+func evaluateValue(expr string, vars map[string]interface{}) (interface{}, error) {
+	src, err := rewrite(expr)
+	if err != nil {
+		return nil, err
+	}
+
+	eval := goval.NewEvaluator()
+
+	return eval.Evaluate(src, vars, functions())
+}
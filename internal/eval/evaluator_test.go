@@ -55,6 +55,54 @@ func TestValidateRule(t *testing.T) {
 			rule:        "dbSizE > 100",
 			expectError: true,
 		},
+		{
+			name:        "valid rule with member variables",
+			rule:        "(!isLeader || dbQuotaUsage > 0.9) && !isLearner && raftIndex - raftAppliedIndex < 100",
+			expectError: false,
+		},
+		{
+			name:        "valid rule with version, memberName and noSpaceAlarms",
+			rule:        `version >= semver("3.6.0") && memberName != "infra1" && noSpaceAlarms == 0 && revision > raftTerm`,
+			expectError: false,
+		},
+		{
+			name:        "valid rule with cluster variables",
+			rule:        "dbSizeFree > clusterMedianDbSizeFree*2 && dbSize >= clusterMaxDbSize - clusterMinDbSize && healthyMemberCount == memberCount",
+			expectError: false,
+		},
+		{
+			name: "valid rule with size and percentage literals",
+			rule: "dbQuotaUsage > 80% || dbSizeFree > 200MiB && dbSize < 1.5GiB",
+		},
+		{
+			name: "valid rule with functions",
+			rule: "ratio(dbSizeFree, dbSize) > 50% && abs(dbSize - clusterMaxDbSize) < max(100MB, dbQuota * 10%) && min(dbSize, 1GiB) > 0",
+		},
+		{
+			name:        "unknown size unit",
+			rule:        "dbSizeFree > 200Mib",
+			expectError: true,
+		},
+		{
+			name:        "unknown function",
+			rule:        "avg(dbSize, dbSizeInUse) > 100",
+			expectError: true,
+		},
+		{
+			name:        "wrong number of arguments",
+			rule:        "ratio(dbSizeFree) > 0.5",
+			expectError: true,
+		},
+		{
+			name:        "invalid argument type",
+			rule:        `abs("dbSize") > 0`,
+			expectError: true,
+		},
+		{
+			name:        "invalid version literal",
+			rule:        `version >= semver("3.6")`,
+			expectError: true,
+		},
 	}
 	for _, tc := range testCases {
 		tc := tc
@@ -186,6 +234,56 @@ func TestEvaluate(t *testing.T) {
 			dbSizeInUse:      60,
 			evaluationResult: true,
 		},
+		{
+			name:             "dbQuotaUsage is greater than 80%",
+			rule:             "dbQuotaUsage > 80%",
+			dbQuota:          100,
+			dbSize:           81,
+			evaluationResult: true,
+		},
+		{
+			name:    "dbQuotaUsage is less than 80% - 10%",
+			rule:    "dbQuotaUsage > 80% - 10%",
+			dbQuota: 100,
+			dbSize:  50,
+		},
+		{
+			name:    "dbSize is less than 80% of dbQuota",
+			rule:    "dbSize > 80% * dbQuota",
+			dbQuota: 100,
+			dbSize:  79,
+		},
+		{
+			name:             "dbSizeFree is greater than 200MiB",
+			rule:             "dbSizeFree > 200MiB",
+			dbSize:           300 * 1024 * 1024,
+			dbSizeInUse:      99 * 1024 * 1024,
+			evaluationResult: true,
+		},
+		{
+			name:        "dbSizeFree is less than 200MiB",
+			rule:        "dbSizeFree > 200MiB",
+			dbSize:      300 * 1024 * 1024,
+			dbSizeInUse: 101 * 1024 * 1024,
+		},
+		{
+			name:             "ratio of free space is greater than 25%",
+			rule:             "ratio(dbSizeFree, dbSize) > 25%",
+			dbSize:           100,
+			dbSizeInUse:      70,
+			evaluationResult: true,
+		},
+		{
+			name:        "ratio is divided by zero",
+			rule:        "ratio(dbSizeFree, dbSize) > 25%",
+			expectError: true,
+		},
+		{
+			name:             "modulo isn't a percentage",
+			rule:             "dbSize %2 == 1",
+			dbSize:           81,
+			evaluationResult: true,
+		},
 		{
 			name:             "expression evaluation result shouldn't round to 0",
 			rule:             "dbSizeInUse / dbSize < 0.5",
@@ -197,7 +295,207 @@ func TestEvaluate(t *testing.T) {
 	for _, tc := range testCases {
 		tc := tc
 		t.Run(tc.name, func(t *testing.T) {
-			ret, err := Evaluate(tc.rule, int64(tc.dbQuota), int64(tc.dbSize), int64(tc.dbSizeInUse))
+			ret, err := Evaluate(tc.rule, Variables{
+				DBQuota:     int64(tc.dbQuota),
+				DBSize:      int64(tc.dbSize),
+				DBSizeInUse: int64(tc.dbSizeInUse),
+			})
+			if tc.expectError != (err != nil) {
+				t.Fatalf("Unexpected result, expected error: %t, got %v", tc.expectError, err)
+			}
+			if ret != tc.evaluationResult {
+				t.Fatalf("Unexpected evaluation result, expected %t, got %t", tc.evaluationResult, ret)
+			}
+		})
+	}
+}
+
+func TestEvaluate_MemberVariables(t *testing.T) {
+	rule := `(!isLeader || dbQuotaUsage > 0.9) && version >= semver("3.5.0") && memberName != "infra3" && noSpaceAlarms == 0`
+	testCases := []struct {
+		name             string
+		vars             Variables
+		evaluationResult bool
+	}{
+		{
+			name:             "follower",
+			vars:             Variables{DBQuota: 100, DBSize: 50, Version: "3.5.21", MemberName: "infra1"},
+			evaluationResult: true,
+		},
+		{
+			name: "leader below 90% of the quota",
+			vars: Variables{DBQuota: 100, DBSize: 50, IsLeader: true, Version: "3.6.0", MemberName: "infra1"},
+		},
+		{
+			name:             "leader above 90% of the quota",
+			vars:             Variables{DBQuota: 100, DBSize: 91, IsLeader: true, Version: "3.6.0", MemberName: "infra1"},
+			evaluationResult: true,
+		},
+		{
+			name: "old version",
+			vars: Variables{DBQuota: 100, DBSize: 50, Version: "3.4.30", MemberName: "infra1"},
+		},
+		{
+			name: "excluded member",
+			vars: Variables{DBQuota: 100, DBSize: 50, Version: "3.6.0", MemberName: "infra3"},
+		},
+		{
+			name: "member with NOSPACE alarm",
+			vars: Variables{DBQuota: 100, DBSize: 50, Version: "3.6.0", MemberName: "infra1", NoSpaceAlarms: 1},
+		},
+	}
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			ret, err := Evaluate(rule, tc.vars)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if ret != tc.evaluationResult {
+				t.Fatalf("Unexpected evaluation result, expected %t, got %t", tc.evaluationResult, ret)
+			}
+		})
+	}
+}
+
+func TestVersionNumber(t *testing.T) {
+	testCases := []struct {
+		version  string
+		expected int
+	}{
+		{version: "3.6.1", expected: 30601},
+		{version: "3.5.21", expected: 30521},
+		{version: "v3.4.0", expected: 30400},
+		{version: "3.6.0-rc.1", expected: 30600},
+		{version: "3.6", expected: 0},
+		{version: "", expected: 0},
+		{version: "a.b.c", expected: 0},
+	}
+	for _, tc := range testCases {
+		if got := VersionNumber(tc.version); got != tc.expected {
+			t.Errorf("Unexpected version number for %q, expected %d, got %d", tc.version, tc.expected, got)
+		}
+	}
+}
+
+func TestEvaluate_ClusterVariables(t *testing.T) {
+	rule := "dbSizeFree > clusterMedianDbSizeFree*2 && healthyMemberCount == memberCount"
+	cluster := ClusterVariables{
+		ClusterMaxDBSize:        1000,
+		ClusterMinDBSize:        400,
+		ClusterMedianDBSizeFree: 100,
+		MemberCount:             3,
+		HealthyMemberCount:      3,
+	}
+	testCases := []struct {
+		name             string
+		vars             Variables
+		evaluationResult bool
+	}{
+		{
+			name:             "free space well above the median",
+			vars:             Variables{DBSize: 1000, DBSizeInUse: 700, ClusterVariables: cluster},
+			evaluationResult: true,
+		},
+		{
+			name: "free space close to the median",
+			vars: Variables{DBSize: 400, DBSizeInUse: 250, ClusterVariables: cluster},
+		},
+		{
+			name: "unhealthy member in the cluster",
+			vars: Variables{DBSize: 1000, DBSizeInUse: 700, ClusterVariables: ClusterVariables{
+				ClusterMedianDBSizeFree: 100,
+				MemberCount:             3,
+				HealthyMemberCount:      2,
+			}},
+		},
+	}
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			ret, err := Evaluate(rule, tc.vars)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if ret != tc.evaluationResult {
+				t.Fatalf("Unexpected evaluation result, expected %t, got %t", tc.evaluationResult, ret)
+			}
+		})
+	}
+}
+
+func TestValidateClusterRule(t *testing.T) {
+	testCases := []struct {
+		name        string
+		rule        string
+		expectError bool
+	}{
+		{
+			name: "valid rule with cluster variables",
+			rule: "clusterMaxDbSize - clusterMinDbSize > 100*1024*1024 && healthyMemberCount == memberCount",
+		},
+		{
+			name: "valid rule with members",
+			rule: "members[0].dbSizeFree > clusterMedianDbSizeFree || members[1].isLeader",
+		},
+		{
+			name:        "member variables aren't available",
+			rule:        "dbSize > 100",
+			expectError: true,
+		},
+		{
+			name:        "not a boolean expression",
+			rule:        "clusterMaxDbSize",
+			expectError: true,
+		},
+	}
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			err := ValidateClusterRule(tc.rule)
+			if tc.expectError != (err != nil) {
+				t.Errorf("Unexpected result, expected error: %t, got %v", tc.expectError, err)
+			}
+		})
+	}
+}
+
+func TestEvaluateCluster(t *testing.T) {
+	members := []Variables{
+		{DBSize: 1000, DBSizeInUse: 400},
+		{DBSize: 500, DBSizeInUse: 400, IsLeader: true},
+	}
+	cluster := ClusterVariables{ClusterMaxDBSize: 1000, ClusterMinDBSize: 500, MemberCount: 2, HealthyMemberCount: 2}
+
+	testCases := []struct {
+		name             string
+		rule             string
+		expectError      bool
+		evaluationResult bool
+	}{
+		{
+			name:             "empty rule",
+			evaluationResult: true,
+		},
+		{
+			name:             "cluster variables",
+			rule:             "clusterMaxDbSize - clusterMinDbSize >= 500",
+			evaluationResult: true,
+		},
+		{
+			name: "members",
+			rule: "members[0].dbSizeFree > 600 || !members[1].isLeader",
+		},
+		{
+			name:        "member out of range",
+			rule:        "members[2].dbSize > 0",
+			expectError: true,
+		},
+	}
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			ret, err := EvaluateCluster(tc.rule, members, cluster)
 			if tc.expectError != (err != nil) {
 				t.Fatalf("Unexpected result, expected error: %t, got %v", tc.expectError, err)
 			}
@@ -207,3 +505,58 @@ func TestEvaluate(t *testing.T) {
 		})
 	}
 }
+
+func TestEvaluateScore(t *testing.T) {
+	vars := Variables{DBQuota: 1000, DBSize: 800, DBSizeInUse: 300}
+
+	testCases := []struct {
+		name          string
+		expr          string
+		expectError   bool
+		expectedScore float64
+	}{
+		{
+			name: "empty expression",
+		},
+		{
+			name:          "variable",
+			expr:          "dbSizeFree",
+			expectedScore: 500,
+		},
+		{
+			name:          "arithmetic and functions",
+			expr:          "ratio(dbSizeFree, dbSize) * 100 + max(dbQuotaUsage, 0.9)",
+			expectedScore: 63.4,
+		},
+		{
+			name:          "integer literal",
+			expr:          "1",
+			expectedScore: 1,
+		},
+		{
+			name:        "boolean expression",
+			expr:        "dbSize > 100",
+			expectError: true,
+		},
+		{
+			name:        "unknown variable",
+			expr:        "dbSizE",
+			expectError: true,
+		},
+	}
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			if err := ValidateScore(tc.expr); tc.expectError != (err != nil) {
+				t.Fatalf("Unexpected validation result, expected error: %t, got %v", tc.expectError, err)
+			}
+			score, err := EvaluateScore(tc.expr, vars)
+			if tc.expectError != (err != nil) {
+				t.Fatalf("Unexpected result, expected error: %t, got %v", tc.expectError, err)
+			}
+			if score != tc.expectedScore {
+				t.Fatalf("Unexpected score, expected %v, got %v", tc.expectedScore, score)
+			}
+		})
+	}
+}
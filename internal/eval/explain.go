@@ -0,0 +1,198 @@
+package eval
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/maja42/goval"
+)
+
+// Step is the value of a sub-expression of the rule.
+type Step struct {
+	// Expr is the sub-expression as written in the rule.
+	Expr string
+	// Depth is the nesting level of the sub-expression, 0 for the rule itself.
+	Depth int
+	Value string
+}
+
+// VariableValue is a variable and its value.
+type VariableValue struct {
+	Name  string
+	Value string
+}
+
+func (v VariableValue) String() string {
+	return v.Name + "=" + v.Value
+}
+
+// Explanation explains how a rule is evaluated.
+type Explanation struct {
+	Result bool
+	// Steps lists the value of every sub-expression of the rule, parents
+	// before their children. Literals are omitted.
+	Steps []Step
+	// Deciding lists the variables which decided the result, e.g. only the
+	// true operands of a true `||` expression are taken into account.
+	Deciding []VariableValue
+}
+
+// Explain evaluates the rule like Evaluate, and explains the result.
+func Explain(rule string, vars Variables) (*Explanation, error) {
+	if len(rule) == 0 {
+		return &Explanation{Result: true}, nil
+	}
+	return explain(rule, vars.toMap())
+}
+
+func explain(rule string, vars map[string]interface{}) (*Explanation, error) {
+	result, err := evaluate(rule, vars)
+	if err != nil {
+		return nil, err
+	}
+
+	root, err := parse(rule)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &explainer{vars: vars, values: map[*node]interface{}{}}
+	exp := &Explanation{Result: result}
+	if err := e.walk(root, 0, &exp.Steps); err != nil {
+		return nil, err
+	}
+
+	deciding := map[*node]bool{}
+	e.deciding(root, deciding)
+	var nodes []*node
+	for n := range deciding {
+		nodes = append(nodes, n)
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].start < nodes[j].start })
+	seen := map[string]bool{}
+	for _, n := range nodes {
+		name := n.String()
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		exp.Deciding = append(exp.Deciding, VariableValue{Name: name, Value: formatValue(e.values[n])})
+	}
+
+	return exp, nil
+}
+
+type explainer struct {
+	vars map[string]interface{}
+	// values holds the value of each evaluated sub-expression.
+	values map[*node]interface{}
+}
+
+// walk evaluates each sub-expression on its own.
+func (e *explainer) walk(n *node, depth int, steps *[]Step) error {
+	if n == nil {
+		return nil
+	}
+	if n.kind == kindParen {
+		err := e.walk(n.args[0], depth, steps)
+		e.values[n] = e.values[n.args[0]]
+		return err
+	}
+
+	value, err := goval.NewEvaluator().Evaluate(n.String(), e.vars, functions())
+	if err != nil {
+		return fmt.Errorf("failed to evaluate %q: %w", n.src, err)
+	}
+	e.values[n] = value
+	if n.kind != kindLiteral {
+		*steps = append(*steps, Step{Expr: n.src, Depth: depth, Value: formatValue(value)})
+		depth++
+	}
+
+	for _, arg := range n.args {
+		if err := e.walk(arg, depth, steps); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deciding collects the variables deciding the value of the sub-expression.
+func (e *explainer) deciding(n *node, out map[*node]bool) {
+	if n == nil {
+		return
+	}
+
+	switch n.kind {
+	case kindLiteral:
+		return
+	case kindIdent:
+		out[n] = true
+		return
+	case kindParen:
+		e.deciding(n.args[0], out)
+		return
+	case kindField, kindIndex:
+		if isVariableAccess(n) {
+			// e.g. members[0].dbSize is reported as a whole.
+			out[n] = true
+			if n.kind == kindIndex {
+				e.deciding(n.args[1], out)
+			}
+			return
+		}
+	case kindTernary:
+		e.deciding(n.args[0], out)
+		if asBool(e.values[n.args[0]]) {
+			e.deciding(n.args[1], out)
+		} else {
+			e.deciding(n.args[2], out)
+		}
+		return
+	case kindBinary:
+		if n.op == "&&" || n.op == "||" {
+			result := asBool(e.values[n])
+			// A true `&&` or a false `||` is decided by both operands,
+			// otherwise only by the operands having the same value as the
+			// result.
+			all := (n.op == "&&") == result
+			for _, arg := range n.args {
+				if all || asBool(e.values[arg]) == result {
+					e.deciding(arg, out)
+				}
+			}
+			return
+		}
+	}
+
+	for _, arg := range n.args {
+		e.deciding(arg, out)
+	}
+}
+
+// isVariableAccess returns whether n is a field or index access to a
+// variable, e.g. members[0].dbSize.
+func isVariableAccess(n *node) bool {
+	for n.kind == kindField || n.kind == kindIndex {
+		n = n.args[0]
+	}
+	return n.kind == kindIdent
+}
+
+func asBool(v interface{}) bool {
+	b, ok := v.(bool)
+	return ok && b
+}
+
+func formatValue(v interface{}) string {
+	switch val := v.(type) {
+	case float64:
+		return strconv.FormatFloat(val, 'f', -1, 64)
+	case string:
+		return strconv.Quote(val)
+	case nil:
+		return "nil"
+	}
+	return fmt.Sprintf("%v", v)
+}
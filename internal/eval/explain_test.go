@@ -0,0 +1,120 @@
+package eval
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestExplain(t *testing.T) {
+	vars := Variables{DBQuota: 1000, DBSize: 500, DBSizeInUse: 200, IsLeader: true, MemberName: "infra1"}
+
+	testCases := []struct {
+		name             string
+		rule             string
+		expectError      bool
+		evaluationResult bool
+		steps            []Step
+		deciding         []string
+	}{
+		{
+			name:             "empty rule",
+			evaluationResult: true,
+		},
+		{
+			name: "false OR is decided by both operands",
+			rule: "dbQuotaUsage > 0.8 || (dbSizeFree > 400)",
+			steps: []Step{
+				{Expr: "dbQuotaUsage > 0.8 || (dbSizeFree > 400)", Depth: 0, Value: "false"},
+				{Expr: "dbQuotaUsage > 0.8", Depth: 1, Value: "false"},
+				{Expr: "dbQuotaUsage", Depth: 2, Value: "0.5"},
+				{Expr: "dbSizeFree > 400", Depth: 1, Value: "false"},
+				{Expr: "dbSizeFree", Depth: 2, Value: "300"},
+			},
+			deciding: []string{"dbQuotaUsage=0.5", "dbSizeFree=300"},
+		},
+		{
+			name:             "true OR is decided by the true operands",
+			rule:             "dbQuotaUsage > 0.8 || dbSizeFree > 200",
+			evaluationResult: true,
+			deciding:         []string{"dbSizeFree=300"},
+		},
+		{
+			name:     "false AND is decided by the false operands",
+			rule:     "!isLeader && dbSize > dbQuota*40/100",
+			deciding: []string{"isLeader=true"},
+		},
+		{
+			name:             "true AND is decided by both operands",
+			rule:             `memberName == "infra1" && dbSize > dbQuota*40/100`,
+			evaluationResult: true,
+			deciding:         []string{`memberName="infra1"`, "dbSize=500", "dbQuota=1000"},
+		},
+		{
+			name:             "ternary is decided by the condition and the chosen branch",
+			rule:             "isLeader ? dbQuotaUsage > 0.4 : dbSizeFree > 100",
+			evaluationResult: true,
+			deciding:         []string{"isLeader=true", "dbQuotaUsage=0.5"},
+		},
+		{
+			name:        "invalid rule",
+			rule:        "dbSizE > 100",
+			expectError: true,
+		},
+	}
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			exp, err := Explain(tc.rule, vars)
+			if tc.expectError != (err != nil) {
+				t.Fatalf("Unexpected result, expected error: %t, got %v", tc.expectError, err)
+			}
+			if err != nil {
+				return
+			}
+			if exp.Result != tc.evaluationResult {
+				t.Fatalf("Unexpected evaluation result, expected %t, got %t", tc.evaluationResult, exp.Result)
+			}
+			if tc.steps != nil && !reflect.DeepEqual(tc.steps, exp.Steps) {
+				t.Fatalf("Unexpected steps, expected %v, got %v", tc.steps, exp.Steps)
+			}
+			var deciding []string
+			for _, v := range exp.Deciding {
+				deciding = append(deciding, v.String())
+			}
+			if !reflect.DeepEqual(tc.deciding, deciding) {
+				t.Fatalf("Unexpected deciding variables, expected %v, got %v", tc.deciding, deciding)
+			}
+		})
+	}
+}
+
+func TestSetVariable(t *testing.T) {
+	var vars Variables
+	for name, value := range map[string]string{
+		DBSize:     "100",
+		IsLeader:   "true",
+		Version:    "3.6.1",
+		MemberName: "infra1",
+		RaftIndex:  "42",
+	} {
+		if err := vars.SetVariable(name, value); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	expected := Variables{DBSize: 100, IsLeader: true, Version: "3.6.1", MemberName: "infra1", RaftIndex: 42}
+	if !reflect.DeepEqual(expected, vars) {
+		t.Fatalf("Unexpected variables, expected %+v, got %+v", expected, vars)
+	}
+
+	for name, value := range map[string]string{
+		DBSize:       "1e3",
+		IsLeader:     "yes",
+		Version:      "3.6",
+		DBQuotaUsage: "0.5",
+		"dbSizE":     "100",
+	} {
+		if err := vars.SetVariable(name, value); err == nil {
+			t.Fatalf("Expected an error for %s=%s", name, value)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package eval
+
+import (
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/maja42/goval"
+)
+
+// functions returns the functions which can be called in a rule.
+func functions() map[string]goval.ExpressionFunction {
+	return map[string]goval.ExpressionFunction{
+		// semver("3.6.0") converts a version literal into the same number
+		// as the version variable, e.g. `version >= semver("3.6.0")`.
+		"semver": func(args ...interface{}) (interface{}, error) {
+			if len(args) != 1 {
+				return nil, errors.New("semver expects exactly one argument")
+			}
+			s, ok := args[0].(string)
+			if !ok {
+				return nil, errors.New("semver expects a string argument")
+			}
+			num := VersionNumber(s)
+			if num == 0 {
+				return nil, fmt.Errorf("invalid version %q", s)
+			}
+			return float64(num), nil
+		},
+		// min(a, b, ...) returns the smallest number.
+		"min": func(args ...interface{}) (interface{}, error) {
+			return reduceNumbers("min", args, math.Min)
+		},
+		// max(a, b, ...) returns the largest number.
+		"max": func(args ...interface{}) (interface{}, error) {
+			return reduceNumbers("max", args, math.Max)
+		},
+		// abs(a) returns the absolute value of the number.
+		"abs": func(args ...interface{}) (interface{}, error) {
+			nums, err := numberArgs("abs", args, 1)
+			if err != nil {
+				return nil, err
+			}
+			return math.Abs(nums[0]), nil
+		},
+		// ratio(a, b) returns a/b, e.g. `ratio(dbSizeFree, dbSize) > 50%`.
+		"ratio": func(args ...interface{}) (interface{}, error) {
+			nums, err := numberArgs("ratio", args, 2)
+			if err != nil {
+				return nil, err
+			}
+			if nums[1] == 0 {
+				return nil, errors.New("ratio: division by zero")
+			}
+			return nums[0] / nums[1], nil
+		},
+	}
+}
+
+func reduceNumbers(name string, args []interface{}, f func(a, b float64) float64) (interface{}, error) {
+	if len(args) == 0 {
+		return nil, fmt.Errorf("%s expects at least one argument", name)
+	}
+	nums, err := numberArgs(name, args, len(args))
+	if err != nil {
+		return nil, err
+	}
+	result := nums[0]
+	for _, n := range nums[1:] {
+		result = f(result, n)
+	}
+	return result, nil
+}
+
+// numberArgs converts the arguments of the function to numbers, and checks
+// their count.
+func numberArgs(name string, args []interface{}, count int) ([]float64, error) {
+	if len(args) != count {
+		return nil, fmt.Errorf("%s expects %d argument(s), got %d", name, count, len(args))
+	}
+	nums := make([]float64, 0, len(args))
+	for _, arg := range args {
+		switch v := arg.(type) {
+		case int:
+			nums = append(nums, float64(v))
+		case float64:
+			nums = append(nums, v)
+		default:
+			return nil, fmt.Errorf("%s expects number arguments, got %T", name, arg)
+		}
+	}
+	return nums, nil
+}
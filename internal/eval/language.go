@@ -0,0 +1,78 @@
+package eval
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Languages in which the defragmentation rule can be written.
+const (
+	// LanguageGoval is the default language, see https://github.com/maja42/goval.
+	LanguageGoval = "goval"
+	// LanguageCEL is the Common Expression Language, see https://cel.dev.
+	LanguageCEL = "cel"
+)
+
+// Evaluator validates and evaluates the defragmentation rules written in one
+// language.
+type Evaluator interface {
+	// Validate checks a rule evaluated for each member.
+	Validate(rule string) error
+	// ValidateCluster checks a rule evaluated once for the whole cluster.
+	ValidateCluster(rule string) error
+	// Evaluate evaluates a rule against the variables of a member. An
+	// empty rule is always true.
+	Evaluate(rule string, vars Variables) (bool, error)
+	// EvaluateCluster evaluates a rule once for the whole cluster. An empty
+	// rule is always true.
+	EvaluateCluster(rule string, members []Variables, cluster ClusterVariables) (bool, error)
+	// ValidateScore checks a numeric expression evaluated for each member.
+	ValidateScore(expr string) error
+	// Score evaluates a numeric expression against the variables of a
+	// member. An empty expression is always 0.
+	Score(expr string, vars Variables) (float64, error)
+}
+
+var newCELEvaluatorOnce = sync.OnceValues(newCELEvaluator)
+
+// NewEvaluator returns the evaluator of the language, an empty language is
+// LanguageGoval.
+func NewEvaluator(language string) (Evaluator, error) {
+	switch language {
+	case "", LanguageGoval:
+		return govalEvaluator{}, nil
+	case LanguageCEL:
+		// The CEL environment is expensive to build, and the compiled rules
+		// are cached, so the evaluator is shared.
+		return newCELEvaluatorOnce()
+	}
+	return nil, fmt.Errorf("unknown rule language %q, only %s and %s are supported", language, LanguageGoval, LanguageCEL)
+}
+
+// govalEvaluator evaluates the rules written in goval, with the size and
+// percentage literals and the functions of this package.
+type govalEvaluator struct{}
+
+func (govalEvaluator) Validate(rule string) error {
+	return ValidateRule(rule)
+}
+
+func (govalEvaluator) ValidateCluster(rule string) error {
+	return ValidateClusterRule(rule)
+}
+
+func (govalEvaluator) Evaluate(rule string, vars Variables) (bool, error) {
+	return Evaluate(rule, vars)
+}
+
+func (govalEvaluator) EvaluateCluster(rule string, members []Variables, cluster ClusterVariables) (bool, error) {
+	return EvaluateCluster(rule, members, cluster)
+}
+
+func (govalEvaluator) ValidateScore(expr string) error {
+	return ValidateScore(expr)
+}
+
+func (govalEvaluator) Score(expr string, vars Variables) (float64, error) {
+	return EvaluateScore(expr, vars)
+}
@@ -0,0 +1,401 @@
+package eval
+
+import (
+	"fmt"
+
+	"github.com/maja42/goval"
+)
+
+// Warning is a probable mistake found in a rule by Lint.
+type Warning struct {
+	// Expr is the sub-expression as written in the rule.
+	Expr    string
+	Message string
+}
+
+func (w Warning) String() string {
+	return fmt.Sprintf("%q: %s", w.Expr, w.Message)
+}
+
+type valueType int
+
+const (
+	typeUnknown valueType = iota
+	typeNumber
+	typeBool
+	typeString
+)
+
+func (t valueType) String() string {
+	switch t {
+	case typeNumber:
+		return "a number"
+	case typeBool:
+		return "a boolean"
+	case typeString:
+		return "a string"
+	}
+	return "unknown"
+}
+
+type variableInfo struct {
+	typ valueType
+	// ratio is set for the variables usually between 0 and 1.
+	ratio bool
+	// nonNegative and nonZero describe the range of the number variables.
+	nonNegative bool
+	nonZero     bool
+}
+
+var (
+	sizeVar    = variableInfo{typ: typeNumber, nonNegative: true}
+	nonZeroVar = variableInfo{typ: typeNumber, nonNegative: true, nonZero: true}
+	boolVar    = variableInfo{typ: typeBool}
+)
+
+var memberVariableInfos = map[string]variableInfo{
+	DBSize:           nonZeroVar,
+	DBSizeInUse:      sizeVar,
+	DBSizeFree:       sizeVar,
+	DBQuota:          nonZeroVar,
+	DBQuotaUsage:     {typ: typeNumber, ratio: true, nonNegative: true},
+	IsLeader:         boolVar,
+	IsLearner:        boolVar,
+	RaftTerm:         sizeVar,
+	RaftIndex:        sizeVar,
+	RaftAppliedIndex: sizeVar,
+	Revision:         sizeVar,
+	Version:          sizeVar,
+	MemberName:       {typ: typeString},
+	NoSpaceAlarms:    sizeVar,
+}
+
+var clusterVariableInfos = map[string]variableInfo{
+	ClusterMaxDBSize:        nonZeroVar,
+	ClusterMinDBSize:        nonZeroVar,
+	ClusterMedianDBSizeFree: sizeVar,
+	MemberCount:             nonZeroVar,
+	HealthyMemberCount:      sizeVar,
+}
+
+// Lint reports the probable mistakes in a rule which ValidateRule can't
+// catch, because it only evaluates the rule against the default variables:
+// unknown identifiers, non-boolean operands of logic operators, booleans
+// compared with numbers or strings, ratios compared with values above 1,
+// divisions which may be by zero, and sub-expressions which are always true
+// or false.
+func Lint(rule string) ([]Warning, error) {
+	infos := map[string]variableInfo{}
+	for _, m := range []map[string]variableInfo{memberVariableInfos, clusterVariableInfos} {
+		for k, v := range m {
+			infos[k] = v
+		}
+	}
+	return lint(rule, infos)
+}
+
+// LintCluster is like Lint for a rule evaluated once for the whole cluster,
+// see EvaluateCluster.
+func LintCluster(rule string) ([]Warning, error) {
+	infos := map[string]variableInfo{Members: {typ: typeUnknown}}
+	for k, v := range clusterVariableInfos {
+		infos[k] = v
+	}
+	return lint(rule, infos)
+}
+
+func lint(rule string, infos map[string]variableInfo) ([]Warning, error) {
+	if len(rule) == 0 {
+		return nil, nil
+	}
+	root, err := parse(rule)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &linter{infos: infos}
+	if t := l.check(root); t != typeBool && t != typeUnknown {
+		l.warn(root, "the rule is %s, not a boolean expression", t)
+	}
+	return l.warnings, nil
+}
+
+type linter struct {
+	infos    map[string]variableInfo
+	warnings []Warning
+}
+
+func (l *linter) warn(n *node, format string, args ...interface{}) {
+	l.warnings = append(l.warnings, Warning{Expr: n.src, Message: fmt.Sprintf(format, args...)})
+}
+
+// check reports the problems of the sub-expression, and returns its type.
+func (l *linter) check(n *node) valueType {
+	if n.kind != kindLiteral && !l.hasVariables(n) {
+		// Only the outermost constant sub-expression is reported. If it
+		// can't be evaluated, the problem is reported below.
+		switch v, _ := l.constant(n); v.(type) {
+		case bool:
+			l.warn(n, "the expression is always %v", v)
+			return typeBool
+		case int, float64:
+			return typeNumber
+		case string:
+			return typeString
+		}
+	}
+	return l.typeOf(n)
+}
+
+func (l *linter) typeOf(n *node) valueType {
+	switch n.kind {
+	case kindLiteral:
+		switch {
+		case n.op == "true" || n.op == "false":
+			return typeBool
+		case n.op == "nil":
+			return typeUnknown
+		case n.op[0] == '"' || n.op[0] == '`':
+			return typeString
+		}
+		return typeNumber
+	case kindIdent:
+		info, ok := l.infos[n.op]
+		if !ok {
+			l.warn(n, "unknown variable %q", n.op)
+			return typeUnknown
+		}
+		return info.typ
+	case kindParen:
+		return l.typeOf(n.args[0])
+	case kindUnary:
+		t := l.check(n.args[0])
+		if n.op == "!" {
+			l.expectBool(n.args[0], t, "operand of !")
+			return typeBool
+		}
+		return typeNumber
+	case kindTernary:
+		l.expectBool(n.args[0], l.check(n.args[0]), "condition of ?:")
+		yes, no := l.check(n.args[1]), l.check(n.args[2])
+		if yes == no {
+			return yes
+		}
+		return typeUnknown
+	case kindBinary:
+		return l.checkBinary(n)
+	case kindCall:
+		for _, arg := range n.args {
+			l.check(arg)
+		}
+		if _, ok := functions()[n.op]; !ok {
+			l.warn(n, "unknown function %q", n.op)
+			return typeUnknown
+		}
+		if n.op == "ratio" && len(n.args) == 2 {
+			l.checkDivisor(n.args[1])
+		}
+		return typeNumber
+	}
+
+	// field and index accesses, arrays and objects
+	for _, arg := range n.args {
+		if arg != nil {
+			l.check(arg)
+		}
+	}
+	return typeUnknown
+}
+
+func (l *linter) checkBinary(n *node) valueType {
+	left, right := l.check(n.args[0]), l.check(n.args[1])
+
+	switch n.op {
+	case "&&", "||":
+		for i, t := range []valueType{left, right} {
+			arg := n.args[i]
+			l.expectBool(arg, t, "operand of "+n.op)
+			// Constant sub-expressions are reported by check, but not the
+			// literals, e.g. dbSize > 1 && true.
+			if arg.kind == kindLiteral && t == typeBool {
+				l.warn(arg, "the operand of %s is always %s", n.op, arg.op)
+			}
+		}
+		return typeBool
+	case "==", "!=", "<", "<=", ">", ">=":
+		if l.checkOperandTypes(n, left, right) {
+			l.checkComparison(n)
+		}
+		return typeBool
+	case "in":
+		return typeBool
+	case "/", "%":
+		l.checkDivisor(n.args[1])
+	case "+":
+		if left == typeString || right == typeString {
+			return typeString
+		}
+	}
+	return typeNumber
+}
+
+func (l *linter) expectBool(n *node, t valueType, what string) {
+	if t != typeBool && t != typeUnknown {
+		l.warn(n, "the %s is %s, not a boolean", what, t)
+	}
+}
+
+// checkOperandTypes reports a boolean compared with a number or a string,
+// e.g. isLeader == 1, and returns whether the types of the operands match.
+func (l *linter) checkOperandTypes(n *node, left, right valueType) bool {
+	if left == typeUnknown || right == typeUnknown || (left == typeBool) == (right == typeBool) {
+		return true
+	}
+	switch n.op {
+	case "==":
+		l.warn(n, "the expression is always false, %s is never equal to %s", left, right)
+	case "!=":
+		l.warn(n, "the expression is always true, %s is never equal to %s", left, right)
+	default:
+		l.warn(n, "%s can't be compared with %s, which fails the evaluation", left, right)
+	}
+	return false
+}
+
+// checkComparison reports a ratio compared with a value above 1, and a
+// non-negative variable compared with a value making the comparison always
+// true or false.
+func (l *linter) checkComparison(n *node) {
+	op := n.op
+	variable, value := n.args[0], n.args[1]
+	c, ok := l.number(value)
+	if !ok {
+		// e.g. 80 < dbQuotaUsage
+		variable, value = value, variable
+		if c, ok = l.number(value); !ok {
+			return
+		}
+		op = map[string]string{"<": ">", "<=": ">=", ">": "<", ">=": "<=", "==": "==", "!=": "!="}[op]
+	}
+
+	if l.isRatio(variable) && c > 1 {
+		l.warn(n, "%s is a ratio usually between 0 and 1, comparing it with %v is probably a mistake, did you mean %v%%?", variable.src, c, c)
+		return
+	}
+
+	info, ok := l.variableInfo(variable)
+	if !ok || !info.nonNegative {
+		return
+	}
+	// below is whether c is below the range of the variable.
+	below, reason := c < 0, "never negative"
+	if info.nonZero {
+		below, reason = c <= 0, "always positive"
+	}
+	switch {
+	case op == "<" && c <= 0, (op == "<=" || op == "==") && below:
+		l.warn(n, "the expression is always false, %s is %s", variable.src, reason)
+	case op == ">=" && c <= 0, (op == ">" || op == "!=") && below:
+		l.warn(n, "the expression is always true, %s is %s", variable.src, reason)
+	}
+}
+
+func (l *linter) checkDivisor(n *node) {
+	if c, ok := l.number(n); ok {
+		if c == 0 {
+			l.warn(n, "division by zero")
+		}
+		return
+	}
+	if l.mayBeZero(n) {
+		l.warn(n, "the divisor may be zero, which fails the evaluation")
+	}
+}
+
+func (l *linter) isRatio(n *node) bool {
+	info, ok := l.variableInfo(n)
+	return ok && info.ratio
+}
+
+// variableInfo returns the info of n if it's a variable.
+func (l *linter) variableInfo(n *node) (variableInfo, bool) {
+	for n.kind == kindParen {
+		n = n.args[0]
+	}
+	if n.kind != kindIdent {
+		return variableInfo{}, false
+	}
+	info, ok := l.infos[n.op]
+	return info, ok
+}
+
+func (l *linter) mayBeZero(n *node) bool {
+	switch n.kind {
+	case kindParen:
+		return l.mayBeZero(n.args[0])
+	case kindLiteral:
+		c, ok := l.number(n)
+		return !ok || c == 0
+	case kindIdent:
+		info, ok := l.infos[n.op]
+		return !ok || !info.nonZero
+	case kindBinary:
+		switch n.op {
+		case "*":
+			return l.mayBeZero(n.args[0]) || l.mayBeZero(n.args[1])
+		case "+":
+			// the sum of non-negative values is not zero if one of them isn't
+			return !(l.nonNegative(n.args[0]) && l.nonNegative(n.args[1]) &&
+				(!l.mayBeZero(n.args[0]) || !l.mayBeZero(n.args[1])))
+		}
+	}
+	return true
+}
+
+func (l *linter) nonNegative(n *node) bool {
+	if c, ok := l.number(n); ok {
+		return c >= 0
+	}
+	info, ok := l.variableInfo(n)
+	return ok && info.nonNegative
+}
+
+// hasVariables returns whether the sub-expression references any variable.
+func (l *linter) hasVariables(n *node) bool {
+	if n == nil {
+		return false
+	}
+	if n.kind == kindIdent {
+		return true
+	}
+	for _, arg := range n.args {
+		if l.hasVariables(arg) {
+			return true
+		}
+	}
+	return false
+}
+
+// constant evaluates a sub-expression without any variable.
+func (l *linter) constant(n *node) (interface{}, bool) {
+	v, err := goval.NewEvaluator().Evaluate(n.String(), nil, functions())
+	return v, err == nil
+}
+
+// number returns the value of a constant number sub-expression.
+func (l *linter) number(n *node) (float64, bool) {
+	if l.hasVariables(n) {
+		return 0, false
+	}
+	v, ok := l.constant(n)
+	if !ok {
+		return 0, false
+	}
+	switch c := v.(type) {
+	case int:
+		return float64(c), true
+	case float64:
+		return c, true
+	}
+	return 0, false
+}
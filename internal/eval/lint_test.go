@@ -0,0 +1,123 @@
+package eval
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLint(t *testing.T) {
+	testCases := []struct {
+		name     string
+		rule     string
+		cluster  bool
+		warnings []string
+	}{
+		{
+			name: "empty rule",
+		},
+		{
+			name: "no warning",
+			rule: "dbQuotaUsage > 80% || dbSizeFree > 200MiB && !isLeader && ratio(dbSizeInUse, dbSize) < 0.5",
+		},
+		{
+			name:     "unknown variable",
+			rule:     "dbSizE > 100 && dbSize > 0",
+			warnings: []string{`"dbSizE": unknown variable "dbSizE"`, `"dbSize > 0": the expression is always true, dbSize is always positive`},
+		},
+		{
+			name:     "unknown function",
+			rule:     "avg(dbSize, dbSizeInUse) > 100",
+			warnings: []string{`"avg(dbSize, dbSizeInUse)": unknown function "avg"`},
+		},
+		{
+			name:     "not a boolean expression",
+			rule:     "dbSize - dbSizeInUse",
+			warnings: []string{`"dbSize - dbSizeInUse": the rule is a number, not a boolean expression`},
+		},
+		{
+			name: "non-boolean operands",
+			rule: "dbSizeFree && !memberName || (isLeader ? 1 : 0)",
+			warnings: []string{
+				`"memberName": the operand of ! is a string, not a boolean`,
+				`"dbSizeFree": the operand of && is a number, not a boolean`,
+				`"(isLeader ? 1 : 0)": the operand of || is a number, not a boolean`,
+			},
+		},
+		{
+			name: "ratio compared with a value above 1",
+			rule: "dbQuotaUsage > 80 || 50 <= (dbQuotaUsage) || dbQuotaUsage > 1",
+			warnings: []string{
+				`"dbQuotaUsage > 80": dbQuotaUsage is a ratio usually between 0 and 1, comparing it with 80 is probably a mistake, did you mean 80%?`,
+				`"50 <= (dbQuotaUsage)": (dbQuotaUsage) is a ratio usually between 0 and 1, comparing it with 50 is probably a mistake, did you mean 50%?`,
+			},
+		},
+		{
+			name: "divisions which may be by zero",
+			rule: "dbSize / dbSizeFree > 2 || ratio(dbSize, dbSizeInUse) > 2 || dbSize / (dbQuota * 2) > 0.4 || dbSize % 0 == 1",
+			warnings: []string{
+				`"dbSizeFree": the divisor may be zero, which fails the evaluation`,
+				`"dbSizeInUse": the divisor may be zero, which fails the evaluation`,
+				`"0": division by zero`,
+			},
+		},
+		{
+			name: "constant sub-expressions",
+			rule: "(dbSize > 100 || 1 > 2) && dbSizeInUse >= 0 && noSpaceAlarms < 0",
+			warnings: []string{
+				`"1 > 2": the expression is always false`,
+				`"dbSizeInUse >= 0": the expression is always true, dbSizeInUse is never negative`,
+				`"noSpaceAlarms < 0": the expression is always false, noSpaceAlarms is never negative`,
+			},
+		},
+		{
+			name: "boolean literals in logic operators",
+			rule: "dbSize > 1 && true || (false) || !true",
+			warnings: []string{
+				`"true": the operand of && is always true`,
+				`"(false)": the expression is always false`,
+				`"!true": the expression is always false`,
+			},
+		},
+		{
+			name: "boolean compared with a number or a string",
+			rule: "isLeader == 1 || \"etcd-1\" != isLearner || isLeader > 0 || isLeader == (dbSize > 0) || memberName == 1",
+			warnings: []string{
+				`"isLeader == 1": the expression is always false, a boolean is never equal to a number`,
+				`"\"etcd-1\" != isLearner": the expression is always true, a string is never equal to a boolean`,
+				`"isLeader > 0": a boolean can't be compared with a number, which fails the evaluation`,
+				`"dbSize > 0": the expression is always true, dbSize is always positive`,
+			},
+		},
+		{
+			name:    "cluster scope",
+			rule:    "clusterMaxDbSize - clusterMinDbSize > 100MiB && members[0].dbSize > 0",
+			cluster: true,
+		},
+		{
+			name:     "member variables in cluster scope",
+			rule:     "dbSize > 100MiB",
+			cluster:  true,
+			warnings: []string{`"dbSize": unknown variable "dbSize"`},
+		},
+	}
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			lint := Lint
+			if tc.cluster {
+				lint = LintCluster
+			}
+			warnings, err := lint(tc.rule)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			var got []string
+			for _, w := range warnings {
+				got = append(got, w.String())
+			}
+			if !reflect.DeepEqual(tc.warnings, got) {
+				t.Fatalf("Unexpected warnings, expected %q, got %q", tc.warnings, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,122 @@
+package eval
+
+import (
+	"fmt"
+	"go/token"
+	"strconv"
+	"strings"
+)
+
+// sizeUnits are the units of the size literals, e.g. 200MiB or 1.5GB.
+var sizeUnits = map[string]float64{
+	"B":   1,
+	"KB":  1000,
+	"MB":  1000 * 1000,
+	"GB":  1000 * 1000 * 1000,
+	"TB":  1000 * 1000 * 1000 * 1000,
+	"KiB": 1 << 10,
+	"MiB": 1 << 20,
+	"GiB": 1 << 30,
+	"TiB": 1 << 40,
+}
+
+// mergeLiterals merges the tokens of the size literals (e.g. 200MiB) and
+// percentage literals (e.g. 80%), which goval doesn't support, into number
+// tokens. A number immediately followed by "%" is a percentage unless an
+// operand follows, e.g. `80% * dbQuota` is 0.8*dbQuota, but `dbSize %2` is
+// a modulo. A "-" after it is a subtraction like "+", e.g. `80% - 10%` is
+// 0.7, while `10 % -3` is still a modulo.
+func mergeLiterals(toks []lexToken) ([]lexToken, error) {
+	merged := make([]lexToken, 0, len(toks))
+	for i := 0; i < len(toks); i++ {
+		t := toks[i]
+		if (t.tok != token.INT && t.tok != token.FLOAT) || i+1 >= len(toks) || toks[i+1].start != t.end {
+			merged = append(merged, t)
+			continue
+		}
+
+		next := toks[i+1]
+		switch {
+		case next.tok == token.IDENT && next.lit != "in" && next.lit != "IN":
+			lit, err := sizeLiteral(t, next.lit)
+			if err != nil {
+				return nil, err
+			}
+			merged = append(merged, lexToken{tok: token.FLOAT, lit: lit, start: t.start, end: next.end, rewritten: true})
+			i++
+		case next.tok == token.REM && (i+2 >= len(toks) || !startsOperand(toks[i+2]) || toks[i+2].tok == token.SUB):
+			v, err := parseNumber(t)
+			if err != nil {
+				return nil, err
+			}
+			lit := strconv.FormatFloat(v/100, 'f', -1, 64)
+			merged = append(merged, lexToken{tok: token.FLOAT, lit: lit, start: t.start, end: next.end, rewritten: true})
+			i++
+		default:
+			merged = append(merged, t)
+		}
+	}
+	return merged, nil
+}
+
+func sizeLiteral(num lexToken, unit string) (string, error) {
+	mult, ok := sizeUnits[unit]
+	if !ok {
+		return "", fmt.Errorf("unknown size unit %q at position %d, supported units are B, KB, MB, GB, TB, KiB, MiB, GiB and TiB", unit, num.end)
+	}
+	v, err := parseNumber(num)
+	if err != nil {
+		return "", err
+	}
+	return strconv.FormatFloat(v*mult, 'f', -1, 64), nil
+}
+
+func parseNumber(t lexToken) (float64, error) {
+	if t.tok == token.INT {
+		n, err := strconv.ParseInt(t.lit, 0, 64)
+		if err != nil {
+			return 0, fmt.Errorf("parse error: cannot parse integer %q at position %d", t.lit, t.start)
+		}
+		return float64(n), nil
+	}
+	v, err := strconv.ParseFloat(t.lit, 64)
+	if err != nil {
+		return 0, fmt.Errorf("parse error: cannot parse float %q at position %d", t.lit, t.start)
+	}
+	return v, nil
+}
+
+// startsOperand returns whether the token can start an operand.
+func startsOperand(t lexToken) bool {
+	switch t.tok {
+	case token.IDENT:
+		return t.lit != "in" && t.lit != "IN"
+	case token.INT, token.FLOAT, token.STRING,
+		token.LPAREN, token.LBRACK, token.LBRACE,
+		token.NOT, token.SUB, token.TILDE:
+		return true
+	}
+	return t.lit == "~"
+}
+
+// rewrite returns the rule with the size and percentage literals replaced by
+// numbers, so that it can be evaluated by goval.
+func rewrite(rule string) (string, error) {
+	toks, err := tokenize(rule)
+	if err != nil {
+		return "", err
+	}
+
+	var b strings.Builder
+	last := 0
+	for _, t := range toks {
+		if !t.rewritten {
+			continue
+		}
+		b.WriteString(rule[last:t.start])
+		b.WriteString(t.lit)
+		last = t.end
+	}
+	b.WriteString(rule[last:])
+	return b.String(), nil
+}
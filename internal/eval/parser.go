@@ -0,0 +1,435 @@
+package eval
+
+import (
+	"fmt"
+	"go/scanner"
+	"go/token"
+	"strconv"
+	"strings"
+)
+
+// The parser below builds the syntax tree of a rule, which goval doesn't
+// expose. It follows goval's grammar and operator precedence, so that each
+// sub-expression can be printed and evaluated by goval on its own.
+
+type nodeKind int
+
+const (
+	kindLiteral nodeKind = iota // 42, 4.2, "text", true, nil
+	kindIdent                   // dbSize
+	kindParen                   // (x)
+	kindUnary                   // !x, -x, ~x
+	kindBinary                  // x op y
+	kindTernary                 // x ? y : z
+	kindCall                    // f(x, y)
+	kindField                   // x.name
+	kindIndex                   // x[y]
+	kindSlice                   // x[y:z]
+	kindArray                   // [x, y]
+	kindObject                  // {k: v}
+)
+
+type node struct {
+	kind nodeKind
+	// op is the operator, the literal, the identifier, the function name or
+	// the field name, depending on the kind.
+	op   string
+	args []*node
+	// src is the sub-expression as written in the rule, at [start, end).
+	src        string
+	start, end int
+}
+
+// String returns the sub-expression as a goval expression. Compound operands
+// are always parenthesized, so the result doesn't depend on precedence.
+func (n *node) String() string {
+	switch n.kind {
+	case kindLiteral, kindIdent:
+		return n.op
+	case kindParen:
+		return "(" + n.args[0].String() + ")"
+	case kindUnary:
+		return n.op + n.args[0].operand()
+	case kindBinary:
+		return n.args[0].operand() + " " + n.op + " " + n.args[1].operand()
+	case kindTernary:
+		return n.args[0].operand() + " ? " + n.args[1].operand() + " : " + n.args[2].operand()
+	case kindCall:
+		return n.op + "(" + joinNodes(n.args, ", ") + ")"
+	case kindField:
+		return n.args[0].operand() + "." + n.op
+	case kindIndex:
+		return n.args[0].operand() + "[" + n.args[1].String() + "]"
+	case kindSlice:
+		s := n.args[0].operand() + "["
+		if n.args[1] != nil {
+			s += n.args[1].String()
+		}
+		s += ":"
+		if n.args[2] != nil {
+			s += n.args[2].String()
+		}
+		return s + "]"
+	case kindArray:
+		return "[" + joinNodes(n.args, ", ") + "]"
+	case kindObject:
+		var pairs []string
+		for i := 0; i < len(n.args); i += 2 {
+			pairs = append(pairs, n.args[i].String()+": "+n.args[i+1].String())
+		}
+		return "{" + strings.Join(pairs, ", ") + "}"
+	}
+	return ""
+}
+
+// operand returns the expression to be used as an operand of another one.
+func (n *node) operand() string {
+	switch n.kind {
+	case kindUnary, kindBinary, kindTernary:
+		return "(" + n.String() + ")"
+	}
+	return n.String()
+}
+
+func joinNodes(nodes []*node, sep string) string {
+	var s []string
+	for _, n := range nodes {
+		s = append(s, n.String())
+	}
+	return strings.Join(s, sep)
+}
+
+type lexToken struct {
+	tok token.Token
+	// lit is the text of the token.
+	lit        string
+	start, end int
+	// rewritten is set if lit isn't the text of the rule at [start, end),
+	// see mergeLiterals.
+	rewritten bool
+}
+
+func tokenize(src string) ([]lexToken, error) {
+	fset := token.NewFileSet()
+	file := fset.AddFile("", fset.Base(), len(src))
+
+	var (
+		s    scanner.Scanner
+		toks []lexToken
+	)
+	// Like goval, no error handler: "?" is reported as an illegal character
+	// by go/scanner, but it's a valid token.
+	s.Init(file, []byte(src), nil, 0)
+
+	for {
+		pos, tok, lit := s.Scan()
+		if tok == token.EOF {
+			break
+		}
+		if tok == token.SEMICOLON && lit == "\n" {
+			// automatically inserted by go/scanner
+			continue
+		}
+		if tok.IsKeyword() {
+			tok = token.IDENT
+		}
+		if lit == "" {
+			lit = tok.String()
+		}
+		start := file.Offset(pos)
+		if tok == token.ARROW {
+			// "<-" is "<" followed by an unary minus.
+			toks = append(toks,
+				lexToken{tok: token.LSS, lit: "<", start: start, end: start + 1},
+				lexToken{tok: token.SUB, lit: "-", start: start + 1, end: start + 2})
+			continue
+		}
+		if tok == token.ILLEGAL && lit != "?" && lit != "~" {
+			return nil, fmt.Errorf("unknown token %q at position %d", lit, start)
+		}
+		if tok == token.STRING {
+			if _, err := strconv.Unquote(lit); err != nil {
+				return nil, fmt.Errorf("parse error: cannot unquote string literal at position %d", start)
+			}
+		}
+		toks = append(toks, lexToken{tok: tok, lit: lit, start: start, end: start + len(lit)})
+	}
+	return mergeLiterals(toks)
+}
+
+// Binding power of the binary and postfix operators, from goval's grammar.
+// The prefix operators bind with unaryPower.
+var infixPowers = map[string]int{
+	"?":  1,
+	"||": 2,
+	"&&": 3,
+	"|":  4,
+	"^":  5,
+	"&":  6,
+	"==": 7, "!=": 7,
+	"<": 8, "<=": 8, ">": 8, ">=": 8,
+	"<<": 9, ">>": 9,
+	"+": 10, "-": 10,
+	"*": 11, "/": 11, "%": 11,
+	"in": 13,
+	".":  14, "[": 14,
+}
+
+const unaryPower = 12
+
+type parser struct {
+	src  string
+	toks []lexToken
+	pos  int
+}
+
+// parse parses the rule into its syntax tree.
+func parse(src string) (*node, error) {
+	toks, err := tokenize(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{src: src, toks: toks}
+	n, err := p.parseExpr(0)
+	if err != nil {
+		return nil, err
+	}
+	if t, ok := p.peek(); ok {
+		return nil, p.unexpected(t)
+	}
+	return n, nil
+}
+
+func (p *parser) peek() (lexToken, bool) {
+	if p.pos >= len(p.toks) {
+		return lexToken{}, false
+	}
+	return p.toks[p.pos], true
+}
+
+func (p *parser) next() (lexToken, bool) {
+	t, ok := p.peek()
+	if ok {
+		p.pos++
+	}
+	return t, ok
+}
+
+// peekIs returns whether the next token has the given text.
+func (p *parser) peekIs(lit string) bool {
+	t, ok := p.peek()
+	return ok && t.tok != token.STRING && t.lit == lit
+}
+
+func (p *parser) expect(lit string) (lexToken, error) {
+	t, ok := p.next()
+	if !ok {
+		return t, fmt.Errorf("syntax error: expected %q, got the end of the rule", lit)
+	}
+	if t.tok == token.STRING || t.lit != lit {
+		return t, fmt.Errorf("syntax error: expected %q, got %q at position %d", lit, t.lit, t.start)
+	}
+	return t, nil
+}
+
+func (p *parser) unexpected(t lexToken) error {
+	return fmt.Errorf("syntax error: unexpected %q at position %d", t.lit, t.start)
+}
+
+func (p *parser) newNode(kind nodeKind, op string, start, end int, args ...*node) *node {
+	return &node{kind: kind, op: op, args: args, src: p.src[start:end], start: start, end: end}
+}
+
+func (p *parser) end() int {
+	return p.toks[p.pos-1].end
+}
+
+func (p *parser) parseExpr(minPower int) (*node, error) {
+	left, err := p.parsePrefix()
+	if err != nil {
+		return nil, err
+	}
+	start := left.start
+
+	for {
+		t, ok := p.peek()
+		if !ok {
+			return left, nil
+		}
+		op := t.lit
+		if t.tok == token.STRING || t.tok == token.IDENT && op != "in" && op != "IN" {
+			return left, nil
+		}
+		if op == "IN" {
+			op = "in"
+		}
+		power, ok := infixPowers[op]
+		if !ok || power <= minPower {
+			return left, nil
+		}
+		p.pos++
+
+		switch op {
+		case "?":
+			yes, err := p.parseExpr(0)
+			if err != nil {
+				return nil, err
+			}
+			if _, err := p.expect(":"); err != nil {
+				return nil, err
+			}
+			// right associative
+			no, err := p.parseExpr(power - 1)
+			if err != nil {
+				return nil, err
+			}
+			left = p.newNode(kindTernary, op, start, p.end(), left, yes, no)
+		case ".":
+			name, ok := p.next()
+			if !ok || name.tok != token.IDENT {
+				return nil, fmt.Errorf("syntax error: expected a field name after %q at position %d", ".", t.start)
+			}
+			left = p.newNode(kindField, name.lit, start, p.end(), left)
+		case "[":
+			if left, err = p.parseIndex(left, start); err != nil {
+				return nil, err
+			}
+		default:
+			if op == "*" && p.peekIs("*") {
+				p.pos++
+				op = "**"
+			}
+			right, err := p.parseExpr(power)
+			if err != nil {
+				return nil, err
+			}
+			left = p.newNode(kindBinary, op, start, p.end(), left, right)
+		}
+	}
+}
+
+// parseIndex parses x[y], x[y:z], x[:z], x[y:] and x[:], after "[".
+func (p *parser) parseIndex(x *node, start int) (*node, error) {
+	var low, high *node
+	var err error
+	if !p.peekIs(":") {
+		if low, err = p.parseExpr(0); err != nil {
+			return nil, err
+		}
+		if p.peekIs("]") {
+			p.pos++
+			return p.newNode(kindIndex, "[]", start, p.end(), x, low), nil
+		}
+	}
+	if _, err := p.expect(":"); err != nil {
+		return nil, err
+	}
+	if !p.peekIs("]") {
+		if high, err = p.parseExpr(0); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := p.expect("]"); err != nil {
+		return nil, err
+	}
+	return p.newNode(kindSlice, "[:]", start, p.end(), x, low, high), nil
+}
+
+func (p *parser) parsePrefix() (*node, error) {
+	t, ok := p.next()
+	if !ok {
+		return nil, fmt.Errorf("syntax error: unexpected end of the rule")
+	}
+
+	switch t.tok {
+	case token.INT, token.FLOAT, token.STRING:
+		return p.newNode(kindLiteral, t.lit, t.start, t.end), nil
+	case token.IDENT:
+		switch t.lit {
+		case "true", "false", "nil":
+			return p.newNode(kindLiteral, t.lit, t.start, t.end), nil
+		case "in", "IN":
+			return nil, p.unexpected(t)
+		}
+		if !p.peekIs("(") {
+			return p.newNode(kindIdent, t.lit, t.start, t.end), nil
+		}
+		p.pos++
+		args, err := p.parseList(")")
+		if err != nil {
+			return nil, err
+		}
+		return p.newNode(kindCall, t.lit, t.start, p.end(), args...), nil
+	}
+
+	switch t.lit {
+	case "(":
+		x, err := p.parseExpr(0)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		return p.newNode(kindParen, "()", t.start, p.end(), x), nil
+	case "[":
+		items, err := p.parseList("]")
+		if err != nil {
+			return nil, err
+		}
+		return p.newNode(kindArray, "[]", t.start, p.end(), items...), nil
+	case "{":
+		var pairs []*node
+		for !p.peekIs("}") {
+			if len(pairs) > 0 {
+				if _, err := p.expect(","); err != nil {
+					return nil, err
+				}
+			}
+			key, err := p.parseExpr(0)
+			if err != nil {
+				return nil, err
+			}
+			if _, err := p.expect(":"); err != nil {
+				return nil, err
+			}
+			value, err := p.parseExpr(0)
+			if err != nil {
+				return nil, err
+			}
+			pairs = append(pairs, key, value)
+		}
+		p.pos++
+		return p.newNode(kindObject, "{}", t.start, p.end(), pairs...), nil
+	case "!", "-", "~":
+		x, err := p.parseExpr(unaryPower)
+		if err != nil {
+			return nil, err
+		}
+		return p.newNode(kindUnary, t.lit, t.start, p.end(), x), nil
+	}
+
+	return nil, p.unexpected(t)
+}
+
+// parseList parses a comma separated list of expressions, up to the closing
+// token.
+func (p *parser) parseList(closing string) ([]*node, error) {
+	var items []*node
+	for !p.peekIs(closing) {
+		if len(items) > 0 {
+			if _, err := p.expect(","); err != nil {
+				return nil, err
+			}
+		}
+		item, err := p.parseExpr(0)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	if _, err := p.expect(closing); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
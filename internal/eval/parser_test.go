@@ -0,0 +1,136 @@
+package eval
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/maja42/goval"
+)
+
+func TestParse(t *testing.T) {
+	vars := map[string]interface{}{
+		"a":    float64(6),
+		"b":    float64(4),
+		"t":    true,
+		"f":    false,
+		"s":    "infra1",
+		"list": []interface{}{float64(1), float64(2), float64(3)},
+		"obj":  map[string]interface{}{"x": float64(2), "inner": map[string]interface{}{"y": "z"}},
+	}
+	// The canonical form of each rule must be evaluated by goval to the
+	// same value as the rule itself, which verifies the precedence.
+	rules := []string{
+		"a + b * 2",
+		"(a + b) * 2",
+		"a - b - 1",
+		"a / b / 2",
+		"a * * 2 + 1",
+		"a % b == 2",
+		"-a + b",
+		"-a * -b",
+		"!t || t",
+		"!t && f || t",
+		"t || f && f",
+		"a > b == t",
+		"a < -b",
+		"a<-b",
+		"a << 1 >> 2",
+		"a | b & 2 ^ 1",
+		"~a & 7",
+		"t ? a : b",
+		"f ? a : t ? b : 1",
+		"a > b ? a - b : b - a",
+		"2 in list",
+		"!(2 in list)",
+		"(a - 5) in list",
+		"!t in []",
+		"list[1] + list[2]",
+		"list[1:]",
+		"list[:2]",
+		"list[:]",
+		"obj.x * 2 == 4 || f",
+		`obj["x"] > 1`,
+		`obj.inner.y == "z" && s != "infra3"`,
+		`{"k": a, "v": [1, 2]}.v[0]`,
+		`semver("3.6.1") > 30600`,
+		"0x10 + 1.5e1 + 1_000",
+		"nil == nil",
+		"a > b // comment",
+		"a >\n b",
+	}
+	for _, rule := range rules {
+		t.Run(rule, func(t *testing.T) {
+			n, err := parse(rule)
+			if err != nil {
+				t.Fatalf("Failed to parse: %v", err)
+			}
+			expected, err := goval.NewEvaluator().Evaluate(rule, vars, functions())
+			if err != nil {
+				t.Fatalf("Failed to evaluate: %v", err)
+			}
+			got, err := goval.NewEvaluator().Evaluate(n.String(), vars, functions())
+			if err != nil {
+				t.Fatalf("Failed to evaluate %q: %v", n.String(), err)
+			}
+			if !reflect.DeepEqual(expected, got) {
+				t.Fatalf("Unexpected value of %q, expected %v, got %v", n.String(), expected, got)
+			}
+		})
+	}
+}
+
+func TestParse_Error(t *testing.T) {
+	rules := []string{
+		"",
+		"a +",
+		"(a",
+		"a b",
+		"a ? b",
+		"list[",
+		"obj.",
+		"a $ b",
+		"a &^ b",
+		`"unterminated`,
+		"200Mib",
+	}
+	for _, rule := range rules {
+		t.Run(rule, func(t *testing.T) {
+			if _, err := parse(rule); err == nil {
+				t.Fatalf("Expected an error")
+			}
+		})
+	}
+}
+
+func TestRewrite(t *testing.T) {
+	testCases := []struct {
+		rule     string
+		expected string
+	}{
+		{rule: "dbSizeFree > 200MiB", expected: "dbSizeFree > 209715200"},
+		{rule: "dbSize < 1.5GiB && dbSize > 2KB", expected: "dbSize < 1610612736 && dbSize > 2000"},
+		{rule: "dbSize > 0.5B", expected: "dbSize > 0.5"},
+		{rule: "dbQuotaUsage > 80%", expected: "dbQuotaUsage > 0.8"},
+		{rule: "dbQuotaUsage > 12.5% || (dbQuotaUsage < 1%)", expected: "dbQuotaUsage > 0.125 || (dbQuotaUsage < 0.01)"},
+		{rule: "dbSize > 80% * dbQuota", expected: "dbSize > 0.8 * dbQuota"},
+		{rule: "max(10%, 20%) > 0", expected: "max(0.1, 0.2) > 0"},
+		{rule: "dbSize %2 == 1", expected: "dbSize %2 == 1"},
+		{rule: "10%dbSize == 1", expected: "10%dbSize == 1"},
+		{rule: "10 % (dbSize) == 1", expected: "10 % (dbSize) == 1"},
+		{rule: "dbQuotaUsage > 80% - 10%", expected: "dbQuotaUsage > 0.8 - 0.1"},
+		{rule: "dbQuotaUsage > 80% -10%", expected: "dbQuotaUsage > 0.8 -0.1"},
+		{rule: "10 % -3 == 1", expected: "10 % -3 == 1"},
+		{rule: `memberName == "80%"`, expected: `memberName == "80%"`},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.rule, func(t *testing.T) {
+			got, err := rewrite(tc.rule)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if got != tc.expected {
+				t.Fatalf("Unexpected rule, expected %q, got %q", tc.expected, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,81 @@
+package logging
+
+import (
+	"fmt"
+
+	"go.etcd.io/etcd/client/pkg/v3/logutil"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+
+	DefaultLevel       = "info"
+	DefaultClientLevel = "error"
+)
+
+// New creates a logger writing to stderr with the given level (debug, info,
+// warn or error) and format (text or json).
+func New(level, format string) (*zap.Logger, error) {
+	lvl, err := zapcore.ParseLevel(level)
+	if err != nil {
+		return nil, fmt.Errorf("invalid log level %q: %w", level, err)
+	}
+
+	// Based on etcd's default configuration, so that the etcd client logs
+	// and etcd-defrag's own logs look alike.
+	lcfg := logutil.DefaultZapLoggerConfig
+	lcfg.Level = zap.NewAtomicLevelAt(lvl)
+	// Never drop log lines of a defragmentation run.
+	lcfg.Sampling = nil
+	lcfg.DisableCaller = true
+	lcfg.DisableStacktrace = true
+
+	switch format {
+	case FormatText:
+		lcfg.Encoding = "console"
+	case FormatJSON:
+		lcfg.Encoding = "json"
+	default:
+		return nil, fmt.Errorf("invalid log format %q, only %s and %s are supported", format, FormatText, FormatJSON)
+	}
+
+	return lcfg.Build()
+}
+
+// Endpoint returns the field identifying the etcd endpoint a log entry is about.
+func Endpoint(ep string) zap.Field {
+	return zap.String("endpoint", ep)
+}
+
+// MemberID returns the field identifying the etcd member a log entry is about,
+// in the same hex format used by etcdctl.
+func MemberID(id uint64) zap.Field {
+	return zap.String("memberID", fmt.Sprintf("%x", id))
+}
+
+// Phase returns the field identifying the step of the defragmentation workflow.
+func Phase(phase string) zap.Field {
+	return zap.String("phase", phase)
+}
+
+// RuleName returns the field identifying the named rule from the rules file
+// a log entry is about. It's omitted for the rule set by --defrag-rule, which
+// has no name.
+func RuleName(name string) zap.Field {
+	if name == "" {
+		return zap.Skip()
+	}
+	return zap.String("ruleName", name)
+}
+
+// MemberName returns the field naming the etcd member a log entry is about.
+// It's omitted if the name is unknown.
+func MemberName(name string) zap.Field {
+	if name == "" {
+		return zap.Skip()
+	}
+	return zap.String("memberName", name)
+}
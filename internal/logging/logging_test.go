@@ -0,0 +1,56 @@
+package logging
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zapcore"
+)
+
+func TestNew(t *testing.T) {
+	testCases := []struct {
+		name        string
+		level       string
+		format      string
+		expectError bool
+	}{
+		{
+			name:   "default text logger",
+			level:  DefaultLevel,
+			format: FormatText,
+		},
+		{
+			name:   "json logger",
+			level:  "debug",
+			format: FormatJSON,
+		},
+		{
+			name:        "invalid level",
+			level:       "verbose",
+			format:      FormatText,
+			expectError: true,
+		},
+		{
+			name:        "invalid format",
+			level:       DefaultLevel,
+			format:      "logfmt",
+			expectError: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			lg, err := New(tc.level, tc.format)
+			if tc.expectError {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+
+			lvl, err := zapcore.ParseLevel(tc.level)
+			require.NoError(t, err)
+			require.True(t, lg.Core().Enabled(lvl))
+			require.False(t, lg.Core().Enabled(lvl-1))
+		})
+	}
+}
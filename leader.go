@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.uber.org/zap"
+
+	"github.com/ahrtr/etcd-defrag/internal/config"
+	"github.com/ahrtr/etcd-defrag/internal/logging"
+)
+
+// leaderPollInterval is how often the status of the transferee is polled
+// until it confirms the new leadership.
+var leaderPollInterval = 100 * time.Millisecond
+
+// transferee is a member the leadership may be transferred to.
+type transferee struct {
+	member member
+	// lag is the number of entries its applied index lags behind the raft
+	// index of the leader.
+	lag uint64
+}
+
+// transferees returns the healthy voting members of the member list other
+// than the leader, by ascending raft lag. Learners can't be leaders, and an
+// unhealthy member or one far behind would delay or fail the election.
+func transferees(ctx context.Context, gcfg config.GlobalConfig, leader member, list []*etcdserverpb.Member) ([]transferee, error) {
+	voters, err := membersFromCluster(gcfg, list)
+	if err != nil {
+		return nil, err
+	}
+	leaderStatus, err := memberStatus(ctx, gcfg, leader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the status of the leader: %w", err)
+	}
+
+	var (
+		mu         sync.Mutex
+		wg         sync.WaitGroup
+		candidates []transferee
+	)
+	for _, m := range voters {
+		if m.ID == leader.ID {
+			continue
+		}
+		wg.Add(1)
+		go func(m member) {
+			defer wg.Done()
+			status, err := memberStatus(ctx, gcfg, m)
+			if err != nil {
+				lg.Warn("Excluding the member from the leader transfer, failed to get its status", append(m.fields(), logging.Phase(phaseMoveLeader), zap.Error(err))...)
+				return
+			}
+			if status.Resp.IsLearner {
+				return
+			}
+			if eh := endpointHealth(ctx, gcfg, status.Ep); !eh.Health {
+				lg.Warn("Excluding the member from the leader transfer, it's unhealthy", append(m.fields(), logging.Phase(phaseMoveLeader), zap.String("error", eh.Error))...)
+				return
+			}
+			t := transferee{member: m}
+			if status.Resp.RaftAppliedIndex < leaderStatus.Resp.RaftIndex {
+				t.lag = leaderStatus.Resp.RaftIndex - status.Resp.RaftAppliedIndex
+			}
+			mu.Lock()
+			candidates = append(candidates, t)
+			mu.Unlock()
+		}(m)
+	}
+	wg.Wait()
+
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].lag != candidates[j].lag {
+			return candidates[i].lag < candidates[j].lag
+		}
+		return candidates[i].member.ID < candidates[j].member.ID
+	})
+	return candidates, nil
+}
+
+// pickTransferee returns the candidate matching --move-leader-to, by name or
+// hex ID, if set. Otherwise it returns the one with the smallest lag.
+func pickTransferee(gcfg config.GlobalConfig, candidates []transferee) (transferee, error) {
+	if gcfg.MoveLeaderTo == "" {
+		if len(candidates) == 0 {
+			return transferee{}, errors.New("couldn't find a healthy voting member to transfer the leadership to")
+		}
+		return candidates[0], nil
+	}
+
+	id, idErr := strconv.ParseUint(gcfg.MoveLeaderTo, 16, 64)
+	for _, c := range candidates {
+		if c.member.Name == gcfg.MoveLeaderTo || (idErr == nil && c.member.ID == id) {
+			return c, nil
+		}
+	}
+	return transferee{}, fmt.Errorf("--move-leader-to %q isn't a healthy voting member other than the leader", gcfg.MoveLeaderTo)
+}
+
+// waitForLeader polls the status of the transferee until it reports itself
+// as the leader, for at most --command-timeout.
+func waitForLeader(ctx context.Context, gcfg config.GlobalConfig, t member) error {
+	deadline := time.Now().Add(gcfg.CommandTimeout)
+	for {
+		status, err := memberStatus(ctx, gcfg, t)
+		if err == nil && status.Resp.Leader == t.ID {
+			return nil
+		}
+		if err == nil {
+			err = fmt.Errorf("the leader is %x", status.Resp.Leader)
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("member %s didn't become the leader within %v: %w", t, gcfg.CommandTimeout, err)
+		}
+		if !sleepCtx(ctx, leaderPollInterval) {
+			return ctx.Err()
+		}
+	}
+}
+
+// restoreLeadership transfers the leadership back to the original leader,
+// from whichever member is leading now, and waits until it's confirmed.
+func restoreLeadership(ctx context.Context, gcfg config.GlobalConfig, original member, members []member) error {
+	status, err := memberStatus(ctx, gcfg, original)
+	if err != nil {
+		return fmt.Errorf("failed to get the status of the original leader: %w", err)
+	}
+	switch status.Resp.Leader {
+	case original.ID:
+		lg.Info("The original leader is already the leader", append(original.fields(), logging.Phase(phaseMoveLeader))...)
+		return nil
+	case 0:
+		return fmt.Errorf("member %s has no leader", original)
+	}
+	leader, err := memberByID(ctx, gcfg, members, status.Resp.Leader)
+	if err != nil {
+		return err
+	}
+
+	lg.Info("Restoring the leadership", logging.Phase(phaseMoveLeader), zap.Stringer("from", leader), zap.Stringer("to", original))
+	if err := transferLeadership(ctx, gcfg, leader, original.ID); err != nil {
+		return err
+	}
+	if err := waitForLeader(ctx, gcfg, original); err != nil {
+		return err
+	}
+	lg.Info("The leadership is restored", logging.Phase(phaseMoveLeader), zap.Stringer("leader", original))
+	return nil
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/ahrtr/etcd-defrag/internal/config"
+)
+
+// fakeLearnerClient adds the learner etcd-4 to the cluster of
+// fakeClusterClient.
+type fakeLearnerClient struct {
+	*fakeClusterClient
+}
+
+func (f *fakeLearnerClient) MemberList(ctx context.Context, opts ...clientv3.OpOption) (*clientv3.MemberListResponse, error) {
+	resp, _ := f.fakeClusterClient.MemberList(ctx, opts...)
+	resp.Members = append([]*etcdserverpb.Member{{ID: 4, Name: "etcd-4", ClientURLs: []string{"ep4"}, IsLearner: true}}, resp.Members...)
+	return resp, nil
+}
+
+func TestMoveLeader(t *testing.T) {
+	oldCreateClient, oldInterval := createClient, leaderPollInterval
+	leaderPollInterval = time.Millisecond
+	t.Cleanup(func() {
+		createClient, leaderPollInterval = oldCreateClient, oldInterval
+	})
+
+	testCases := []struct {
+		name           string
+		moveLeaderTo   string
+		applied        map[string]uint64
+		unhealthy      string
+		ignoreTransfer bool
+		expectedLeader uint64
+		expectedErr    string
+	}{
+		{
+			name:           "smallest lag",
+			applied:        map[string]uint64{"ep1": 4000, "ep2": 4900, "ep4": 5000},
+			expectedLeader: 2,
+		},
+		{
+			name:           "unhealthy member excluded",
+			applied:        map[string]uint64{"ep1": 4000, "ep2": 4900},
+			unhealthy:      "ep2",
+			expectedLeader: 1,
+		},
+		{
+			name:           "override by name",
+			moveLeaderTo:   "etcd-1",
+			applied:        map[string]uint64{"ep1": 4000, "ep2": 4900},
+			expectedLeader: 1,
+		},
+		{
+			name:           "override by ID",
+			moveLeaderTo:   "1",
+			applied:        map[string]uint64{"ep1": 4000, "ep2": 4900},
+			expectedLeader: 1,
+		},
+		{
+			name:         "override with a learner",
+			moveLeaderTo: "etcd-4",
+			expectedErr:  `--move-leader-to "etcd-4" isn't a healthy voting member other than the leader`,
+		},
+		{
+			name:           "new leader not confirmed",
+			ignoreTransfer: true,
+			expectedLeader: 3,
+			expectedErr:    "didn't become the leader",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var (
+				mu     sync.Mutex
+				leader uint64 = 3
+			)
+			onStatus := func(ep string, resp *clientv3.StatusResponse) error {
+				mu.Lock()
+				defer mu.Unlock()
+				if ep == tc.unhealthy {
+					return status.Error(codes.Unavailable, "connection refused")
+				}
+				resp.Leader = leader
+				resp.RaftIndex = 5000
+				resp.RaftAppliedIndex = tc.applied[ep]
+				return nil
+			}
+			onMoveLeader := func(transfereeID uint64) error {
+				mu.Lock()
+				defer mu.Unlock()
+				if transfereeID == 4 {
+					return errors.New("learner can not be the leader")
+				}
+				if !tc.ignoreTransfer {
+					leader = transfereeID
+				}
+				return nil
+			}
+			createClient = func(cfgSpec *clientv3.ConfigSpec) (EtcdCluster, error) {
+				return &fakeLearnerClient{&fakeClusterClient{onStatus: onStatus, onMoveLeader: onMoveLeader}}, nil
+			}
+
+			gcfg := config.GlobalConfig{
+				Endpoints:      []string{"ep3"},
+				CommandTimeout: 50 * time.Millisecond,
+				MoveLeader:     true,
+				MoveLeaderTo:   tc.moveLeaderTo,
+			}
+			_, err := moveLeader(context.Background(), gcfg, member{ID: 3, Name: "etcd-3", URLs: []string{"ep3"}})
+			if tc.expectedErr != "" {
+				require.ErrorContains(t, err, tc.expectedErr)
+			} else {
+				require.NoError(t, err)
+			}
+			if tc.expectedLeader != 0 {
+				require.Equal(t, tc.expectedLeader, leader)
+			}
+		})
+	}
+}
+
+func TestRunDefrag_RestoreLeader(t *testing.T) {
+	oldCreateClient, oldInterval := createClient, leaderPollInterval
+	leaderPollInterval = time.Millisecond
+	t.Cleanup(func() {
+		createClient, leaderPollInterval = oldCreateClient, oldInterval
+	})
+
+	testCases := []struct {
+		name             string
+		failRestore      bool
+		expectedLeader   uint64
+		expectedRestored bool
+	}{
+		{
+			name:             "restored",
+			expectedLeader:   3,
+			expectedRestored: true,
+		},
+		{
+			name:             "restore failed",
+			failRestore:      true,
+			expectedLeader:   1,
+			expectedRestored: false,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var (
+				mu     sync.Mutex
+				leader uint64 = 3
+			)
+			onStatus := func(ep string, resp *clientv3.StatusResponse) error {
+				mu.Lock()
+				defer mu.Unlock()
+				resp.Leader = leader
+				return nil
+			}
+			onMoveLeader := func(transfereeID uint64) error {
+				mu.Lock()
+				defer mu.Unlock()
+				if tc.failRestore && transfereeID == 3 {
+					return errors.New("leadership transfer timed out")
+				}
+				leader = transfereeID
+				return nil
+			}
+			onDefrag := func(ctx context.Context, ep string) error {
+				return nil
+			}
+			createClient = func(cfgSpec *clientv3.ConfigSpec) (EtcdCluster, error) {
+				return &fakeClusterClient{onDefrag: onDefrag, onStatus: onStatus, onMoveLeader: onMoveLeader}, nil
+			}
+
+			reportFile := filepath.Join(t.TempDir(), "report.json")
+			gcfg := config.GlobalConfig{
+				Endpoints:             []string{"ep1"},
+				Cluster:               true,
+				CommandTimeout:        time.Minute,
+				MoveLeader:            true,
+				RestoreLeader:         true,
+				EtcdStorageQuotaBytes: 2 * 1024 * 1024 * 1024,
+				ReportFile:            reportFile,
+				ReportFormat:          "json",
+			}
+			err := runDefrag(context.Background(), gcfg)
+			if tc.failRestore {
+				require.ErrorContains(t, err, "1 (total 3) member(s) failed to be defragmented")
+			} else {
+				require.NoError(t, err)
+			}
+			require.Equal(t, tc.expectedLeader, leader)
+
+			report := readReport(t, reportFile)
+			require.Len(t, report.Endpoints, 3)
+			require.Nil(t, report.Endpoints[0].LeaderRestored)
+			leaderReport := report.Endpoints[2]
+			require.Equal(t, "etcd-3", leaderReport.MemberName)
+			require.Equal(t, actionDefragmented, leaderReport.Action)
+			require.NotNil(t, leaderReport.LeaderRestored)
+			require.Equal(t, tc.expectedRestored, *leaderReport.LeaderRestored)
+		})
+	}
+}
@@ -1,22 +1,43 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"log"
 	"os"
 	"runtime"
 	"time"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
+	"go.uber.org/zap"
 
 	"github.com/ahrtr/etcd-defrag/internal/config"
-	"github.com/ahrtr/etcd-defrag/internal/eval"
+	"github.com/ahrtr/etcd-defrag/internal/logging"
 	"github.com/ahrtr/etcd-defrag/pkg/version"
 )
 
 var (
 	globalCfg = config.GlobalConfig{}
+
+	// lg is etcd-defrag's own logger, and clientLg is passed to the etcd
+	// clients. Both are replaced according to the --log-* flags before
+	// running the command.
+	lg       = zap.Must(logging.New(logging.DefaultLevel, logging.FormatText))
+	clientLg = zap.Must(logging.New(logging.DefaultClientLevel, logging.FormatText)).Named("etcd-client")
+)
+
+// Values of the "phase" log field.
+const (
+	phaseValidation   = "validation"
+	phaseHealthCheck  = "healthCheck"
+	phaseStatus       = "status"
+	phaseCompaction   = "compaction"
+	phaseDefrag       = "defrag"
+	phaseMoveLeader   = "moveLeader"
+	phaseCatchUp      = "catchUp"
+	phaseAutoDisalarm = "autoDisalarm"
+	phaseDaemon       = "daemon"
 )
 
 func newDefragCommand() *cobra.Command {
@@ -24,6 +45,9 @@ func newDefragCommand() *cobra.Command {
 		Use:   "etcd-defrag",
 		Short: "A simple command line tool for etcd defragmentation",
 		PreRunE: func(cmd *cobra.Command, args []string) error {
+			if err := config.LoadConfigFile(cmd, globalCfg.ConfigFile); err != nil {
+				return err
+			}
 			return viper.BindPFlags(cmd.Flags())
 		},
 		Run: defragCommandFunc,
@@ -31,6 +55,8 @@ func newDefragCommand() *cobra.Command {
 
 	config.SetupViper()
 	config.RegisterFlags(defragCmd, &globalCfg)
+	defragCmd.AddCommand(newRuleCommand())
+	defragCmd.CompletionOptions.DisableDefaultCmd = true
 
 	return defragCmd
 }
@@ -39,7 +65,7 @@ func main() {
 	defragCmd := newDefragCommand()
 	if err := defragCmd.Execute(); err != nil {
 		if defragCmd.SilenceErrors {
-			log.Println("Error:", err)
+			lg.Error("Error", zap.Error(err))
 			os.Exit(1)
 		} else {
 			os.Exit(1)
@@ -60,231 +86,520 @@ func printVersion(printVersion bool) {
 func defragCommandFunc(cmd *cobra.Command, args []string) {
 	printVersion(globalCfg.PrintVersion)
 
+	if err := setupLoggers(globalCfg); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to set up the loggers: %v\n", err)
+		os.Exit(1)
+	}
+	defer func() {
+		_ = lg.Sync()
+	}()
+
 	if globalCfg.DryRun {
-		log.Println("Using dry run mode, will not perform defragmentation")
+		lg.Info("Using dry run mode, will not perform defragmentation")
 	}
 
-	log.Println("Validating configuration.")
-	if err := globalCfg.Validate(cmd); err != nil {
-		log.Printf("Validating configuration failed: %v\n", err)
+	if err := validateConfig(cmd, globalCfg); err != nil {
+		lg.Error("Validating configuration failed", logging.Phase(phaseValidation), zap.Error(err))
 		os.Exit(1)
 	}
 
-	if len(globalCfg.DefragRule) > 0 {
-		log.Printf("Validating the defragmentation rule: %v ... ", globalCfg.DefragRule)
+	if globalCfg.MetricsAddr != "" {
+		if err := serveMetrics(globalCfg.MetricsAddr); err != nil {
+			lg.Error("Failed to serve metrics", zap.Error(err))
+			_ = lg.Sync()
+			os.Exit(1)
+		}
+	}
+
+	ctx, stop := signalContext()
+	defer stop()
+
+	pauser = newPauseController(globalCfg.PauseFile)
+	defer pauser.close()
 
-		if err := eval.ValidateRule(globalCfg.DefragRule); err != nil {
-			log.Println("invalid")
-			log.Printf("Validating configuration failed: invalid rule %q, error: %v\n", globalCfg.DefragRule, err)
+	if globalCfg.Interval > 0 {
+		if err := runDaemon(ctx, globalCfg, runDefrag); err != nil {
+			if errors.Is(err, errInterrupted) {
+				lg.Warn("Daemon stopped, the cycle in progress was interrupted", logging.Phase(phaseDaemon), zap.Error(err))
+				_ = lg.Sync()
+				os.Exit(exitCodeInterrupted)
+			}
+			lg.Error("Daemon exited", logging.Phase(phaseDaemon), zap.Error(err))
+			_ = lg.Sync()
 			os.Exit(1)
 		}
-		log.Println("valid")
-	} else {
-		log.Println("No defragmentation rule provided")
+		// Stopped between cycles, nothing was interrupted.
+		lg.Info("Daemon stopped", logging.Phase(phaseDaemon), zap.Error(context.Cause(ctx)))
+		return
 	}
 
-	log.Println("Performing health check.")
-	if !healthCheck(globalCfg) {
+	if err := runDefrag(ctx, globalCfg); err != nil {
+		lg.Error("The defragmentation failed", zap.Error(err))
+		_ = lg.Sync()
+		if errors.Is(err, errInterrupted) {
+			os.Exit(exitCodeInterrupted)
+		}
 		os.Exit(1)
 	}
+}
 
-	log.Println("Getting members status")
-	statusList, err := getMembersStatus(globalCfg)
+// setupLoggers replaces the default loggers according to the --log-* flags.
+func setupLoggers(gcfg config.GlobalConfig) error {
+	newLg, err := logging.New(gcfg.LogLevel, gcfg.LogFormat)
 	if err != nil {
-		log.Printf("Failed to get members status: %v\n", err)
-		os.Exit(1)
+		return err
+	}
+	newClientLg, err := logging.New(gcfg.ClientLogLevel, gcfg.LogFormat)
+	if err != nil {
+		return fmt.Errorf("invalid --client-log-level: %w", err)
+	}
+
+	lg = newLg
+	clientLg = newClientLg.Named("etcd-client")
+	return nil
+}
+
+func validateConfig(cmd *cobra.Command, gcfg config.GlobalConfig) error {
+	lg.Info("Validating configuration", logging.Phase(phaseValidation))
+	if err := gcfg.Validate(cmd); err != nil {
+		return err
 	}
 
-	eps, err := endpointsWithLeaderAtEnd(globalCfg, statusList)
+	switch {
+	case len(gcfg.RulesFile) > 0:
+		rules, err := loadRules(gcfg)
+		if err != nil {
+			return err
+		}
+		lg.Info("The rules file is valid", logging.Phase(phaseValidation), zap.String("path", gcfg.RulesFile), zap.Int("rules", len(rules)), zap.String("language", gcfg.RuleLanguage))
+	case len(gcfg.DefragRule) > 0:
+		if err := validateRule(gcfg, "", gcfg.DefragRule); err != nil {
+			return err
+		}
+		lg.Info("The defragmentation rule is valid", logging.Phase(phaseValidation), zap.String("rule", gcfg.DefragRule), zap.String("scope", gcfg.RuleScope), zap.String("language", gcfg.RuleLanguage))
+	default:
+		lg.Info("No defragmentation rule provided", logging.Phase(phaseValidation))
+	}
+
+	if len(gcfg.DefragScore) > 0 {
+		if err := validateScore(gcfg); err != nil {
+			return err
+		}
+		lg.Info("The defragmentation score is valid", logging.Phase(phaseValidation), zap.String("score", gcfg.DefragScore), zap.Int("maxMembersPerRun", gcfg.MaxMembersPerRun))
+	}
+
+	return nil
+}
+
+// runDefrag performs one complete defragmentation cycle, including the
+// health check, the rule evaluation, the compaction and the defragmentation
+// of each endpoint. It returns an error instead of exiting, so that it can
+// be called repeatedly in daemon mode.
+//
+// Once the context is done, no new defragmentation is started, and the
+// running ones are abandoned, except the leader transfer which is completed.
+// The error then wraps errInterrupted, and the report covers the members
+// processed so far.
+func runDefrag(ctx context.Context, gcfg config.GlobalConfig) (err error) {
+	report := newRunReport(gcfg)
+	defer func() {
+		err = interruptedError(ctx, err)
+		recordRunResult(err)
+		report.finish(err)
+		if report.Interrupted {
+			lg.Warn("The defragmentation was interrupted", zap.Any("members", report.actionCounts()), zap.Int64("bytesReclaimed", report.BytesReclaimed))
+		}
+		if gcfg.ReportFile != "" {
+			if werr := writeReport(report, gcfg.ReportFile, gcfg.ReportFormat); werr != nil {
+				lg.Error("Failed to write the report", zap.String("path", gcfg.ReportFile), zap.Error(werr))
+			}
+		}
+	}()
+
+	// The clients are reused by all the steps of the run.
+	defer startClientPool()()
+
+	lg.Info("Performing health check", logging.Phase(phaseHealthCheck))
+	healthInfos, healthy := healthCheck(ctx, gcfg)
+	report.HealthCheck = healthInfos
+	if !healthy {
+		return errors.New("health check failed")
+	}
+
+	members, err := getMembers(ctx, gcfg)
 	if err != nil {
-		log.Printf("Failed to get endpoints: %v\n", err)
-		os.Exit(1)
+		return fmt.Errorf("failed to get members: %w", err)
+	}
+
+	lg.Info("Getting members status", logging.Phase(phaseStatus))
+	statusList, err := getMembersStatus(ctx, gcfg, members)
+	if err != nil {
+		return fmt.Errorf("failed to get members status: %w", err)
+	}
+	members = membersWithLeaderAtEnd(statusList)
+
+	rules, err := loadRules(gcfg)
+	if err != nil {
+		return err
+	}
+
+	var info clusterInfo
+	if len(gcfg.DefragRule) > 0 || len(rules) > 0 || len(gcfg.DefragScore) > 0 {
+		if info, err = getClusterInfo(ctx, gcfg, statusList, healthInfos); err != nil {
+			return err
+		}
+	}
+
+	members, scores, err := sortMembersByScore(gcfg, members, statusList, rules, info)
+	if err != nil {
+		return err
+	}
+	if scores != nil {
+		memberScores := map[string]float64{}
+		for _, m := range members {
+			memberScores[m.String()] = scores[m.ID]
+		}
+		lg.Info("Members sorted by the defragmentation score", logging.Phase(phaseDefrag), zap.Stringers("members", members), zap.Any("scores", memberScores))
 	}
 
-	if globalCfg.Compaction && !globalCfg.DryRun {
-		log.Printf("Running compaction until revision: %d ... ", statusList[0].Resp.Header.Revision)
-		if err := compact(globalCfg, statusList[0].Resp.Header.Revision, eps[0]); err != nil {
-			log.Printf("failed, %v\n", err)
+	// In cluster scope, the rule is evaluated only once, and the result
+	// applies to all endpoints.
+	var clusterResult *bool
+	if len(gcfg.DefragRule) > 0 && gcfg.RuleScope == config.RuleScopeCluster {
+		ret, err := evaluateClusterRule(gcfg, statusList, info)
+		if err != nil {
+			return fmt.Errorf("failed to evaluate the rule in cluster scope: %w", err)
+		}
+		lg.Info("Cluster evaluation result", logging.Phase(phaseDefrag), zap.Bool("result", ret))
+		clusterResult = &ret
+	}
+
+	// The members over --max-members-per-run are the ones with the lowest
+	// score, which may be followers even if the leader goes last.
+	selected := selectMembersPerRun(gcfg, members, statusList, scores, rules, info, clusterResult)
+	if selected != nil {
+		var selectedMembers []member
+		for _, m := range members {
+			if selected[m.ID] {
+				selectedMembers = append(selectedMembers, m)
+			}
+		}
+		lg.Info("Members selected by --max-members-per-run", logging.Phase(phaseDefrag), zap.Int("maxMembersPerRun", gcfg.MaxMembersPerRun), zap.Stringers("members", selectedMembers))
+	}
+
+	if gcfg.Compaction && !gcfg.DryRun {
+		rev := statusList[0].Resp.Header.Revision
+		lg.Info("Running compaction", append(members[0].fields(), logging.Phase(phaseCompaction), zap.Int64("revision", rev))...)
+		startTS := time.Now()
+		_, err := compact(ctx, gcfg, rev, members[0])
+		d := time.Since(startTS)
+		compactionDurationHistogram.Observe(d.Seconds())
+		report.Compaction = &compactionReport{Revision: rev, Duration: d.String()}
+		if err != nil {
+			report.Compaction.Error = err.Error()
+			lg.Warn("Compaction failed", logging.Phase(phaseCompaction), zap.Int64("revision", rev), zap.Duration("took", d), zap.Error(err))
 		} else {
-			log.Println("successful")
+			lg.Info("Compaction succeeded", logging.Phase(phaseCompaction), zap.Int64("revision", rev), zap.Duration("took", d))
 		}
 	} else {
-		log.Println("Skip compaction.")
+		lg.Info("Skip compaction", logging.Phase(phaseCompaction))
 	}
 
-	log.Printf("%d endpoint(s) need to be defragmented: %v\n", len(eps), eps)
-	failures := 0
-	for index, ep := range eps {
-		log.Print("[Before defragmentation] ")
-		status, err := getMemberStatus(globalCfg, ep)
+	lg.Info("Members need to be defragmented", logging.Phase(phaseDefrag), zap.Int("count", len(members)), zap.Stringers("members", members))
+	limit, err := concurrencyLimit(ctx, gcfg)
+	if err != nil {
+		return err
+	}
+	zones, err := config.ParseMemberZones(gcfg.MemberZones)
+	if err != nil {
+		return err
+	}
+	if limit > 1 {
+		lg.Info("Defragmenting followers concurrently", logging.Phase(phaseDefrag), zap.Int("limit", limit), zap.Strings("memberZones", gcfg.MemberZones))
+	}
+	sched := newDefragScheduler(gcfg, newDefragSlots(limit, zones), report, members)
+	for index, m := range members {
+		// Pausing keeps the plan, the member is processed on resume.
+		pauser.wait(ctx, m)
+		if ctx.Err() != nil {
+			sched.halt(nil)
+			break
+		}
+		epReport := report.addEndpoint(m)
+		if score, ok := scores[m.ID]; ok {
+			epReport.Score = &score
+		}
+		status, err := getMemberStatus(ctx, gcfg, m, "Before defragmentation")
+		if err != nil && ctx.Err() != nil {
+			sched.notStarted(epReport)
+			break
+		}
 		if err != nil {
-			failures++
-			log.Printf("Failed to get member (%q) status, error: %v\n", ep, err)
-			if !globalCfg.ContinueOnError {
+			lg.Error("Failed to get member status", append(m.fields(), logging.Phase(phaseStatus), zap.Error(err))...)
+			if !sched.fail(epReport, err) {
 				break
 			}
 			continue
 		}
 
-		evalRet, err := eval.Evaluate(globalCfg.DefragRule, globalCfg.EtcdStorageQuotaBytes, status.Resp.DbSize, status.Resp.DbSizeInUse)
+		// ep is the URL of the member which works, used in the metrics.
+		ep := status.Ep
+		epReport.Endpoint = ep
+		epReport.Before = &status
+		rule, ok := memberRule(gcfg, rules, status, info)
+		if !ok {
+			lg.Info("No rule in the rules file matches the member, so skipping it", append(m.fields(), logging.Phase(phaseDefrag), logging.Endpoint(ep))...)
+			epReport.Action = actionSkipped
+			recordDefragSkipped(ep)
+			continue
+		}
+		epReport.RuleName = rule.Name
+		rcfg := withRule(gcfg, rule)
+
+		evalRet, err := memberRuleResult(rcfg, status, info, clusterResult)
+		recordRuleEvaluation(ep, evalRet, err)
 		if !evalRet || err != nil {
 			if err != nil {
-				failures++
-				log.Printf("Evaluation failed, endpoint: %s, error:%v\n", ep, err)
-				if !globalCfg.ContinueOnError {
+				lg.Error("Evaluation failed", append(m.fields(), logging.Phase(phaseDefrag), logging.Endpoint(ep), logging.RuleName(rule.Name), zap.Error(err))...)
+				if !sched.fail(epReport, err) {
 					break
 				}
 				continue
 			}
-			log.Printf("Evaluation result is false, so skipping endpoint: %s\n", ep)
+			lg.Info("Evaluation result is false, so skipping member", append(m.fields(), logging.Phase(phaseDefrag), logging.Endpoint(ep), logging.RuleName(rule.Name), zap.Strings("decidedBy", decidingVariables(rcfg, status, info, clusterResult)))...)
+			epReport.RuleResult = &evalRet
+			epReport.Action = actionSkipped
+			recordDefragSkipped(ep)
 			continue
 		}
 
-		if globalCfg.DryRun {
-			log.Printf("[Dry run] skip defragmenting endpoint %q\n", ep)
+		epReport.RuleResult = &evalRet
+
+		if selected != nil && !selected[m.ID] {
+			lg.Info("Not selected by --max-members-per-run, so skipping member", append(m.fields(), logging.Phase(phaseDefrag), logging.Endpoint(ep), zap.Int("maxMembersPerRun", gcfg.MaxMembersPerRun))...)
+			epReport.Action = actionSkipped
+			recordDefragSkipped(ep)
 			continue
 		}
 
-		// Check if the member is a leader and move the leader if necessary
-		if globalCfg.MoveLeader {
-			if status.Resp.Leader == status.Resp.Header.MemberId {
-				log.Println("Transferring the leadership from the current leader")
-				if err = moveLeader(globalCfg, status.Resp.Leader, ep); err != nil {
-					log.Printf("Failed to transfer the leadership from %x to a follower, error: %v\n", status.Resp.Leader, err)
-					if !globalCfg.ContinueOnError {
-						break
-					}
-					continue
-				}
-				if globalCfg.WaitBetweenDefrags > 0 {
-					log.Printf("Transferred the leadership successfully! Waiting for %s for next operation\n", globalCfg.WaitBetweenDefrags.String())
-					time.Sleep(globalCfg.WaitBetweenDefrags)
-				}
-			}
+		if gcfg.DryRun {
+			lg.Info("[Dry run] skip defragmenting member", append(m.fields(), logging.Phase(phaseDefrag), logging.Endpoint(ep))...)
+			epReport.Action = actionDryRun
+			recordDefragSkipped(ep)
+			continue
 		}
 
-		log.Printf("Defragmenting endpoint %q\n", ep)
-		startTS := time.Now()
-		err = defragment(globalCfg, ep)
-		d := time.Since(startTS)
+		// Followers may be defragmented along with others, but the leader
+		// is always defragmented alone. The leadership may move while
+		// waiting for the others, e.g. to this member, so the status is
+		// fetched again after each wait.
+		alone := status.Resp.Leader == status.Resp.Header.MemberId
+		for !sched.slots.free(m, alone) {
+			if !sched.wait(m, alone, epReport) {
+				break
+			}
+			if status, err = getMemberStatus(ctx, gcfg, m, "Before defragmentation"); err != nil {
+				break
+			}
+			ep = status.Ep
+			epReport.Endpoint = ep
+			epReport.Before = &status
+			alone = status.Resp.Leader == status.Resp.Header.MemberId
+		}
+		if err != nil && ctx.Err() != nil {
+			sched.notStarted(epReport)
+			break
+		}
 		if err != nil {
-			failures++
-			log.Printf("Failed to defragment etcd member %q. took %s. (%v)\n", ep, d.String(), err)
-			if !globalCfg.ContinueOnError {
+			lg.Error("Failed to get member status", append(m.fields(), logging.Phase(phaseStatus), zap.Error(err))...)
+			if !sched.fail(epReport, err) {
 				break
 			}
 			continue
-		} else {
-			log.Printf("Finished defragmenting etcd endpoint %q. took %s\n", ep, d.String())
+		}
+		if sched.stop {
+			break
 		}
 
-		log.Print("[Post defragmentation] ")
-		_, err = getMemberStatus(globalCfg, ep)
-		if err != nil {
-			failures++
-			log.Printf("Failed to get member (%q) status, error: %v\n", ep, err)
-			if !globalCfg.ContinueOnError {
+		// The member is unavailable while defragmented, so make sure that
+		// the rest of the cluster is healthy enough right before, even with
+		// --continue-on-error. Members defragmented at once always keep a
+		// quorum, since the cap of concurrencyLimit assumes all the others
+		// are healthy.
+		if gcfg.MinHealthyAfter != "" || sched.slots.limit > 1 {
+			err := checkQuorum(ctx, gcfg, m, sched.slots.members())
+			if err != nil && len(sched.slots.running) > 0 && ctx.Err() == nil {
+				// The margin may only be short because of the members
+				// being defragmented, so check again once they're done.
+				lg.Info("Waiting for the other defragmentations before checking the quorum again", append(m.fields(), logging.Phase(phaseHealthCheck), zap.Error(err))...)
+				if !sched.wait(m, true, epReport) {
+					break
+				}
+				err = checkQuorum(ctx, gcfg, m, nil)
+			}
+			if err != nil && ctx.Err() != nil {
+				sched.notStarted(epReport)
+				break
+			}
+			if err != nil {
+				lg.Error("Refusing to defragment the member, so stopping the run", append(m.fields(), logging.Phase(phaseHealthCheck), logging.Endpoint(ep), zap.Error(err))...)
+				sched.refuse(epReport, err)
 				break
 			}
-			continue
 		}
 
-		if globalCfg.WaitBetweenDefrags > 0 && index < len(eps)-1 {
-			log.Printf("Waiting for %s for next operation\n", globalCfg.WaitBetweenDefrags.String())
-			time.Sleep(globalCfg.WaitBetweenDefrags)
+		// Check if the member is a leader and move the leader if necessary
+		// movedLeader is whether the leadership was transferred away from
+		// the member, so that it can be restored.
+		movedLeader := false
+		if gcfg.MoveLeader {
+			if status.Resp.Leader == status.Resp.Header.MemberId {
+				lg.Info("Transferring the leadership from the current leader", append(m.fields(), logging.Phase(phaseMoveLeader), logging.Endpoint(ep))...)
+				// A half-done leader transfer is left to complete even if
+				// the run is interrupted.
+				if movedLeader, err = moveLeader(context.WithoutCancel(ctx), gcfg, m); err != nil {
+					lg.Error("Failed to transfer the leadership to a follower", append(m.fields(), logging.Phase(phaseMoveLeader), logging.Endpoint(ep), zap.Error(err))...)
+					if !sched.fail(epReport, err) {
+						break
+					}
+					continue
+				}
+				if gcfg.WaitBetweenDefrags > 0 {
+					lg.Info("Transferred the leadership successfully! Waiting for next operation", logging.Phase(phaseMoveLeader), zap.Duration("wait", gcfg.WaitBetweenDefrags))
+					sleepCtx(ctx, gcfg.WaitBetweenDefrags)
+				}
+			}
+		}
+
+		if ctx.Err() != nil {
+			sched.notStarted(epReport)
+			break
+		}
+		last := index == len(members)-1
+		if !sched.start(m, alone, func() defragResult {
+			return defragMember(ctx, gcfg, m, status, epReport, members, movedLeader, last)
+		}) {
+			break
 		}
 	}
-	if failures != 0 {
-		log.Printf("%d (total %d) endpoint(s) failed to be defragmented.\n", failures, len(eps))
-		os.Exit(1)
+	if err := sched.finish(ctx); err != nil {
+		return err
 	}
-	log.Println("The defragmentation is successful.")
+	lg.Info("The defragmentation is successful")
 
 	// Perform auto-disalarm if enabled and not in dry-run mode
-	if !globalCfg.DryRun && globalCfg.AutoDisalarm {
-		log.Println("Start auto-disalarm")
+	if !gcfg.DryRun && gcfg.AutoDisalarm {
+		lg.Info("Start auto-disalarm", logging.Phase(phaseAutoDisalarm))
 		// Get updated status after defragmentation
-		updatedStatusList, err := getMembersStatus(globalCfg)
+		report.AutoDisalarm = &autoDisalarmReport{}
+		updatedStatusList, err := getMembersStatus(ctx, gcfg, members)
 		if err != nil {
-			log.Printf("Failed to get updated members status for auto-disalarm: %v\n", err)
+			report.AutoDisalarm.Result = resultFailure
+			report.AutoDisalarm.Error = err.Error()
+			lg.Error("Failed to get updated members status for auto-disalarm", logging.Phase(phaseAutoDisalarm), zap.Error(err))
 		} else {
-			if err := performAutoDisalarm(globalCfg, updatedStatusList); err != nil {
-				log.Printf("Auto-disalarm failed: %v\n", err)
+			result, err := performAutoDisalarm(ctx, gcfg, updatedStatusList)
+			report.AutoDisalarm.Result = result
+			if err != nil {
+				report.AutoDisalarm.Error = err.Error()
+				lg.Error("Auto-disalarm failed", logging.Phase(phaseAutoDisalarm), zap.Error(err))
 			}
 		}
 	}
+
+	return nil
 }
 
-func healthCheck(gcfg config.GlobalConfig) bool {
+func healthCheck(ctx context.Context, gcfg config.GlobalConfig) ([]epHealth, bool) {
 	if gcfg.SkipHealthcheckClusterEndpoints {
-		log.Printf("Health check will be performed only on the explicitly provided endpoints: %v\n", gcfg.Endpoints)
+		lg.Info("Health check will be performed only on the explicitly provided endpoints", logging.Phase(phaseHealthCheck), zap.Strings("endpoints", gcfg.Endpoints))
 	} else {
-		log.Println("Health check will be performed on all cluster member endpoints")
+		lg.Info("Health check will be performed on all cluster member endpoints", logging.Phase(phaseHealthCheck))
 	}
 
-	healthInfos, err := clusterHealth(gcfg)
+	healthList, err := clusterHealth(ctx, gcfg)
 	if err != nil {
-		log.Printf("Failed to get members' health info: %v\n", err)
-		return false
+		lg.Error("Failed to get members' health info", logging.Phase(phaseHealthCheck), zap.Error(err))
+		return nil, false
 	}
 
+	// A member is healthy if any of its URLs is, the other URLs are only
+	// kept in the report.
+	var healthInfos []epHealth
 	unhealthyCount := 0
-	for _, healthInfo := range healthInfos {
-		if !healthInfo.Health {
+	for _, mh := range healthList {
+		for _, healthInfo := range mh.urls {
+			healthInfos = append(healthInfos, healthInfo)
+			if !healthInfo.Health {
+				lg.Warn("Endpoint health", append(healthInfo.fields(), mh.member.fields()...)...)
+				continue
+			}
+
+			lg.Info("Endpoint health", append(healthInfo.fields(), mh.member.fields()...)...)
+		}
+		if !mh.healthy {
 			unhealthyCount++
+			lg.Warn("Member is unhealthy", append(mh.member.fields(), logging.Phase(phaseHealthCheck))...)
 		}
-
-		log.Println(healthInfo.String())
 	}
 
-	return unhealthyCount == 0
+	return healthInfos, unhealthyCount == 0
 }
 
-func getMembersStatus(gcfg config.GlobalConfig) ([]epStatus, error) {
-	statusList, err := membersStatus(gcfg)
+func getMembersStatus(ctx context.Context, gcfg config.GlobalConfig, members []member) ([]epStatus, error) {
+	statusList, err := membersStatus(ctx, gcfg, members)
 	if err != nil {
 		return nil, err
 	}
 
 	for _, status := range statusList {
-		log.Println(status.String())
+		lg.Info("Member status", append(status.fields(), logging.Phase(phaseStatus))...)
+		recordMemberStatus(status)
 	}
 	return statusList, nil
 }
 
-func getMemberStatus(gcfg config.GlobalConfig, ep string) (epStatus, error) {
-	status, err := memberStatus(gcfg, ep)
+func getMemberStatus(ctx context.Context, gcfg config.GlobalConfig, m member, msg string) (epStatus, error) {
+	status, err := memberStatus(ctx, gcfg, m)
 	if err != nil {
 		return epStatus{}, err
 	}
-	log.Println(status.String())
+	lg.Info(msg, append(status.fields(), logging.Phase(phaseStatus))...)
+	recordMemberStatus(status)
 	return status, nil
 }
 
-func moveLeader(gcfg config.GlobalConfig, leaderID uint64, leaderEndpoint string) error {
-	memberlistResp, err := memberList(gcfg)
+// moveLeader transfers the leadership to a healthy voting member, see
+// transferees, and waits until the new leader is confirmed, so that the
+// former leader is never defragmented while still leading. It returns
+// whether the leadership was transferred.
+func moveLeader(ctx context.Context, gcfg config.GlobalConfig, leader member) (bool, error) {
+	memberlistResp, err := memberList(ctx, gcfg)
 	if err != nil {
-		return fmt.Errorf("failed to get member list: %w", err)
+		return false, fmt.Errorf("failed to get member list: %w", err)
 	}
 
 	if len(memberlistResp.Members) == 1 {
-		log.Println("Skip moving leader as there is only one member in the cluster")
-		return nil
+		lg.Info("Skip moving leader as there is only one member in the cluster", logging.Phase(phaseMoveLeader))
+		return false, nil
 	}
 
-	// pick up a follower to transfer the leadership to
-	newLeaderID := uint64(0)
-	for _, m := range memberlistResp.Members {
-		if m.ID != leaderID {
-			newLeaderID = m.ID
-			break
-		}
+	candidates, err := transferees(ctx, gcfg, leader, memberlistResp.Members)
+	if err != nil {
+		return false, err
 	}
-
-	if newLeaderID == 0 {
-		return fmt.Errorf("coundn't find a follower in the %d member cluster", len(memberlistResp.Members))
+	t, err := pickTransferee(gcfg, candidates)
+	if err != nil {
+		return false, err
 	}
 
-	log.Printf("Transferring the leadership from %x to %x\n", leaderID, newLeaderID)
-	return transferLeadership(globalCfg, leaderEndpoint, newLeaderID)
+	lg.Info("Transferring the leadership", logging.Phase(phaseMoveLeader), zap.Stringer("from", leader), zap.Stringer("to", t.member), zap.Uint64("lag", t.lag))
+	if err := transferLeadership(ctx, gcfg, leader, t.member.ID); err != nil {
+		return false, err
+	}
+	if err := waitForLeader(ctx, gcfg, t.member); err != nil {
+		return true, err
+	}
+	lg.Info("The new leader is confirmed", logging.Phase(phaseMoveLeader), zap.Stringer("leader", t.member))
+	return true, nil
 }
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.uber.org/zap"
+	"golang.org/x/exp/slices"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/ahrtr/etcd-defrag/internal/config"
+	"github.com/ahrtr/etcd-defrag/internal/logging"
+)
+
+// member is an etcd member the defragmentation workflow runs on. A member
+// may advertise several client URLs, but it's processed only once, via the
+// first URL which works.
+type member struct {
+	ID        uint64   `json:"id"`
+	Name      string   `json:"name,omitempty"`
+	URLs      []string `json:"urls"`
+	IsLearner bool     `json:"isLearner,omitempty"`
+}
+
+func (m member) String() string {
+	if m.Name == "" {
+		return fmt.Sprintf("%x", m.ID)
+	}
+	return fmt.Sprintf("%s(%x)", m.Name, m.ID)
+}
+
+// fields returns the log fields identifying the member.
+func (m member) fields() []zap.Field {
+	return []zap.Field{logging.MemberID(m.ID), logging.MemberName(m.Name)}
+}
+
+// eachURL calls fn with the URLs of the member in turn, until it succeeds.
+// It only moves on to the next URL if retry returns true for the error, and
+// returns the last URL tried.
+func (m member) eachURL(fn func(ep string) error, retry func(error) bool) (string, error) {
+	if len(m.URLs) == 0 {
+		return "", fmt.Errorf("member %s has no client URL", m)
+	}
+	var (
+		ep  string
+		err error
+	)
+	for i, u := range m.URLs {
+		ep = u
+		if err = fn(ep); err == nil || !retry(err) {
+			return ep, err
+		}
+		if i < len(m.URLs)-1 {
+			lg.Warn("Falling back to the next URL of the member", append(m.fields(), logging.Endpoint(ep), zap.String("next", m.URLs[i+1]), zap.Error(err))...)
+		}
+	}
+	return ep, err
+}
+
+// preferURL returns a copy of the member which tries the URL first.
+func (m member) preferURL(ep string) member {
+	urls := []string{ep}
+	for _, u := range m.URLs {
+		if u != ep {
+			urls = append(urls, u)
+		}
+	}
+	m.URLs = urls
+	return m
+}
+
+// anyError retries on all errors, for the requests which can safely be sent
+// twice.
+func anyError(error) bool {
+	return true
+}
+
+// isUnavailable returns whether the request failed because the URL was
+// unreachable, so that it wasn't executed by the member.
+func isUnavailable(err error) bool {
+	var createErr *createClientError
+	return errors.As(err, &createErr) || status.Code(err) == codes.Unavailable
+}
+
+// createClientError is returned when the client of a URL can't be created.
+type createClientError struct {
+	err error
+}
+
+func (e *createClientError) Error() string {
+	return fmt.Sprintf("failed to createClient: %v", e.err)
+}
+
+func (e *createClientError) Unwrap() error {
+	return e.err
+}
+
+// getMembers returns the members to defragment, deduplicated by member ID.
+// With --cluster, they are the voting members in the member list. Otherwise,
+// the endpoints given on the command line are grouped by the member they
+// belong to, and each member only uses the given endpoints.
+func getMembers(ctx context.Context, gcfg config.GlobalConfig) ([]member, error) {
+	resp, err := memberList(ctx, gcfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get member list: %w", err)
+	}
+	if gcfg.Cluster {
+		return membersFromCluster(gcfg, resp.Members)
+	}
+
+	eps, err := endpointsFromCmd(gcfg)
+	if err != nil {
+		return nil, err
+	}
+	return membersFromEndpoints(ctx, gcfg, eps, resp.Members)
+}
+
+func membersFromCluster(gcfg config.GlobalConfig, list []*etcdserverpb.Member) ([]member, error) {
+	var members []member
+	for _, m := range list {
+		// learner member only serves Status and SerializableRead requests, just ignore it
+		if m.IsLearner {
+			continue
+		}
+		urls, err := filterURLs(gcfg, m.ClientURLs)
+		if err != nil {
+			return nil, err
+		}
+		if len(urls) == 0 {
+			// not started yet, or only serving on localhost
+			continue
+		}
+		members = append(members, member{ID: m.ID, Name: m.Name, URLs: urls})
+	}
+	return members, nil
+}
+
+// filterURLs removes the duplicate URLs, and the loopback ones when
+// --exclude-localhost is set.
+func filterURLs(gcfg config.GlobalConfig, urls []string) ([]string, error) {
+	var ret []string
+	seen := map[string]bool{}
+	for _, u := range urls {
+		if seen[u] {
+			continue
+		}
+		seen[u] = true
+		if gcfg.ExcludeLocalhost {
+			ok, err := isLocalEndpoint(u)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				continue
+			}
+		}
+		ret = append(ret, u)
+	}
+	return ret, nil
+}
+
+func membersFromEndpoints(ctx context.Context, gcfg config.GlobalConfig, eps []string, list []*etcdserverpb.Member) ([]member, error) {
+	byURL := map[string]*etcdserverpb.Member{}
+	byID := map[uint64]*etcdserverpb.Member{}
+	for _, m := range list {
+		byID[m.ID] = m
+		for _, u := range m.ClientURLs {
+			byURL[u] = m
+		}
+	}
+
+	var members []member
+	index := map[uint64]int{}
+	for _, ep := range eps {
+		m, ok := byURL[ep]
+		if !ok {
+			// e.g. a load balancer or DNS name which isn't advertised by
+			// the member, so ask the member itself.
+			resp, err := endpointStatus(ctx, gcfg, ep)
+			if err != nil {
+				return nil, fmt.Errorf("failed to get the member of endpoint %q: %w", ep, err)
+			}
+			id := resp.Header.MemberId
+			if m, ok = byID[id]; !ok {
+				m = &etcdserverpb.Member{ID: id}
+			}
+		}
+
+		i, ok := index[m.ID]
+		if !ok {
+			index[m.ID] = len(members)
+			members = append(members, member{ID: m.ID, Name: m.Name, IsLearner: m.IsLearner, URLs: []string{ep}})
+			continue
+		}
+		if !slices.Contains(members[i].URLs, ep) {
+			members[i].URLs = append(members[i].URLs, ep)
+		}
+	}
+	return members, nil
+}
+
+// membersWithLeaderAtEnd returns the members in the order of the status
+// list, with the leader moved to the end.
+func membersWithLeaderAtEnd(statusList []epStatus) []member {
+	var sorted, leaders []member
+	for _, status := range statusList {
+		if status.Resp.Header.MemberId != status.Resp.Leader {
+			sorted = append(sorted, status.Member)
+		} else {
+			leaders = append(leaders, status.Member)
+		}
+	}
+	return append(sorted, leaders...)
+}
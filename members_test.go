@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/ahrtr/etcd-defrag/internal/config"
+)
+
+// fakeMemberClient returns the member list, and the status of the endpoints
+// in statusIDs, the other endpoints are unreachable.
+type fakeMemberClient struct {
+	*clientv3.Client
+	memberListResp *clientv3.MemberListResponse
+	statusIDs      map[string]uint64
+}
+
+func (f *fakeMemberClient) MemberList(ctx context.Context, opts ...clientv3.OpOption) (*clientv3.MemberListResponse, error) {
+	return f.memberListResp, nil
+}
+
+func (f *fakeMemberClient) Status(ctx context.Context, ep string) (*clientv3.StatusResponse, error) {
+	id, ok := f.statusIDs[ep]
+	if !ok {
+		return nil, status.Error(codes.Unavailable, "connection refused")
+	}
+	return &clientv3.StatusResponse{Header: &etcdserverpb.ResponseHeader{MemberId: id}}, nil
+}
+
+func (f *fakeMemberClient) Close() error {
+	return nil
+}
+
+func TestGetMembers(t *testing.T) {
+	oldCreateClient := createClient
+	t.Cleanup(func() {
+		createClient = oldCreateClient
+	})
+
+	fakeClient := &fakeMemberClient{
+		memberListResp: &clientv3.MemberListResponse{
+			Members: []*etcdserverpb.Member{
+				{ID: 1, Name: "etcd-1", ClientURLs: []string{"https://10.0.0.1:2379", "https://etcd-1:2379", "https://10.0.0.1:2379"}},
+				{ID: 2, Name: "etcd-2", ClientURLs: []string{"https://10.0.0.2:2379", "https://127.0.0.1:2379"}},
+				{ID: 3, Name: "etcd-3", ClientURLs: []string{"https://10.0.0.3:2379"}, IsLearner: true},
+				{ID: 4, Name: "etcd-4"},
+			},
+		},
+		statusIDs: map[string]uint64{"https://etcd-lb:2379": 2},
+	}
+	createClient = func(cfgSpec *clientv3.ConfigSpec) (EtcdCluster, error) {
+		return fakeClient, nil
+	}
+
+	testCases := []struct {
+		name            string
+		gcfg            config.GlobalConfig
+		expectedMembers []member
+	}{
+		{
+			name: "cluster",
+			gcfg: config.GlobalConfig{Cluster: true, Endpoints: []string{"https://10.0.0.1:2379"}},
+			expectedMembers: []member{
+				{ID: 1, Name: "etcd-1", URLs: []string{"https://10.0.0.1:2379", "https://etcd-1:2379"}},
+				{ID: 2, Name: "etcd-2", URLs: []string{"https://10.0.0.2:2379", "https://127.0.0.1:2379"}},
+			},
+		},
+		{
+			name: "cluster excluding localhost",
+			gcfg: config.GlobalConfig{Cluster: true, ExcludeLocalhost: true, Endpoints: []string{"https://10.0.0.1:2379"}},
+			expectedMembers: []member{
+				{ID: 1, Name: "etcd-1", URLs: []string{"https://10.0.0.1:2379", "https://etcd-1:2379"}},
+				{ID: 2, Name: "etcd-2", URLs: []string{"https://10.0.0.2:2379"}},
+			},
+		},
+		{
+			name: "endpoints of the same member",
+			gcfg: config.GlobalConfig{Endpoints: []string{"https://etcd-1:2379", "https://10.0.0.3:2379", "https://10.0.0.1:2379"}},
+			expectedMembers: []member{
+				{ID: 1, Name: "etcd-1", URLs: []string{"https://etcd-1:2379", "https://10.0.0.1:2379"}},
+				{ID: 3, Name: "etcd-3", URLs: []string{"https://10.0.0.3:2379"}, IsLearner: true},
+			},
+		},
+		{
+			name: "endpoint not advertised by the member",
+			gcfg: config.GlobalConfig{Endpoints: []string{"https://etcd-lb:2379", "https://10.0.0.2:2379"}},
+			expectedMembers: []member{
+				{ID: 2, Name: "etcd-2", URLs: []string{"https://etcd-lb:2379", "https://10.0.0.2:2379"}},
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			members, err := getMembers(context.Background(), tc.gcfg)
+			require.NoError(t, err)
+			require.Equal(t, tc.expectedMembers, members)
+		})
+	}
+
+	_, err := getMembers(context.Background(), config.GlobalConfig{Endpoints: []string{"https://unknown:2379"}})
+	require.ErrorContains(t, err, `failed to get the member of endpoint "https://unknown:2379"`)
+}
+
+func TestMemberEachURL(t *testing.T) {
+	m := member{ID: 1, Name: "etcd-1", URLs: []string{"ep1", "ep2", "ep3"}}
+	unavailable := status.Error(codes.Unavailable, "connection refused")
+
+	testCases := []struct {
+		name        string
+		errs        map[string]error
+		retry       func(error) bool
+		expectedEp  string
+		expectedErr error
+		expectedTry []string
+	}{
+		{
+			name:        "first URL works",
+			retry:       anyError,
+			expectedEp:  "ep1",
+			expectedTry: []string{"ep1"},
+		},
+		{
+			name:        "fall back on any error",
+			errs:        map[string]error{"ep1": errors.New("timeout"), "ep2": &createClientError{err: errors.New("bad URL")}},
+			retry:       anyError,
+			expectedEp:  "ep3",
+			expectedTry: []string{"ep1", "ep2", "ep3"},
+		},
+		{
+			name:        "fall back on unavailable URL",
+			errs:        map[string]error{"ep1": unavailable},
+			retry:       isUnavailable,
+			expectedEp:  "ep2",
+			expectedTry: []string{"ep1", "ep2"},
+		},
+		{
+			name:        "no fall back on other errors",
+			errs:        map[string]error{"ep1": errors.New("timeout")},
+			retry:       isUnavailable,
+			expectedEp:  "ep1",
+			expectedErr: errors.New("timeout"),
+			expectedTry: []string{"ep1"},
+		},
+		{
+			name:        "all URLs unavailable",
+			errs:        map[string]error{"ep1": unavailable, "ep2": unavailable, "ep3": unavailable},
+			retry:       isUnavailable,
+			expectedEp:  "ep3",
+			expectedErr: unavailable,
+			expectedTry: []string{"ep1", "ep2", "ep3"},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var tried []string
+			ep, err := m.eachURL(func(ep string) error {
+				tried = append(tried, ep)
+				return tc.errs[ep]
+			}, tc.retry)
+			require.Equal(t, tc.expectedEp, ep)
+			require.Equal(t, tc.expectedErr, err)
+			require.Equal(t, tc.expectedTry, tried)
+		})
+	}
+
+	_, err := member{ID: 1}.eachURL(func(string) error { return nil }, anyError)
+	require.ErrorContains(t, err, "member 1 has no client URL")
+}
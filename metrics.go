@@ -0,0 +1,183 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.uber.org/zap"
+)
+
+const metricsNamespace = "etcd_defrag"
+
+// Values of the "result" label.
+const (
+	resultSuccess = "success"
+	resultFailure = "failure"
+	resultSkip    = "skip"
+)
+
+var (
+	metricsRegistry = prometheus.NewRegistry()
+
+	memberDBSizeGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "member_db_size_bytes",
+		Help:      "Total size of the member's backend database in bytes.",
+	}, []string{"endpoint"})
+
+	memberDBSizeInUseGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "member_db_size_in_use_bytes",
+		Help:      "Size of the member's backend database logically in use in bytes.",
+	}, []string{"endpoint"})
+
+	memberDBSizeFreeGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "member_db_size_free_bytes",
+		Help:      "Size of the member's backend database not in use (dbSize - dbSizeInUse) in bytes.",
+	}, []string{"endpoint"})
+
+	defragDurationHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "defrag_duration_seconds",
+		Help:      "Duration of the defragmentation of a member.",
+		Buckets:   prometheus.ExponentialBuckets(0.1, 2, 12), // 100ms ~ 204.8s
+	}, []string{"endpoint"})
+
+	compactionDurationHistogram = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "compaction_duration_seconds",
+		Help:      "Duration of the compaction executed before the defragmentation.",
+		Buckets:   prometheus.ExponentialBuckets(0.1, 2, 12), // 100ms ~ 204.8s
+	})
+
+	defragTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "defrag_total",
+		Help:      "Number of defragmentation attempts per endpoint, partitioned by result (success, failure or skip).",
+	}, []string{"endpoint", "result"})
+
+	ruleEvaluationTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "rule_evaluation_total",
+		Help:      "Number of defragmentation rule evaluations per endpoint, partitioned by result (true, false or error).",
+	}, []string{"endpoint", "result"})
+
+	autoDisalarmTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "auto_disalarm_total",
+		Help:      "Number of auto-disalarm actions, partitioned by result (success, failure or skip).",
+	}, []string{"result"})
+
+	lastRunTimestampGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "last_run_timestamp_seconds",
+		Help:      "Unix timestamp of the end of the last defragmentation cycle.",
+	})
+
+	lastRunSuccessGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "last_run_success",
+		Help:      "Whether the last defragmentation cycle succeeded (1) or failed (0).",
+	})
+
+	pausedGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "paused",
+		Help:      "Whether the defragmentation is paused (1) or not (0).",
+	})
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		memberDBSizeGauge,
+		memberDBSizeInUseGauge,
+		memberDBSizeFreeGauge,
+		defragDurationHistogram,
+		compactionDurationHistogram,
+		defragTotal,
+		ruleEvaluationTotal,
+		autoDisalarmTotal,
+		lastRunTimestampGauge,
+		lastRunSuccessGauge,
+		pausedGauge,
+	)
+}
+
+// serveMetrics starts serving the /metrics endpoint on the given address in
+// the background. The address is bound synchronously, so that a bad or
+// already used address fails the startup instead of leaving the daemon
+// running without metrics.
+func serveMetrics(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on --metrics-addr %q: %w", addr, err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}))
+
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	lg.Info("Serving metrics", zap.String("address", ln.Addr().String()), zap.String("path", "/metrics"))
+	go func() {
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			lg.Error("Failed to serve metrics", zap.String("address", addr), zap.Error(err))
+		}
+	}()
+	return nil
+}
+
+func recordMemberStatus(status epStatus) {
+	if status.Resp == nil {
+		return
+	}
+	memberDBSizeGauge.WithLabelValues(status.Ep).Set(float64(status.Resp.DbSize))
+	memberDBSizeInUseGauge.WithLabelValues(status.Ep).Set(float64(status.Resp.DbSizeInUse))
+	memberDBSizeFreeGauge.WithLabelValues(status.Ep).Set(float64(status.Resp.DbSize - status.Resp.DbSizeInUse))
+}
+
+func recordDefrag(ep string, d time.Duration, err error) {
+	defragDurationHistogram.WithLabelValues(ep).Observe(d.Seconds())
+	if err != nil {
+		defragTotal.WithLabelValues(ep, resultFailure).Inc()
+		return
+	}
+	defragTotal.WithLabelValues(ep, resultSuccess).Inc()
+}
+
+func recordDefragSkipped(ep string) {
+	defragTotal.WithLabelValues(ep, resultSkip).Inc()
+}
+
+func recordRuleEvaluation(ep string, result bool, err error) {
+	switch {
+	case err != nil:
+		ruleEvaluationTotal.WithLabelValues(ep, "error").Inc()
+	case result:
+		ruleEvaluationTotal.WithLabelValues(ep, "true").Inc()
+	default:
+		ruleEvaluationTotal.WithLabelValues(ep, "false").Inc()
+	}
+}
+
+func recordRunResult(err error) {
+	lastRunTimestampGauge.SetToCurrentTime()
+	if err != nil {
+		lastRunSuccessGauge.Set(0)
+		return
+	}
+	lastRunSuccessGauge.Set(1)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+func TestRecordMemberStatus(t *testing.T) {
+	recordMemberStatus(epStatus{Ep: "metrics-ep1", Resp: &clientv3.StatusResponse{DbSize: 1000, DbSizeInUse: 600}})
+
+	require.InDelta(t, 1000, testutil.ToFloat64(memberDBSizeGauge.WithLabelValues("metrics-ep1")), 0)
+	require.InDelta(t, 600, testutil.ToFloat64(memberDBSizeInUseGauge.WithLabelValues("metrics-ep1")), 0)
+	require.InDelta(t, 400, testutil.ToFloat64(memberDBSizeFreeGauge.WithLabelValues("metrics-ep1")), 0)
+
+	// A failed status request must not reset the last known values.
+	recordMemberStatus(epStatus{Ep: "metrics-ep1"})
+	require.InDelta(t, 1000, testutil.ToFloat64(memberDBSizeGauge.WithLabelValues("metrics-ep1")), 0)
+}
+
+func TestRecordDefrag(t *testing.T) {
+	recordDefrag("metrics-ep2", time.Second, nil)
+	recordDefrag("metrics-ep2", time.Second, errors.New("timeout"))
+	recordDefrag("metrics-ep2", time.Second, nil)
+	recordDefragSkipped("metrics-ep2")
+
+	require.InDelta(t, 2, testutil.ToFloat64(defragTotal.WithLabelValues("metrics-ep2", resultSuccess)), 0)
+	require.InDelta(t, 1, testutil.ToFloat64(defragTotal.WithLabelValues("metrics-ep2", resultFailure)), 0)
+	require.InDelta(t, 1, testutil.ToFloat64(defragTotal.WithLabelValues("metrics-ep2", resultSkip)), 0)
+}
+
+func TestRecordRuleEvaluation(t *testing.T) {
+	recordRuleEvaluation("metrics-ep3", true, nil)
+	recordRuleEvaluation("metrics-ep3", false, nil)
+	recordRuleEvaluation("metrics-ep3", false, nil)
+	recordRuleEvaluation("metrics-ep3", false, errors.New("bad rule"))
+
+	require.InDelta(t, 1, testutil.ToFloat64(ruleEvaluationTotal.WithLabelValues("metrics-ep3", "true")), 0)
+	require.InDelta(t, 2, testutil.ToFloat64(ruleEvaluationTotal.WithLabelValues("metrics-ep3", "false")), 0)
+	require.InDelta(t, 1, testutil.ToFloat64(ruleEvaluationTotal.WithLabelValues("metrics-ep3", "error")), 0)
+}
+
+func TestServeMetrics(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	err = serveMetrics(ln.Addr().String())
+	require.ErrorContains(t, err, "failed to listen on --metrics-addr")
+
+	require.ErrorContains(t, serveMetrics("not-an-address"), "failed to listen on --metrics-addr")
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/ahrtr/etcd-defrag/internal/logging"
+)
+
+// Values of the "reason" of a pause.
+const (
+	pauseReasonSignal = "signal"
+	pauseReasonFile   = "pauseFile"
+)
+
+// pausePollInterval is how often the pause state is checked while paused.
+var pausePollInterval = time.Second
+
+// pauser is the pause controller of the process, see newPauseController.
+// When it's nil, the defragmentation is never paused.
+var pauser *pauseController
+
+// pauseController tracks whether the defragmentation is paused, either by
+// SIGUSR1 until SIGUSR2 (not supported on Windows), or while --pause-file
+// exists. It lasts for the whole process, so that a pause spans the cycles
+// in daemon mode.
+type pauseController struct {
+	file     string
+	signaled atomic.Bool
+	stop     func()
+}
+
+func newPauseController(file string) *pauseController {
+	p := &pauseController{file: file}
+	p.stop = notifyPauseSignals(p)
+	return p
+}
+
+func (p *pauseController) close() {
+	if p != nil {
+		p.stop()
+	}
+}
+
+// setSignaled pauses or resumes the defragmentation on a signal.
+func (p *pauseController) setSignaled(paused bool) {
+	if p.signaled.Swap(paused) != paused {
+		lg.Info("Received pause signal", zap.Bool("paused", paused))
+	}
+}
+
+// paused returns whether the defragmentation is paused, and why.
+func (p *pauseController) paused() (bool, string) {
+	if p == nil {
+		return false, ""
+	}
+	if p.signaled.Load() {
+		return true, pauseReasonSignal
+	}
+	if p.file != "" {
+		_, err := os.Stat(p.file)
+		if err == nil {
+			return true, pauseReasonFile
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			lg.Warn("Failed to check the pause file, assuming it doesn't exist", zap.String("path", p.file), zap.Error(err))
+		}
+	}
+	return false, ""
+}
+
+// wait blocks while the defragmentation is paused, before processing the
+// member, or until the context is done.
+func (p *pauseController) wait(ctx context.Context, m member) {
+	paused, reason := p.paused()
+	if !paused {
+		return
+	}
+
+	lg.Warn("Paused before processing the next member", append(m.fields(), logging.Phase(phaseDefrag), zap.String("reason", reason), zap.String("pauseFile", p.file))...)
+	pausedGauge.Set(1)
+	defer pausedGauge.Set(0)
+	startTS := time.Now()
+	for paused {
+		if !sleepCtx(ctx, pausePollInterval) {
+			return
+		}
+		paused, _ = p.paused()
+	}
+	lg.Info("Resumed", append(m.fields(), logging.Phase(phaseDefrag), zap.Duration("paused", time.Since(startTS)))...)
+}
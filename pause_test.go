@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPauseController(t *testing.T) {
+	oldInterval := pausePollInterval
+	pausePollInterval = time.Millisecond
+	t.Cleanup(func() {
+		pausePollInterval = oldInterval
+	})
+
+	var nilPauser *pauseController
+	paused, _ := nilPauser.paused()
+	require.False(t, paused)
+	nilPauser.wait(context.Background(), member{})
+
+	pauseFile := filepath.Join(t.TempDir(), "pause")
+	p := &pauseController{file: pauseFile}
+	paused, _ = p.paused()
+	require.False(t, paused)
+
+	require.NoError(t, os.WriteFile(pauseFile, nil, 0o600))
+	paused, reason := p.paused()
+	require.True(t, paused)
+	require.Equal(t, pauseReasonFile, reason)
+
+	// The wait ends once the file is removed.
+	done := make(chan struct{})
+	go func() {
+		p.wait(context.Background(), member{ID: 1})
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("Expected the wait to block while paused")
+	case <-time.After(20 * time.Millisecond):
+	}
+	require.NoError(t, os.Remove(pauseFile))
+	<-done
+
+	// The signal pauses until it's reset, or the context is done.
+	p.setSignaled(true)
+	paused, reason = p.paused()
+	require.True(t, paused)
+	require.Equal(t, pauseReasonSignal, reason)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	p.wait(ctx, member{ID: 1})
+	require.Error(t, ctx.Err())
+
+	p.setSignaled(false)
+	paused, _ = p.paused()
+	require.False(t, paused)
+}
@@ -0,0 +1,33 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// notifyPauseSignals pauses the defragmentation on SIGUSR1, and resumes it on
+// SIGUSR2. It returns the function which stops listening to them.
+func notifyPauseSignals(p *pauseController) func() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGUSR1, syscall.SIGUSR2)
+
+	done := make(chan struct{})
+	go func() {
+		defer signal.Stop(ch)
+		for {
+			select {
+			case sig := <-ch:
+				p.setSignaled(sig == syscall.SIGUSR1)
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+	}
+}
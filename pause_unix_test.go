@@ -0,0 +1,25 @@
+//go:build !windows
+
+package main
+
+import (
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPauseSignals(t *testing.T) {
+	p := newPauseController("")
+	defer p.close()
+
+	paused := func() bool {
+		ret, _ := p.paused()
+		return ret
+	}
+	require.NoError(t, syscall.Kill(syscall.Getpid(), syscall.SIGUSR1))
+	require.Eventually(t, paused, time.Second, time.Millisecond)
+	require.NoError(t, syscall.Kill(syscall.Getpid(), syscall.SIGUSR2))
+	require.Eventually(t, func() bool { return !paused() }, time.Second, time.Millisecond)
+}
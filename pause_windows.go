@@ -0,0 +1,9 @@
+//go:build windows
+
+package main
+
+// notifyPauseSignals does nothing, since Windows has no SIGUSR1 or SIGUSR2,
+// so only --pause-file is supported.
+func notifyPauseSignals(*pauseController) func() {
+	return func() {}
+}
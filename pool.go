@@ -0,0 +1,81 @@
+package main
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/ahrtr/etcd-defrag/internal/config"
+)
+
+// clients is the client pool of the current run, see startClientPool. When
+// it's nil, a new client is created and closed for each request.
+var clients *clientPool
+
+// clientPool reuses the clients, and so the gRPC connections and TLS
+// handshakes, of the endpoints for the whole run. It's safe for concurrent
+// use.
+type clientPool struct {
+	mu      sync.Mutex
+	clients map[string]EtcdCluster
+}
+
+func newClientPool() *clientPool {
+	return &clientPool{clients: map[string]EtcdCluster{}}
+}
+
+// startClientPool installs a new client pool, and returns the function which
+// closes all its clients and uninstalls it.
+func startClientPool() func() {
+	clients = newClientPool()
+	return func() {
+		clients.close()
+		clients = nil
+	}
+}
+
+// get returns the client of the endpoints, creating it on first use. The
+// configuration doesn't change during a run, so the endpoints are the key.
+func (p *clientPool) get(gcfg config.GlobalConfig, eps []string) (EtcdCluster, error) {
+	key := strings.Join(eps, ",")
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if c, ok := p.clients[key]; ok {
+		return c, nil
+	}
+	c, err := newClient(gcfg, eps)
+	if err != nil {
+		return nil, err
+	}
+	p.clients[key] = c
+	return c, nil
+}
+
+func (p *clientPool) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for key, c := range p.clients {
+		c.Close()
+		delete(p.clients, key)
+	}
+}
+
+// getClient returns the client of the endpoints from the pool of the run if
+// any, along with the function to call when done with it.
+func getClient(gcfg config.GlobalConfig, eps ...string) (EtcdCluster, func(), error) {
+	if clients != nil {
+		c, err := clients.get(gcfg, eps)
+		return c, func() {}, err
+	}
+	c, err := newClient(gcfg, eps)
+	if err != nil {
+		return nil, nil, err
+	}
+	return c, func() { c.Close() }, nil
+}
+
+func newClient(gcfg config.GlobalConfig, eps []string) (EtcdCluster, error) {
+	cfgSpec := gcfg.ClientConfigWithoutEndpoints()
+	cfgSpec.Endpoints = eps
+	return createClient(cfgSpec)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+
+	"github.com/ahrtr/etcd-defrag/internal/config"
+)
+
+// fakePoolClient counts the Status requests in flight, and whether it's
+// closed.
+type fakePoolClient struct {
+	*clientv3.Client
+	inFlight    *atomic.Int32
+	maxInFlight *atomic.Int32
+	closed      atomic.Bool
+}
+
+func (f *fakePoolClient) Status(ctx context.Context, ep string) (*clientv3.StatusResponse, error) {
+	n := f.inFlight.Add(1)
+	defer f.inFlight.Add(-1)
+	for {
+		m := f.maxInFlight.Load()
+		if n <= m || f.maxInFlight.CompareAndSwap(m, n) {
+			break
+		}
+	}
+	return &clientv3.StatusResponse{Header: &etcdserverpb.ResponseHeader{MemberId: uint64(len(ep))}}, nil
+}
+
+func (f *fakePoolClient) Close() error {
+	f.closed.Store(true)
+	return nil
+}
+
+func TestClientPool(t *testing.T) {
+	oldCreateClient := createClient
+	t.Cleanup(func() {
+		createClient = oldCreateClient
+	})
+
+	var (
+		mu      sync.Mutex
+		created = map[string][]*fakePoolClient{}
+	)
+	var inFlight, maxInFlight atomic.Int32
+	createClient = func(cfgSpec *clientv3.ConfigSpec) (EtcdCluster, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		c := &fakePoolClient{inFlight: &inFlight, maxInFlight: &maxInFlight}
+		created[cfgSpec.Endpoints[0]] = append(created[cfgSpec.Endpoints[0]], c)
+		return c, nil
+	}
+
+	var members []member
+	for _, ep := range []string{"a", "bb", "ccc", "dddd", "eeeee", "ffffff", "ggggggg"} {
+		members = append(members, member{ID: uint64(len(ep)), URLs: []string{ep}})
+	}
+	gcfg := config.GlobalConfig{StatusConcurrency: 3}
+
+	// Without a pool, each request has its own client.
+	_, err := membersStatus(context.Background(), gcfg, members)
+	require.NoError(t, err)
+	_, err = membersStatus(context.Background(), gcfg, members)
+	require.NoError(t, err)
+	require.Len(t, created["a"], 2)
+	require.True(t, created["a"][0].closed.Load())
+
+	clear(created)
+	maxInFlight.Store(0)
+	stop := startClientPool()
+	for i := 0; i < 2; i++ {
+		statusList, err := membersStatus(context.Background(), gcfg, members)
+		require.NoError(t, err)
+		for j, status := range statusList {
+			require.Equal(t, members[j].ID, status.Resp.Header.MemberId)
+		}
+	}
+	require.LessOrEqual(t, maxInFlight.Load(), int32(3))
+	for ep, cs := range created {
+		require.Lenf(t, cs, 1, "endpoint %s", ep)
+		require.False(t, cs[0].closed.Load())
+	}
+
+	stop()
+	require.Nil(t, clients)
+	for _, cs := range created {
+		require.True(t, cs[0].closed.Load())
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"go.uber.org/zap"
+
+	"github.com/ahrtr/etcd-defrag/internal/config"
+	"github.com/ahrtr/etcd-defrag/internal/logging"
+)
+
+// errQuorumGuard is returned when defragmenting a member would leave fewer
+// healthy voting members than --min-healthy-after.
+var errQuorumGuard = errors.New("not enough healthy voting members")
+
+// checkQuorum re-checks the health of the voting members right before the
+// member is defragmented, since the health check at the start of the run
+// may be outdated by then. The member and the others being defragmented are
+// unavailable, so they don't count, and neither do the voters without a
+// usable client URL. Without --min-healthy-after, a quorum is required.
+func checkQuorum(ctx context.Context, gcfg config.GlobalConfig, m member, defragmenting []member) error {
+	resp, err := memberList(ctx, gcfg)
+	if err != nil {
+		return fmt.Errorf("failed to get member list: %w", err)
+	}
+
+	var voters []member
+	for _, v := range resp.Members {
+		if v.IsLearner {
+			continue
+		}
+		urls, err := filterURLs(gcfg, v.ClientURLs)
+		if err != nil {
+			return err
+		}
+		voters = append(voters, member{ID: v.ID, Name: v.Name, URLs: urls})
+	}
+	spec, requiredBy := gcfg.MinHealthyAfter, "--min-healthy-after="+gcfg.MinHealthyAfter
+	if spec == "" {
+		spec, requiredBy = config.MinHealthyQuorum, "a quorum"
+	}
+	required, err := config.MinHealthyMembers(spec, len(voters))
+	if err != nil {
+		return err
+	}
+
+	down := map[uint64]bool{m.ID: true}
+	for _, d := range defragmenting {
+		down[d.ID] = true
+	}
+
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		healthy int
+	)
+	for _, v := range voters {
+		if down[v.ID] || len(v.URLs) == 0 {
+			continue
+		}
+		wg.Add(1)
+		go func(v member) {
+			defer wg.Done()
+			_, err := v.eachURL(func(ep string) error {
+				if eh := endpointHealth(ctx, gcfg, ep); !eh.Health {
+					return errors.New(eh.Error)
+				}
+				return nil
+			}, anyError)
+			if err != nil {
+				lg.Warn("Voting member is unhealthy", append(v.fields(), logging.Phase(phaseHealthCheck), zap.Error(err))...)
+				return
+			}
+			mu.Lock()
+			healthy++
+			mu.Unlock()
+		}(v)
+	}
+	wg.Wait()
+
+	lg.Info("Checked the quorum", append(m.fields(), logging.Phase(phaseHealthCheck), zap.Int("voters", len(voters)), zap.Stringers("defragmenting", defragmenting), zap.Int("healthyAfter", healthy), zap.Int("required", required))...)
+	if healthy < required {
+		what := fmt.Sprintf("member %s", m)
+		if len(defragmenting) > 0 {
+			what += fmt.Sprintf(" along with %d other member(s)", len(defragmenting))
+		}
+		return fmt.Errorf("defragmenting %s would leave %d (total %d) healthy voting member(s), but %s requires %d: %w", what, healthy, len(voters), requiredBy, required, errQuorumGuard)
+	}
+	return nil
+}
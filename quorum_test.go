@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	clientv3 "go.etcd.io/etcd/client/v3"
+
+	"github.com/ahrtr/etcd-defrag/internal/config"
+)
+
+func TestMinHealthyMembers(t *testing.T) {
+	testCases := []struct {
+		minHealthyAfter string
+		voters          int
+		expected        int
+		expectedErr     bool
+	}{
+		{minHealthyAfter: "", voters: 3, expected: 0},
+		{minHealthyAfter: "quorum", voters: 1, expected: 1},
+		{minHealthyAfter: "quorum", voters: 3, expected: 2},
+		{minHealthyAfter: "quorum", voters: 4, expected: 3},
+		{minHealthyAfter: "quorum+1", voters: 5, expected: 4},
+		{minHealthyAfter: "2", voters: 5, expected: 2},
+		{minHealthyAfter: "quorum+", expectedErr: true},
+		{minHealthyAfter: "quorum-1", expectedErr: true},
+		{minHealthyAfter: "-1", expectedErr: true},
+		{minHealthyAfter: "majority", expectedErr: true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.minHealthyAfter, func(t *testing.T) {
+			n, err := config.MinHealthyMembers(tc.minHealthyAfter, tc.voters)
+			if tc.expectedErr {
+				require.ErrorContains(t, err, "invalid --min-healthy-after")
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, n)
+		})
+	}
+}
+
+// fakeDegradedClient is unhealthy once degraded, if it's the client of
+// unhealthy.
+type fakeDegradedClient struct {
+	EtcdCluster
+	ep        string
+	unhealthy string
+	degraded  *atomic.Bool
+}
+
+func (f *fakeDegradedClient) Get(ctx context.Context, key string, opts ...clientv3.OpOption) (*clientv3.GetResponse, error) {
+	if f.degraded.Load() && f.ep == f.unhealthy {
+		return nil, errors.New("etcdserver: request timed out")
+	}
+	return f.EtcdCluster.Get(ctx, key, opts...)
+}
+
+func TestRunDefrag_QuorumGuard(t *testing.T) {
+	oldCreateClient := createClient
+	t.Cleanup(func() {
+		createClient = oldCreateClient
+	})
+
+	testCases := []struct {
+		name            string
+		minHealthyAfter string
+		degrade         bool
+		expectedErr     error
+		expectedActions []string
+	}{
+		{
+			name:            "quorum kept",
+			minHealthyAfter: "quorum",
+			expectedActions: []string{"etcd-1:defragmented", "etcd-2:defragmented", "etcd-3:defragmented"},
+		},
+		{
+			name:            "member failed after the health check",
+			minHealthyAfter: "quorum",
+			degrade:         true,
+			expectedErr:     errQuorumGuard,
+			expectedActions: []string{"etcd-1:failed", "etcd-2:notStarted", "etcd-3:notStarted"},
+		},
+		{
+			name:            "margin not possible",
+			minHealthyAfter: "quorum+1",
+			expectedErr:     errQuorumGuard,
+			expectedActions: []string{"etcd-1:failed", "etcd-2:notStarted", "etcd-3:notStarted"},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// ep2 becomes unhealthy once the health check at the start of
+			// the run is done.
+			var degraded atomic.Bool
+			onStatus := func(ep string, resp *clientv3.StatusResponse) error {
+				degraded.Store(tc.degrade)
+				return nil
+			}
+			onDefrag := func(ctx context.Context, ep string) error {
+				return nil
+			}
+			createClient = func(cfgSpec *clientv3.ConfigSpec) (EtcdCluster, error) {
+				return &fakeDegradedClient{
+					EtcdCluster: &fakeClusterClient{onDefrag: onDefrag, onStatus: onStatus},
+					ep:          cfgSpec.Endpoints[0],
+					unhealthy:   "ep2",
+					degraded:    &degraded,
+				}, nil
+			}
+
+			reportFile := filepath.Join(t.TempDir(), "report.json")
+			gcfg := config.GlobalConfig{
+				Endpoints:             []string{"ep1"},
+				Cluster:               true,
+				ContinueOnError:       true,
+				CommandTimeout:        time.Minute,
+				MinHealthyAfter:       tc.minHealthyAfter,
+				EtcdStorageQuotaBytes: 2 * 1024 * 1024 * 1024,
+				ReportFile:            reportFile,
+				ReportFormat:          "json",
+			}
+			err := runDefrag(context.Background(), gcfg)
+			if tc.expectedErr != nil {
+				require.ErrorIs(t, err, tc.expectedErr)
+			} else {
+				require.NoError(t, err)
+			}
+
+			require.Equal(t, tc.expectedActions, reportActions(t, reportFile))
+		})
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"go.yaml.in/yaml/v3"
+
+	"github.com/ahrtr/etcd-defrag/internal/config"
+)
+
+// Values of endpointReport.Action.
+const (
+	actionDefragmented = "defragmented"
+	actionSkipped      = "skipped"
+	actionDryRun       = "dryRun"
+	actionFailed       = "failed"
+	// actionCompletedAfterTimeout is a defragmentation which exceeded
+	// --command-timeout, but was completed within --max-busy-wait.
+	actionCompletedAfterTimeout = "completedAfterTimeout"
+	// actionStillBusy is a defragmentation which exceeded --command-timeout,
+	// and wasn't completed within --max-busy-wait.
+	actionStillBusy = "stillBusy"
+	// actionInterrupted is the member being defragmented when the run was
+	// interrupted, the defragmentation may still be running on the member.
+	actionInterrupted = "interrupted"
+	// actionNotStarted is a member not processed because the run was
+	// interrupted.
+	actionNotStarted = "notStarted"
+)
+
+// runReport is the machine-readable summary of one defragmentation run,
+// written to --report-file.
+type runReport struct {
+	StartTime      time.Time              `json:"startTime"`
+	EndTime        time.Time              `json:"endTime"`
+	Duration       string                 `json:"duration"`
+	Success        bool                   `json:"success"`
+	Interrupted    bool                   `json:"interrupted,omitempty"`
+	Error          string                 `json:"error,omitempty"`
+	Config         map[string]interface{} `json:"config"`
+	HealthCheck    []epHealth             `json:"healthCheck"`
+	Compaction     *compactionReport      `json:"compaction,omitempty"`
+	Endpoints      []*endpointReport      `json:"endpoints"`
+	BytesReclaimed int64                  `json:"bytesReclaimed"`
+	Failures       int                    `json:"failures"`
+	AutoDisalarm   *autoDisalarmReport    `json:"autoDisalarm,omitempty"`
+}
+
+type compactionReport struct {
+	Revision int64  `json:"revision"`
+	Duration string `json:"duration"`
+	Error    string `json:"error,omitempty"`
+}
+
+type endpointReport struct {
+	// Endpoint is the URL of the member which was used.
+	Endpoint       string    `json:"endpoint"`
+	MemberID       string    `json:"memberId"`
+	MemberName     string    `json:"memberName,omitempty"`
+	Before         *epStatus `json:"before,omitempty"`
+	After          *epStatus `json:"after,omitempty"`
+	RuleResult     *bool     `json:"ruleResult,omitempty"`
+	RuleName       string    `json:"ruleName,omitempty"`
+	Score          *float64  `json:"score,omitempty"`
+	Action         string    `json:"action"`
+	Duration       string    `json:"duration,omitempty"`
+	BytesReclaimed int64     `json:"bytesReclaimed"`
+	// LeaderRestored is whether the leadership was transferred back to the
+	// member with --restore-leader, nil if it wasn't attempted.
+	LeaderRestored *bool  `json:"leaderRestored,omitempty"`
+	Error          string `json:"error,omitempty"`
+}
+
+type autoDisalarmReport struct {
+	Result string `json:"result"`
+	Error  string `json:"error,omitempty"`
+}
+
+func newRunReport(gcfg config.GlobalConfig) *runReport {
+	return &runReport{
+		StartTime: time.Now(),
+		Config:    gcfg.RedactedSettings(),
+	}
+}
+
+// addEndpoint adds a new entry for the member to the report and returns it,
+// so that the caller can fill it in while processing the member.
+func (r *runReport) addEndpoint(m member) *endpointReport {
+	er := &endpointReport{Endpoint: m.URLs[0], MemberID: fmt.Sprintf("%x", m.ID), MemberName: m.Name}
+	r.Endpoints = append(r.Endpoints, er)
+	return er
+}
+
+// finish records the overall result of the run.
+func (r *runReport) finish(err error) {
+	r.EndTime = time.Now()
+	r.Duration = r.EndTime.Sub(r.StartTime).String()
+	r.Success = err == nil
+	r.Interrupted = errors.Is(err, errInterrupted)
+	if err != nil {
+		r.Error = err.Error()
+	}
+
+	r.BytesReclaimed = 0
+	for _, er := range r.Endpoints {
+		r.BytesReclaimed += er.BytesReclaimed
+	}
+}
+
+func (er *endpointReport) fail(err error) {
+	er.Action = actionFailed
+	er.Error = err.Error()
+}
+
+// actionCounts returns the number of members by action.
+func (r *runReport) actionCounts() map[string]int {
+	counts := map[string]int{}
+	for _, er := range r.Endpoints {
+		counts[er.Action]++
+	}
+	return counts
+}
+
+// setAfter records the post defragmentation status, and calculates how many
+// bytes were reclaimed by the defragmentation.
+func (er *endpointReport) setAfter(status epStatus) {
+	er.After = &status
+	if er.Before != nil && er.Before.Resp != nil && status.Resp != nil {
+		er.BytesReclaimed = er.Before.Resp.DbSize - status.Resp.DbSize
+	}
+}
+
+func marshalReport(r *runReport, format string) ([]byte, error) {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil || format != "yaml" {
+		return data, err
+	}
+
+	// Convert via the JSON representation, so that the yaml output uses
+	// exactly the same field names as the json output.
+	var obj interface{}
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return nil, err
+	}
+	return yaml.Marshal(obj)
+}
+
+// writeReport writes the report to the file atomically, so that readers
+// never see a partially written report in daemon mode.
+func writeReport(r *runReport, path, format string) error {
+	data, err := marshalReport(r, format)
+	if err != nil {
+		return fmt.Errorf("failed to marshal the report: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.yaml.in/yaml/v3"
+
+	"github.com/ahrtr/etcd-defrag/internal/config"
+)
+
+func TestRunReport(t *testing.T) {
+	gcfg := config.GlobalConfig{
+		Endpoints:      []string{"127.0.0.1:2379"},
+		User:           "root:secret",
+		Password:       "secret",
+		CommandTimeout: 30 * time.Second,
+	}
+	r := newRunReport(gcfg)
+	r.HealthCheck = []epHealth{{Ep: "ep1", Health: true, Took: "1ms"}}
+
+	before := epStatus{Ep: "ep1", Resp: &clientv3.StatusResponse{Header: &etcdserverpb.ResponseHeader{}, DbSize: 1000, DbSizeInUse: 400}}
+	after := epStatus{Ep: "ep1", Resp: &clientv3.StatusResponse{Header: &etcdserverpb.ResponseHeader{}, DbSize: 450, DbSizeInUse: 400}}
+	er := r.addEndpoint(member{ID: 1, Name: "etcd-1", URLs: []string{"ep1"}})
+	er.Before = &before
+	er.Action = actionDefragmented
+	er.setAfter(after)
+
+	r.addEndpoint(member{ID: 2, Name: "etcd-2", URLs: []string{"ep2"}}).fail(errors.New("context deadline exceeded"))
+	r.finish(errors.New("1 (total 2) member(s) failed to be defragmented"))
+
+	require.False(t, r.Success)
+	require.Equal(t, int64(550), r.BytesReclaimed)
+
+	for _, format := range []string{"json", "yaml"} {
+		t.Run(format, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "report."+format)
+			require.NoError(t, writeReport(r, path, format))
+
+			data, err := os.ReadFile(path)
+			require.NoError(t, err)
+			require.NotContains(t, string(data), "secret")
+
+			var got map[string]interface{}
+			if format == "json" {
+				require.NoError(t, json.Unmarshal(data, &got))
+			} else {
+				require.NoError(t, yaml.Unmarshal(data, &got))
+			}
+
+			require.Equal(t, false, got["success"])
+			require.EqualValues(t, 550, got["bytesReclaimed"])
+
+			cfg := got["config"].(map[string]interface{})
+			require.Equal(t, "******", cfg["password"])
+			require.Equal(t, "root:******", cfg["user"])
+			require.Equal(t, "30s", cfg["command-timeout"])
+
+			eps := got["endpoints"].([]interface{})
+			require.Len(t, eps, 2)
+			require.Equal(t, actionDefragmented, eps[0].(map[string]interface{})["action"])
+			require.Equal(t, actionFailed, eps[1].(map[string]interface{})["action"])
+		})
+	}
+}
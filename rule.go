@@ -0,0 +1,358 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.uber.org/zap"
+
+	"github.com/ahrtr/etcd-defrag/internal/config"
+	"github.com/ahrtr/etcd-defrag/internal/eval"
+	"github.com/ahrtr/etcd-defrag/internal/logging"
+)
+
+// clusterInfo holds the cluster wide data exposed to the defragmentation
+// rule, which is fetched once per run.
+type clusterInfo struct {
+	// memberNames maps member IDs to member names.
+	memberNames map[uint64]string
+	// noSpaceAlarms maps member IDs to the number of active NOSPACE alarms.
+	noSpaceAlarms map[uint64]int
+	// aggregates are the values aggregated over all members.
+	aggregates eval.ClusterVariables
+}
+
+func getClusterInfo(ctx context.Context, gcfg config.GlobalConfig, statusList []epStatus, healthInfos []epHealth) (clusterInfo, error) {
+	info := clusterInfo{
+		memberNames:   map[uint64]string{},
+		noSpaceAlarms: map[uint64]int{},
+	}
+
+	members, err := memberList(ctx, gcfg)
+	if err != nil {
+		return info, fmt.Errorf("failed to get member list: %w", err)
+	}
+	for _, m := range members.Members {
+		info.memberNames[m.ID] = m.Name
+	}
+
+	alarms, err := noSpaceAlarms(ctx, gcfg)
+	if err != nil {
+		return info, fmt.Errorf("failed to get alarm list: %w", err)
+	}
+	for _, a := range alarms {
+		info.noSpaceAlarms[a.MemberID]++
+	}
+
+	info.aggregates = clusterAggregates(statusList)
+	info.aggregates.MemberCount, info.aggregates.HealthyMemberCount = memberCounts(members.Members, statusList, healthInfos)
+
+	return info, nil
+}
+
+// memberCounts returns the number of voting members in the member list, and
+// how many of them are healthy. The health check is per URL, so a voting
+// member is healthy if any of its checked URLs is, and counted once.
+func memberCounts(list []*etcdserverpb.Member, statusList []epStatus, healthInfos []epHealth) (int, int) {
+	voters := map[uint64]bool{}
+	urlIDs := map[string]uint64{}
+	for _, m := range list {
+		if m.IsLearner {
+			continue
+		}
+		voters[m.ID] = true
+		for _, u := range m.ClientURLs {
+			urlIDs[u] = m.ID
+		}
+	}
+	// The URLs passed via --endpoints may not be advertised by the member.
+	for _, status := range statusList {
+		for _, u := range status.Member.URLs {
+			urlIDs[u] = status.Member.ID
+		}
+	}
+
+	healthy := map[uint64]bool{}
+	for _, h := range healthInfos {
+		if id, ok := urlIDs[h.Ep]; ok && h.Health && voters[id] {
+			healthy[id] = true
+		}
+	}
+	return len(voters), len(healthy)
+}
+
+// clusterAggregates aggregates the status of the members fetched before
+// the defragmentation, so that all members are compared against the same
+// values during a run. The member counts are left to the caller.
+func clusterAggregates(statusList []epStatus) eval.ClusterVariables {
+	var agg eval.ClusterVariables
+	if len(statusList) == 0 {
+		return agg
+	}
+
+	free := make([]int64, 0, len(statusList))
+	agg.ClusterMinDBSize = statusList[0].Resp.DbSize
+	for _, status := range statusList {
+		agg.ClusterMaxDBSize = max(agg.ClusterMaxDBSize, status.Resp.DbSize)
+		agg.ClusterMinDBSize = min(agg.ClusterMinDBSize, status.Resp.DbSize)
+		free = append(free, status.Resp.DbSize-status.Resp.DbSizeInUse)
+	}
+
+	sort.Slice(free, func(i, j int) bool { return free[i] < free[j] })
+	mid := len(free) / 2
+	if len(free)%2 == 1 {
+		agg.ClusterMedianDBSizeFree = float64(free[mid])
+	} else {
+		agg.ClusterMedianDBSizeFree = float64(free[mid-1]+free[mid]) / 2
+	}
+
+	return agg
+}
+
+// evaluateClusterRule evaluates the rule once for the whole cluster, using
+// the status of all members fetched before the defragmentation.
+func evaluateClusterRule(gcfg config.GlobalConfig, statusList []epStatus, info clusterInfo) (bool, error) {
+	members := make([]eval.Variables, 0, len(statusList))
+	for _, status := range statusList {
+		members = append(members, ruleVariables(gcfg, status, info))
+	}
+	evaluator, err := ruleEvaluator(gcfg)
+	if err != nil {
+		return false, err
+	}
+	return evaluator.EvaluateCluster(gcfg.DefragRule, members, info.aggregates)
+}
+
+// memberRuleResult returns the result of the rule for the member. In cluster
+// scope, it's the result of the rule evaluated once for the whole cluster.
+func memberRuleResult(gcfg config.GlobalConfig, status epStatus, info clusterInfo, clusterResult *bool) (bool, error) {
+	if clusterResult != nil {
+		return *clusterResult, nil
+	}
+	evaluator, err := ruleEvaluator(gcfg)
+	if err != nil {
+		return false, err
+	}
+	return evaluator.Evaluate(gcfg.DefragRule, ruleVariables(gcfg, status, info))
+}
+
+// validateRule validates the rule, and logs the probable mistakes found by the
+// static check. name is the name of the rule in the rules file, if any.
+func validateRule(gcfg config.GlobalConfig, name, rule string) error {
+	evaluator, err := ruleEvaluator(gcfg)
+	if err != nil {
+		return err
+	}
+	validate, lint := evaluator.Validate, eval.Lint
+	if gcfg.RuleScope == config.RuleScopeCluster {
+		validate, lint = evaluator.ValidateCluster, eval.LintCluster
+	}
+	if err := validate(rule); err != nil {
+		return fmt.Errorf("invalid rule %q, error: %w", rule, err)
+	}
+	// The CEL rules are already type checked by validate, the linter only
+	// supports goval.
+	var warnings []eval.Warning
+	if !isCELRule(gcfg) {
+		if warnings, err = lint(rule); err != nil {
+			return fmt.Errorf("invalid rule %q, error: %w", rule, err)
+		}
+	}
+	for _, w := range warnings {
+		lg.Warn("Possible mistake in the defragmentation rule", logging.Phase(phaseValidation), logging.RuleName(name), zap.String("expression", w.Expr), zap.String("warning", w.Message))
+	}
+	if len(warnings) > 0 && gcfg.StrictRules {
+		return fmt.Errorf("the rule %q has %d warning(s), and --strict-rules is set", rule, len(warnings))
+	}
+	return nil
+}
+
+// validateScore validates --defrag-score.
+func validateScore(gcfg config.GlobalConfig) error {
+	evaluator, err := ruleEvaluator(gcfg)
+	if err != nil {
+		return err
+	}
+	if err := evaluator.ValidateScore(gcfg.DefragScore); err != nil {
+		return fmt.Errorf("invalid score %q, error: %w", gcfg.DefragScore, err)
+	}
+	return nil
+}
+
+// loadRules loads the rules file, if any. It's loaded on each run, so that
+// the changes are picked up in daemon mode.
+func loadRules(gcfg config.GlobalConfig) ([]config.MemberRule, error) {
+	if gcfg.RulesFile == "" {
+		return nil, nil
+	}
+	rules, err := config.LoadRulesFile(gcfg.RulesFile)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range rules {
+		if err := validateRule(gcfg, r.Name, r.Rule); err != nil {
+			return nil, fmt.Errorf("rule %q in rules file %q: %w", r.Name, gcfg.RulesFile, err)
+		}
+	}
+	return rules, nil
+}
+
+// memberRule returns the rule applying to the member: the first rule in the
+// rules file whose selector matches the member, or the unnamed rule set by
+// --defrag-rule. It returns false if no rule in the rules file matches.
+func memberRule(gcfg config.GlobalConfig, rules []config.MemberRule, status epStatus, info clusterInfo) (config.MemberRule, bool) {
+	if gcfg.RulesFile == "" {
+		return config.MemberRule{Rule: gcfg.DefragRule}, true
+	}
+	memberID := status.Resp.Header.MemberId
+	return config.MatchRule(rules, info.memberNames[memberID], memberID, status.Resp.Leader == memberID)
+}
+
+// withRule returns the configuration used to evaluate the rule of a member,
+// the rule replaces --defrag-rule, and its quota --etcd-storage-quota-bytes.
+func withRule(gcfg config.GlobalConfig, rule config.MemberRule) config.GlobalConfig {
+	gcfg.DefragRule = rule.Rule
+	if rule.EtcdStorageQuotaBytes > 0 {
+		gcfg.EtcdStorageQuotaBytes = rule.EtcdStorageQuotaBytes
+	}
+	return gcfg
+}
+
+// sortMembersByScore sorts the members in descending order of
+// --defrag-score, evaluated against the status fetched before the
+// defragmentation. The leader still goes last. It returns the score of each
+// member by ID, or nil if no score is set.
+func sortMembersByScore(gcfg config.GlobalConfig, members []member, statusList []epStatus, rules []config.MemberRule, info clusterInfo) ([]member, map[uint64]float64, error) {
+	if gcfg.DefragScore == "" {
+		return members, nil, nil
+	}
+	evaluator, err := ruleEvaluator(gcfg)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	statuses := map[uint64]epStatus{}
+	for _, status := range statusList {
+		statuses[status.Resp.Header.MemberId] = status
+	}
+	scores := map[uint64]float64{}
+	leaders := map[uint64]bool{}
+	for _, m := range members {
+		status, ok := statuses[m.ID]
+		if !ok {
+			continue
+		}
+		// The quota of the member's rule applies to the score too.
+		scfg := gcfg
+		if rule, ok := memberRule(gcfg, rules, status, info); ok {
+			scfg = withRule(gcfg, rule)
+		}
+		score, err := evaluator.Score(gcfg.DefragScore, ruleVariables(scfg, status, info))
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to evaluate the score of member %s: %w", m, err)
+		}
+		scores[m.ID] = score
+		leaders[m.ID] = status.Resp.Leader == status.Resp.Header.MemberId
+	}
+
+	sorted := append([]member(nil), members...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if leaders[sorted[i].ID] != leaders[sorted[j].ID] {
+			return leaders[sorted[j].ID]
+		}
+		return scores[sorted[i].ID] > scores[sorted[j].ID]
+	})
+	return sorted, scores, nil
+}
+
+// ruleEvaluator returns the evaluator of the language of the defragmentation
+// rule.
+func ruleEvaluator(gcfg config.GlobalConfig) (eval.Evaluator, error) {
+	return eval.NewEvaluator(gcfg.RuleLanguage)
+}
+
+func isCELRule(gcfg config.GlobalConfig) bool {
+	return gcfg.RuleLanguage == eval.LanguageCEL
+}
+
+// decidingVariables returns the variables which decided the result of the
+// rule for the member, as name=value. It's only available for the goval rules
+// in member scope.
+func decidingVariables(gcfg config.GlobalConfig, status epStatus, info clusterInfo, clusterResult *bool) []string {
+	if clusterResult != nil || isCELRule(gcfg) {
+		return nil
+	}
+	exp, err := eval.Explain(gcfg.DefragRule, ruleVariables(gcfg, status, info))
+	if err != nil {
+		return nil
+	}
+	var vars []string
+	for _, v := range exp.Deciding {
+		vars = append(vars, v.String())
+	}
+	return vars
+}
+
+// ruleVariables returns the variables of the member used to evaluate the
+// defragmentation rule.
+func ruleVariables(gcfg config.GlobalConfig, status epStatus, info clusterInfo) eval.Variables {
+	resp := status.Resp
+	memberID := resp.Header.MemberId
+	return eval.Variables{
+		DBQuota:          status.dbQuota(gcfg),
+		DBSize:           resp.DbSize,
+		DBSizeInUse:      resp.DbSizeInUse,
+		IsLeader:         resp.Leader == memberID,
+		IsLearner:        resp.IsLearner,
+		RaftTerm:         resp.RaftTerm,
+		RaftIndex:        resp.RaftIndex,
+		RaftAppliedIndex: resp.RaftAppliedIndex,
+		Revision:         resp.Header.Revision,
+		Version:          resp.Version,
+		MemberName:       info.memberNames[memberID],
+		NoSpaceAlarms:    info.noSpaceAlarms[memberID],
+		ClusterVariables: info.aggregates,
+	}
+}
+
+// selectMembersPerRun returns the IDs of the members selected by
+// --max-members-per-run, or nil if there's no limit: the first members
+// passing the rule, by descending score regardless of the leader, against the
+// status fetched before the defragmentation. The caller still defragments
+// them with the leader last.
+func selectMembersPerRun(gcfg config.GlobalConfig, members []member, statusList []epStatus, scores map[uint64]float64, rules []config.MemberRule, info clusterInfo, clusterResult *bool) map[uint64]bool {
+	if gcfg.MaxMembersPerRun <= 0 {
+		return nil
+	}
+	statuses := map[uint64]epStatus{}
+	for _, status := range statusList {
+		statuses[status.Resp.Header.MemberId] = status
+	}
+
+	ranked := append([]member(nil), members...)
+	sort.SliceStable(ranked, func(i, j int) bool {
+		return scores[ranked[i].ID] > scores[ranked[j].ID]
+	})
+	selected := map[uint64]bool{}
+	for _, m := range ranked {
+		if len(selected) >= gcfg.MaxMembersPerRun {
+			break
+		}
+		status, ok := statuses[m.ID]
+		if !ok {
+			continue
+		}
+		rule, ok := memberRule(gcfg, rules, status, info)
+		if !ok {
+			continue
+		}
+		// An evaluation error is reported when the member is processed.
+		if ret, err := memberRuleResult(withRule(gcfg, rule), status, info, clusterResult); err != nil || !ret {
+			continue
+		}
+		selected[m.ID] = true
+	}
+	return selected
+}
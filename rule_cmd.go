@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/ahrtr/etcd-defrag/internal/eval"
+)
+
+// ruleCmdConfig holds the flags of the rule subcommands.
+type ruleCmdConfig struct {
+	rule     string
+	language string
+	vars     []string
+}
+
+func newRuleCommand() *cobra.Command {
+	ruleCmd := &cobra.Command{
+		Use:   "rule",
+		Short: "Test or explain a defragmentation rule offline, without connecting to etcd",
+	}
+
+	var cfg ruleCmdConfig
+	testCmd := &cobra.Command{
+		Use:   "test",
+		Short: "Evaluate a defragmentation rule against the given variables",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return ruleTest(cmd.OutOrStdout(), cfg)
+		},
+	}
+	explainCmd := &cobra.Command{
+		Use:   "explain",
+		Short: "Print the value of every sub-expression of a defragmentation rule, and the variables deciding the result",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return ruleExplain(cmd.OutOrStdout(), cfg)
+		},
+	}
+
+	for _, c := range []*cobra.Command{testCmd, explainCmd} {
+		// Don't print the usage when the rule is invalid.
+		c.SilenceUsage = true
+		c.Flags().StringVar(&cfg.rule, "rule", "", "the defragmentation rule, same as --defrag-rule")
+		c.Flags().StringVar(&cfg.language, "rule-language", eval.LanguageGoval, "language of the rule, same as --rule-language")
+		c.Flags().StringArrayVar(&cfg.vars, "var", nil,
+			"value of a variable as name=value, e.g. --var dbSize=104857600. It can be repeated. dbQuota defaults to 2GiB, and the other variables to 0, false or an empty string")
+		_ = c.MarkFlagRequired("rule")
+		ruleCmd.AddCommand(c)
+	}
+
+	return ruleCmd
+}
+
+// variables returns the rule variables set by --var.
+func (cfg ruleCmdConfig) variables() (eval.Variables, error) {
+	vars := eval.Variables{DBQuota: 2 * 1024 * 1024 * 1024}
+	for _, kv := range cfg.vars {
+		name, value, ok := strings.Cut(kv, "=")
+		if !ok {
+			return vars, fmt.Errorf("invalid --var %q, expected name=value", kv)
+		}
+		if err := vars.SetVariable(strings.TrimSpace(name), strings.TrimSpace(value)); err != nil {
+			return vars, err
+		}
+	}
+	if vars.DBQuota <= 0 {
+		return vars, errors.New("dbQuota must be greater than 0")
+	}
+	return vars, nil
+}
+
+func ruleTest(w io.Writer, cfg ruleCmdConfig) error {
+	evaluator, err := eval.NewEvaluator(cfg.language)
+	if err != nil {
+		return err
+	}
+	if err := evaluator.Validate(cfg.rule); err != nil {
+		return fmt.Errorf("invalid rule %q, error: %w", cfg.rule, err)
+	}
+	vars, err := cfg.variables()
+	if err != nil {
+		return err
+	}
+
+	result, err := evaluator.Evaluate(cfg.rule, vars)
+	if err != nil {
+		return fmt.Errorf("failed to evaluate the rule: %w", err)
+	}
+	fmt.Fprintf(w, "Result: %t\n", result)
+	return nil
+}
+
+func ruleExplain(w io.Writer, cfg ruleCmdConfig) error {
+	if cfg.language != "" && cfg.language != eval.LanguageGoval {
+		return fmt.Errorf("explain only supports the %s rules", eval.LanguageGoval)
+	}
+	if err := eval.ValidateRule(cfg.rule); err != nil {
+		return fmt.Errorf("invalid rule %q, error: %w", cfg.rule, err)
+	}
+	vars, err := cfg.variables()
+	if err != nil {
+		return err
+	}
+
+	exp, err := eval.Explain(cfg.rule, vars)
+	if err != nil {
+		return fmt.Errorf("failed to explain the rule: %w", err)
+	}
+
+	fmt.Fprintf(w, "Rule: %s\n", cfg.rule)
+	fmt.Fprintf(w, "Result: %t\n", exp.Result)
+	fmt.Fprintln(w, "Sub-expressions:")
+	for _, step := range exp.Steps {
+		fmt.Fprintf(w, "%s%s => %s\n", strings.Repeat("  ", step.Depth+1), step.Expr, step.Value)
+	}
+	fmt.Fprintf(w, "Decided by: %s\n", joinVariables(exp.Deciding))
+
+	warnings, err := eval.Lint(cfg.rule)
+	if err != nil {
+		return fmt.Errorf("failed to check the rule: %w", err)
+	}
+	for _, warning := range warnings {
+		fmt.Fprintf(w, "Warning: %s\n", warning)
+	}
+	return nil
+}
+
+func joinVariables(vars []eval.VariableValue) string {
+	if len(vars) == 0 {
+		return "no variable"
+	}
+	s := make([]string, 0, len(vars))
+	for _, v := range vars {
+		s = append(s, v.String())
+	}
+	return strings.Join(s, ", ")
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRuleCommand(t *testing.T) {
+	testCases := []struct {
+		name        string
+		args        []string
+		expected    string
+		expectedErr string
+	}{
+		{
+			name:     "test true",
+			args:     []string{"test", "--rule", "dbSizeFree > 100 && !isLeader", "--var", "dbSize=300", "--var", "dbSizeInUse=100"},
+			expected: "Result: true\n",
+		},
+		{
+			name:     "test with the default quota",
+			args:     []string{"test", "--rule", "dbQuotaUsage > 0.5", "--var", "dbSize=1073741824"},
+			expected: "Result: false\n",
+		},
+		{
+			name: "explain",
+			args: []string{"explain", "--rule", "dbQuotaUsage > 0.8 || (dbSizeFree > 200)", "--var", "dbQuota=1000", "--var", "dbSize=500", "--var", "dbSizeInUse=400"},
+			expected: `Rule: dbQuotaUsage > 0.8 || (dbSizeFree > 200)
+Result: false
+Sub-expressions:
+  dbQuotaUsage > 0.8 || (dbSizeFree > 200) => false
+    dbQuotaUsage > 0.8 => false
+      dbQuotaUsage => 0.5
+    dbSizeFree > 200 => false
+      dbSizeFree => 100
+Decided by: dbQuotaUsage=0.5, dbSizeFree=100
+`,
+		},
+		{
+			name: "explain with warnings",
+			args: []string{"explain", "--rule", "dbQuotaUsage > 80", "--var", "dbQuota=1000", "--var", "dbSize=500"},
+			expected: `Rule: dbQuotaUsage > 80
+Result: false
+Sub-expressions:
+  dbQuotaUsage > 80 => false
+    dbQuotaUsage => 0.5
+Decided by: dbQuotaUsage=0.5
+Warning: "dbQuotaUsage > 80": dbQuotaUsage is a ratio usually between 0 and 1, comparing it with 80 is probably a mistake, did you mean 80%?
+`,
+		},
+		{
+			name:     "test cel",
+			args:     []string{"test", "--rule-language", "cel", "--rule", "dbSizeFree > 100 && semver(version) >= semver(\"3.6.0\")", "--var", "dbSize=300", "--var", "version=3.6.1"},
+			expected: "Result: true\n",
+		},
+		{
+			name:        "cel type error",
+			args:        []string{"test", "--rule-language", "cel", "--rule", "dbSize > dbQuota * 0.8"},
+			expectedErr: `invalid rule "dbSize > dbQuota * 0.8"`,
+		},
+		{
+			name:        "explain cel",
+			args:        []string{"explain", "--rule-language", "cel", "--rule", "dbSize > 100"},
+			expectedErr: "explain only supports the goval rules",
+		},
+		{
+			name:        "invalid rule",
+			args:        []string{"test", "--rule", "dbSizE > 100"},
+			expectedErr: `invalid rule "dbSizE > 100"`,
+		},
+		{
+			name:        "invalid variable",
+			args:        []string{"explain", "--rule", "dbSize > 100", "--var", "dbSize"},
+			expectedErr: `invalid --var "dbSize", expected name=value`,
+		},
+		{
+			name:        "derived variable",
+			args:        []string{"test", "--rule", "dbSize > 100", "--var", "dbSizeFree=100"},
+			expectedErr: "dbSizeFree is derived from the other variables and can't be set",
+		},
+		{
+			name:        "missing rule",
+			args:        []string{"test"},
+			expectedErr: `required flag(s) "rule" not set`,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cmd := newRuleCommand()
+			var out bytes.Buffer
+			cmd.SetOut(&out)
+			cmd.SetErr(&bytes.Buffer{})
+			cmd.SetArgs(tc.args)
+
+			err := cmd.Execute()
+			if tc.expectedErr != "" {
+				require.ErrorContains(t, err, tc.expectedErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, out.String())
+		})
+	}
+}
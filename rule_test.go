@@ -0,0 +1,486 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/stretchr/testify/require"
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+
+	"github.com/ahrtr/etcd-defrag/internal/config"
+	"github.com/ahrtr/etcd-defrag/internal/eval"
+)
+
+func TestRuleVariables(t *testing.T) {
+	gcfg := config.GlobalConfig{EtcdStorageQuotaBytes: 1000}
+	info := clusterInfo{
+		memberNames:   map[uint64]string{1: "infra1", 2: "infra2"},
+		noSpaceAlarms: map[uint64]int{2: 1},
+	}
+	status := epStatus{
+		Ep: "ep2",
+		Resp: &clientv3.StatusResponse{
+			Header:           &etcdserverpb.ResponseHeader{MemberId: 2, Revision: 50},
+			Version:          "3.6.1",
+			DbSize:           800,
+			DbSizeInUse:      300,
+			Leader:           2,
+			RaftTerm:         3,
+			RaftIndex:        120,
+			RaftAppliedIndex: 118,
+		},
+	}
+
+	require.Equal(t, eval.Variables{
+		DBQuota:          1000,
+		DBSize:           800,
+		DBSizeInUse:      300,
+		IsLeader:         true,
+		RaftTerm:         3,
+		RaftIndex:        120,
+		RaftAppliedIndex: 118,
+		Revision:         50,
+		Version:          "3.6.1",
+		MemberName:       "infra2",
+		NoSpaceAlarms:    1,
+	}, ruleVariables(gcfg, status, info))
+
+	status.Resp.Header.MemberId = 1
+	vars := ruleVariables(gcfg, status, info)
+	require.False(t, vars.IsLeader)
+	require.Equal(t, "infra1", vars.MemberName)
+	require.Equal(t, 0, vars.NoSpaceAlarms)
+}
+
+func TestClusterAggregates(t *testing.T) {
+	status := func(dbSize, dbSizeInUse int64) epStatus {
+		return epStatus{Resp: &clientv3.StatusResponse{DbSize: dbSize, DbSizeInUse: dbSizeInUse}}
+	}
+	testCases := []struct {
+		name       string
+		statusList []epStatus
+		expected   eval.ClusterVariables
+	}{
+		{
+			name:       "no status",
+			statusList: nil,
+			expected:   eval.ClusterVariables{},
+		},
+		{
+			name:       "odd number of members",
+			statusList: []epStatus{status(500, 100), status(300, 250), status(900, 100)},
+			expected: eval.ClusterVariables{
+				ClusterMaxDBSize:        900,
+				ClusterMinDBSize:        300,
+				ClusterMedianDBSizeFree: 400,
+			},
+		},
+		{
+			name:       "even number of members",
+			statusList: []epStatus{status(500, 100), status(300, 250), status(900, 100), status(400, 300)},
+			expected: eval.ClusterVariables{
+				ClusterMaxDBSize:        900,
+				ClusterMinDBSize:        300,
+				ClusterMedianDBSizeFree: 250,
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			require.Equal(t, tc.expected, clusterAggregates(tc.statusList))
+		})
+	}
+}
+
+func TestMemberCounts(t *testing.T) {
+	list := []*etcdserverpb.Member{
+		{ID: 1, ClientURLs: []string{"https://10.0.0.1:2379", "https://etcd-1:2379"}},
+		{ID: 2, ClientURLs: []string{"https://10.0.0.2:2379"}},
+		{ID: 3, ClientURLs: []string{"https://10.0.0.3:2379"}},
+		{ID: 4, ClientURLs: []string{"https://10.0.0.4:2379"}, IsLearner: true},
+	}
+	statusList := []epStatus{{Member: member{ID: 2, URLs: []string{"https://etcd-lb:2379", "https://10.0.0.2:2379"}}}}
+
+	testCases := []struct {
+		name            string
+		healthInfos     []epHealth
+		expectedHealthy int
+	}{
+		{
+			name: "member with two URLs counted once",
+			healthInfos: []epHealth{
+				{Ep: "https://10.0.0.1:2379", Health: true},
+				{Ep: "https://etcd-1:2379", Health: true},
+				{Ep: "https://10.0.0.2:2379", Health: true},
+				{Ep: "https://10.0.0.3:2379", Health: true},
+				{Ep: "https://10.0.0.4:2379", Health: true},
+			},
+			expectedHealthy: 3,
+		},
+		{
+			name: "member healthy via one of its URLs",
+			healthInfos: []epHealth{
+				{Ep: "https://10.0.0.1:2379", Health: false},
+				{Ep: "https://etcd-1:2379", Health: true},
+				{Ep: "https://10.0.0.3:2379", Health: false},
+			},
+			expectedHealthy: 1,
+		},
+		{
+			name:            "URL not advertised by the member",
+			healthInfos:     []epHealth{{Ep: "https://etcd-lb:2379", Health: true}, {Ep: "https://unknown:2379", Health: true}},
+			expectedHealthy: 1,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			voters, healthy := memberCounts(list, statusList, tc.healthInfos)
+			require.Equal(t, 3, voters)
+			require.Equal(t, tc.expectedHealthy, healthy)
+		})
+	}
+}
+
+func TestMemberRuleResult_ClusterScope(t *testing.T) {
+	status := func(id uint64, dbSize int64) epStatus {
+		return epStatus{Resp: &clientv3.StatusResponse{
+			Header: &etcdserverpb.ResponseHeader{MemberId: id},
+			DbSize: dbSize,
+		}}
+	}
+	statusList := []epStatus{status(1, 900), status(2, 300), status(3, 400)}
+	info := clusterInfo{aggregates: clusterAggregates(statusList)}
+
+	// In member scope only the first member would be defragmented, in cluster
+	// scope all of them are.
+	gcfg := config.GlobalConfig{
+		EtcdStorageQuotaBytes: 1000,
+		DefragRule:            "clusterMaxDbSize > 800",
+		RuleScope:             config.RuleScopeCluster,
+	}
+	ret, err := evaluateClusterRule(gcfg, statusList, info)
+	require.NoError(t, err)
+	require.True(t, ret)
+	for _, s := range statusList {
+		result, err := memberRuleResult(gcfg, s, info, &ret)
+		require.NoError(t, err)
+		require.True(t, result)
+	}
+
+	gcfg.DefragRule = "members[1].dbSize > 800"
+	ret, err = evaluateClusterRule(gcfg, statusList, info)
+	require.NoError(t, err)
+	require.False(t, ret)
+
+	gcfg.RuleScope = config.RuleScopeMember
+	gcfg.DefragRule = "dbSize > 800"
+	result, err := memberRuleResult(gcfg, statusList[0], info, nil)
+	require.NoError(t, err)
+	require.True(t, result)
+	result, err = memberRuleResult(gcfg, statusList[1], info, nil)
+	require.NoError(t, err)
+	require.False(t, result)
+}
+
+func TestValidateConfig_Rule(t *testing.T) {
+	testCases := []struct {
+		name        string
+		cfg         config.GlobalConfig
+		expectedErr string
+	}{
+		{
+			name: "warnings are only logged by default",
+			cfg:  config.GlobalConfig{DefragRule: "dbQuotaUsage > 80"},
+		},
+		{
+			name: "no warning under --strict-rules",
+			cfg:  config.GlobalConfig{DefragRule: "dbQuotaUsage > 80%", StrictRules: true},
+		},
+		{
+			name:        "warnings fail under --strict-rules",
+			cfg:         config.GlobalConfig{DefragRule: "dbQuotaUsage > 80", StrictRules: true},
+			expectedErr: `the rule "dbQuotaUsage > 80" has 1 warning(s), and --strict-rules is set`,
+		},
+		{
+			name:        "cluster scope",
+			cfg:         config.GlobalConfig{DefragRule: "dbSize > 100", RuleScope: config.RuleScopeCluster},
+			expectedErr: `invalid rule "dbSize > 100"`,
+		},
+		{
+			name: "cel",
+			cfg:  config.GlobalConfig{DefragRule: "dbQuotaUsage > 0.8 && !isLeader", RuleLanguage: eval.LanguageCEL, StrictRules: true},
+		},
+		{
+			name:        "cel type error",
+			cfg:         config.GlobalConfig{DefragRule: "memberName > 1", RuleLanguage: eval.LanguageCEL},
+			expectedErr: `invalid rule "memberName > 1"`,
+		},
+		{
+			name:        "rules file with --defrag-rule",
+			cfg:         config.GlobalConfig{DefragRule: "dbSize > 100", RulesFile: "rules.yaml"},
+			expectedErr: "--rules-file and --defrag-rule can't be used together",
+		},
+		{
+			name:        "invalid score",
+			cfg:         config.GlobalConfig{DefragScore: "dbSize > 100"},
+			expectedErr: `invalid score "dbSize > 100"`,
+		},
+		{
+			name:        "negative --max-members-per-run",
+			cfg:         config.GlobalConfig{MaxMembersPerRun: -1},
+			expectedErr: "--max-members-per-run must not be negative",
+		},
+		{
+			name:        "unknown language",
+			cfg:         config.GlobalConfig{DefragRule: "dbSize > 100", RuleLanguage: "lua"},
+			expectedErr: `invalid --rule-language "lua"`,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.cfg.EtcdStorageQuotaBytes = 2 * 1024 * 1024 * 1024
+			err := validateConfig(&cobra.Command{}, tc.cfg)
+			if tc.expectedErr == "" {
+				require.NoError(t, err)
+			} else {
+				require.ErrorContains(t, err, tc.expectedErr)
+			}
+		})
+	}
+}
+
+func TestMemberRule(t *testing.T) {
+	rulesFile := filepath.Join(t.TempDir(), "rules.yaml")
+	require.NoError(t, os.WriteFile(rulesFile, []byte(`rules:
+- name: leader
+  selector:
+    role: leader
+  rule: dbQuotaUsage > 0.5
+- name: big
+  selector:
+    member-name: ^big-
+  rule: dbQuotaUsage > 0.8
+  etcd-storage-quota-bytes: 4000
+- name: infra3
+  selector:
+    member-id: "3"
+    role: follower
+  rule: dbSize > 100
+`), 0o600))
+
+	gcfg := config.GlobalConfig{EtcdStorageQuotaBytes: 1000, RulesFile: rulesFile}
+	rules, err := loadRules(gcfg)
+	require.NoError(t, err)
+
+	info := clusterInfo{memberNames: map[uint64]string{1: "big-1", 2: "big-2", 3: "infra3", 4: "infra4"}}
+	status := func(id uint64) epStatus {
+		return epStatus{Resp: &clientv3.StatusResponse{
+			Header: &etcdserverpb.ResponseHeader{MemberId: id},
+			Leader: 1,
+			DbSize: 2000,
+		}}
+	}
+
+	testCases := []struct {
+		memberID     uint64
+		expectedRule string
+		expected     bool
+	}{
+		// the leader rule comes first, so the quota of the big rule
+		// doesn't apply
+		{memberID: 1, expectedRule: "leader", expected: true},
+		{memberID: 2, expectedRule: "big", expected: false},
+		{memberID: 3, expectedRule: "infra3", expected: true},
+		{memberID: 4},
+	}
+	for _, tc := range testCases {
+		rule, ok := memberRule(gcfg, rules, status(tc.memberID), info)
+		require.Equal(t, tc.expectedRule != "", ok)
+		if !ok {
+			continue
+		}
+		require.Equal(t, tc.expectedRule, rule.Name)
+		result, err := memberRuleResult(withRule(gcfg, rule), status(tc.memberID), info, nil)
+		require.NoError(t, err)
+		require.Equal(t, tc.expected, result, tc.expectedRule)
+	}
+
+	// Without a rules file, --defrag-rule applies to all members.
+	gcfg = config.GlobalConfig{DefragRule: "dbSize > 100"}
+	rule, ok := memberRule(gcfg, nil, status(4), info)
+	require.True(t, ok)
+	require.Equal(t, config.MemberRule{Rule: "dbSize > 100"}, rule)
+}
+
+func TestLoadRules_Error(t *testing.T) {
+	testCases := []struct {
+		name        string
+		content     string
+		expectedErr string
+	}{
+		{
+			name:        "no rule",
+			content:     "rules: []",
+			expectedErr: "no rule in rules file",
+		},
+		{
+			name:        "unknown key",
+			content:     "rules:\n- name: a\n  rul: dbSize > 100",
+			expectedErr: "field rul not found",
+		},
+		{
+			name:        "missing name",
+			content:     "rules:\n- rule: dbSize > 100",
+			expectedErr: "the name is empty",
+		},
+		{
+			name:        "duplicate name",
+			content:     "rules:\n- name: a\n- name: a",
+			expectedErr: `duplicate rule name "a"`,
+		},
+		{
+			name:        "invalid regex",
+			content:     "rules:\n- name: a\n  selector:\n    member-name: \"(\"",
+			expectedErr: `invalid member-name "("`,
+		},
+		{
+			name:        "invalid member ID",
+			content:     "rules:\n- name: a\n  selector:\n    member-id: xyz",
+			expectedErr: `invalid member-id "xyz"`,
+		},
+		{
+			name:        "invalid role",
+			content:     "rules:\n- name: a\n  selector:\n    role: learner",
+			expectedErr: `invalid role "learner"`,
+		},
+		{
+			name:        "invalid rule",
+			content:     "rules:\n- name: a\n  rule: dbSizE > 100",
+			expectedErr: `rule "a" in rules file`,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rulesFile := filepath.Join(t.TempDir(), "rules.yaml")
+			require.NoError(t, os.WriteFile(rulesFile, []byte(tc.content), 0o600))
+			_, err := loadRules(config.GlobalConfig{RulesFile: rulesFile})
+			require.ErrorContains(t, err, tc.expectedErr)
+		})
+	}
+}
+
+func TestSortMembersByScore(t *testing.T) {
+	status := func(ep string, id uint64, dbSize, dbSizeInUse int64) epStatus {
+		return epStatus{Ep: ep, Member: member{ID: id, Name: ep, URLs: []string{ep}}, Resp: &clientv3.StatusResponse{
+			Header:      &etcdserverpb.ResponseHeader{MemberId: id},
+			Leader:      1,
+			DbSize:      dbSize,
+			DbSizeInUse: dbSizeInUse,
+		}}
+	}
+	statusList := []epStatus{
+		status("ep1", 1, 1000, 100),
+		status("ep2", 2, 1000, 800),
+		status("ep3", 3, 1000, 500),
+		status("ep4", 4, 1000, 300),
+	}
+	members := membersWithLeaderAtEnd(statusList)
+	names := func(members []member) []string {
+		var ret []string
+		for _, m := range members {
+			ret = append(ret, m.Name)
+		}
+		return ret
+	}
+	gcfg := config.GlobalConfig{EtcdStorageQuotaBytes: 2000}
+
+	sorted, scores, err := sortMembersByScore(gcfg, members, statusList, nil, clusterInfo{})
+	require.NoError(t, err)
+	require.Equal(t, []string{"ep2", "ep3", "ep4", "ep1"}, names(sorted))
+	require.Nil(t, scores)
+
+	// The leader ep1 has the highest score, but it still goes last.
+	gcfg.DefragScore = "dbSizeFree"
+	sorted, scores, err = sortMembersByScore(gcfg, members, statusList, nil, clusterInfo{})
+	require.NoError(t, err)
+	require.Equal(t, []string{"ep4", "ep3", "ep2", "ep1"}, names(sorted))
+	require.Equal(t, map[uint64]float64{1: 900, 2: 200, 3: 500, 4: 700}, scores)
+
+	gcfg.DefragScore = "dbSizeFree / (dbSize - 1000)"
+	_, _, err = sortMembersByScore(gcfg, members, statusList, nil, clusterInfo{})
+	require.ErrorContains(t, err, "failed to evaluate the score of member ep2(2)")
+}
+
+func TestRunDefrag_MaxMembersPerRun(t *testing.T) {
+	oldCreateClient := createClient
+	t.Cleanup(func() {
+		createClient = oldCreateClient
+	})
+
+	// dbSizeFree is 700 on etcd-1, 200 on etcd-2, and 900 on the leader
+	// etcd-3.
+	inUse := map[string]int64{"ep1": 300, "ep2": 800, "ep3": 100}
+	onStatus := func(ep string, resp *clientv3.StatusResponse) error {
+		resp.DbSizeInUse = inUse[ep]
+		return nil
+	}
+	onDefrag := func(ctx context.Context, ep string) error {
+		return nil
+	}
+	createClient = func(cfgSpec *clientv3.ConfigSpec) (EtcdCluster, error) {
+		return &fakeClusterClient{onDefrag: onDefrag, onStatus: onStatus}, nil
+	}
+
+	testCases := []struct {
+		name             string
+		maxMembersPerRun int
+		defragRule       string
+		expectedActions  []string
+	}{
+		{
+			name:             "no limit",
+			maxMembersPerRun: 0,
+			expectedActions:  []string{"etcd-1:defragmented", "etcd-2:defragmented", "etcd-3:defragmented"},
+		},
+		{
+			name:             "leader with the highest score",
+			maxMembersPerRun: 2,
+			expectedActions:  []string{"etcd-1:defragmented", "etcd-2:skipped", "etcd-3:defragmented"},
+		},
+		{
+			name:             "only the leader",
+			maxMembersPerRun: 1,
+			expectedActions:  []string{"etcd-1:skipped", "etcd-2:skipped", "etcd-3:defragmented"},
+		},
+		{
+			name:             "leader not passing the rule",
+			maxMembersPerRun: 1,
+			defragRule:       "dbSizeFree < 800",
+			expectedActions:  []string{"etcd-1:defragmented", "etcd-2:skipped", "etcd-3:skipped"},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			reportFile := filepath.Join(t.TempDir(), "report.json")
+			gcfg := config.GlobalConfig{
+				Endpoints:             []string{"ep1"},
+				Cluster:               true,
+				CommandTimeout:        time.Minute,
+				DefragScore:           "dbSizeFree",
+				DefragRule:            tc.defragRule,
+				MaxMembersPerRun:      tc.maxMembersPerRun,
+				EtcdStorageQuotaBytes: 2 * 1024 * 1024 * 1024,
+				ReportFile:            reportFile,
+				ReportFormat:          "json",
+			}
+			require.NoError(t, runDefrag(context.Background(), gcfg))
+
+			require.Equal(t, tc.expectedActions, reportActions(t, reportFile))
+		})
+	}
+}
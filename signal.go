@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"go.uber.org/zap"
+)
+
+// exitCodeInterrupted is the exit code when the run is interrupted by a
+// signal, so that it can be told apart from a failed run.
+const exitCodeInterrupted = 3
+
+// errInterrupted is returned by a run interrupted by a signal.
+var errInterrupted = errors.New("interrupted")
+
+// signalContext returns a context cancelled on SIGTERM or SIGINT, along with
+// the function to release it. After the first signal, the default behavior is
+// restored, so that a second one terminates the process immediately.
+func signalContext() (context.Context, func()) {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGTERM, os.Interrupt)
+
+	done := make(chan struct{})
+	go func() {
+		defer signal.Stop(ch)
+		select {
+		case sig := <-ch:
+			lg.Warn("Received signal, stopping after the current operation. Send it again to exit immediately", zap.Stringer("signal", sig))
+			cancel(fmt.Errorf("signal %v", sig))
+		case <-done:
+		}
+	}()
+
+	return ctx, func() {
+		close(done)
+		cancel(nil)
+	}
+}
+
+// interrupted returns the error of a run interrupted because the context is
+// done, e.g. "interrupted by signal terminated".
+func interrupted(ctx context.Context) error {
+	return fmt.Errorf("%w by %w", errInterrupted, context.Cause(ctx))
+}
+
+// interruptedError wraps the error of a run whose context is done, since the
+// error is most likely caused by the interruption.
+func interruptedError(ctx context.Context, err error) error {
+	if err == nil || ctx.Err() == nil || errors.Is(err, errInterrupted) {
+		return err
+	}
+	return fmt.Errorf("%w: %w", interrupted(ctx), err)
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+
+	"github.com/ahrtr/etcd-defrag/internal/config"
+)
+
+// fakeClusterClient serves a healthy 3 member cluster whose leader is member
+// 3, member N listening on the endpoint "epN". onDefrag is called by the
+// defragmentation requests, and onStatus, if set, by the status requests.
+type fakeClusterClient struct {
+	*clientv3.Client
+	onDefrag func(ctx context.Context, ep string) error
+	onStatus func(ep string, resp *clientv3.StatusResponse) error
+	// onMoveLeader is called with the transferee ID, if set.
+	onMoveLeader func(transfereeID uint64) error
+}
+
+func (f *fakeClusterClient) Get(ctx context.Context, key string, opts ...clientv3.OpOption) (*clientv3.GetResponse, error) {
+	return &clientv3.GetResponse{}, nil
+}
+
+func (f *fakeClusterClient) AlarmList(ctx context.Context) (*clientv3.AlarmResponse, error) {
+	return &clientv3.AlarmResponse{}, nil
+}
+
+func (f *fakeClusterClient) MemberList(ctx context.Context, opts ...clientv3.OpOption) (*clientv3.MemberListResponse, error) {
+	return &clientv3.MemberListResponse{Members: []*etcdserverpb.Member{
+		{ID: 1, Name: "etcd-1", ClientURLs: []string{"ep1"}},
+		{ID: 2, Name: "etcd-2", ClientURLs: []string{"ep2"}},
+		{ID: 3, Name: "etcd-3", ClientURLs: []string{"ep3"}},
+	}}, nil
+}
+
+func (f *fakeClusterClient) Status(ctx context.Context, ep string) (*clientv3.StatusResponse, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	resp := &clientv3.StatusResponse{
+		Header:      &etcdserverpb.ResponseHeader{MemberId: uint64(ep[2] - '0')},
+		Leader:      3,
+		DbSize:      1000,
+		DbSizeInUse: 500,
+	}
+	if f.onStatus != nil {
+		if err := f.onStatus(ep, resp); err != nil {
+			return nil, err
+		}
+	}
+	return resp, nil
+}
+
+func (f *fakeClusterClient) Defragment(ctx context.Context, ep string) (*clientv3.DefragmentResponse, error) {
+	return &clientv3.DefragmentResponse{}, f.onDefrag(ctx, ep)
+}
+
+func (f *fakeClusterClient) MoveLeader(ctx context.Context, transfereeID uint64) (*clientv3.MoveLeaderResponse, error) {
+	if f.onMoveLeader == nil {
+		return &clientv3.MoveLeaderResponse{}, nil
+	}
+	return &clientv3.MoveLeaderResponse{}, f.onMoveLeader(transfereeID)
+}
+
+func (f *fakeClusterClient) Close() error {
+	return nil
+}
+
+// readReport reads the JSON report written to --report-file by the run.
+func readReport(t *testing.T, path string) runReport {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	var report runReport
+	require.NoError(t, json.Unmarshal(data, &report))
+	return report
+}
+
+// reportActions returns the actions of the members in the report, as
+// "<member name>:<action>".
+func reportActions(t *testing.T, path string) []string {
+	t.Helper()
+	var actions []string
+	for _, er := range readReport(t, path).Endpoints {
+		actions = append(actions, er.MemberName+":"+er.Action)
+	}
+	return actions
+}
+
+func TestRunDefrag_Interrupted(t *testing.T) {
+	oldCreateClient := createClient
+	t.Cleanup(func() {
+		createClient = oldCreateClient
+	})
+
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+
+	// The run is interrupted while the first member is being defragmented.
+	var defragmented []string
+	onDefrag := func(reqCtx context.Context, ep string) error {
+		defragmented = append(defragmented, ep)
+		cancel(errors.New("signal terminated"))
+		<-reqCtx.Done()
+		return reqCtx.Err()
+	}
+	createClient = func(cfgSpec *clientv3.ConfigSpec) (EtcdCluster, error) {
+		return &fakeClusterClient{onDefrag: onDefrag}, nil
+	}
+
+	reportFile := filepath.Join(t.TempDir(), "report.json")
+	gcfg := config.GlobalConfig{
+		Endpoints:             []string{"ep1"},
+		Cluster:               true,
+		CommandTimeout:        time.Minute,
+		ContinueOnError:       true,
+		EtcdStorageQuotaBytes: 2 * 1024 * 1024 * 1024,
+		ReportFile:            reportFile,
+		ReportFormat:          "json",
+	}
+	err := runDefrag(ctx, gcfg)
+	require.ErrorIs(t, err, errInterrupted)
+	require.EqualError(t, err, "interrupted by signal terminated")
+	require.Equal(t, []string{"ep1"}, defragmented)
+
+	report := readReport(t, reportFile)
+	require.False(t, report.Success)
+	require.True(t, report.Interrupted)
+	require.Equal(t, []string{"etcd-1:interrupted", "etcd-2:notStarted", "etcd-3:notStarted"}, reportActions(t, reportFile))
+}
+
+func TestInterruptedError(t *testing.T) {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	failed := errors.New("failed to get members status")
+	require.NoError(t, interruptedError(ctx, nil))
+	require.Equal(t, failed, interruptedError(ctx, failed))
+
+	cancel(errors.New("signal interrupt"))
+	require.NoError(t, interruptedError(ctx, nil))
+	err := interruptedError(ctx, failed)
+	require.ErrorIs(t, err, errInterrupted)
+	require.ErrorIs(t, err, failed)
+	require.EqualError(t, err, "interrupted by signal interrupt: failed to get members status")
+	require.Equal(t, err, interruptedError(ctx, err))
+}
@@ -5,14 +5,11 @@ import (
 	"io"
 	"time"
 
-	"go.uber.org/zap"
-
-	"go.etcd.io/etcd/client/pkg/v3/logutil"
 	clientv3 "go.etcd.io/etcd/client/v3"
 )
 
-func commandCtx(timeout time.Duration) (context.Context, context.CancelFunc) {
-	return context.WithTimeout(context.Background(), timeout)
+func commandCtx(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, timeout)
 }
 
 // EtcdCluster composes the interfaces needed to interact with the cluster. It mainly exist to enable testing.
@@ -24,10 +21,10 @@ type EtcdCluster interface {
 }
 
 var createClient = func(cfgSpec *clientv3.ConfigSpec) (EtcdCluster, error) {
-	lg, _ := logutil.CreateDefaultZapLogger(zap.InfoLevel)
-	cfg, err := clientv3.NewClientConfig(cfgSpec, lg)
+	cfg, err := clientv3.NewClientConfig(cfgSpec, clientLg)
 	if err != nil {
 		return nil, err
 	}
+	cfg.Logger = clientLg
 	return clientv3.New(*cfg)
 }